@@ -3,7 +3,6 @@ package bot
 import (
 	"context"
 	"fmt"
-	"regexp"
 
 	"github.com/khicago/got/util/typer"
 
@@ -19,7 +18,7 @@ const (
 	CallPrefix = "agent_call::"
 )
 
-var Caller = &call.Caller{Prefix: CallPrefix, Regex: regexp.MustCompile(`agent_call::(\w+)\((.*?)\)`)}
+var Caller = call.NewCaller(CallPrefix)
 
 // InitActAsForBots 初始化所有 ActAs
 func InitActAsForBots(ctx context.Context, allBots ...*Bot) {
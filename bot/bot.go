@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -14,8 +15,10 @@ import (
 	"github.com/bagaking/botheater/driver"
 	"github.com/bagaking/goulp/jsonex"
 	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/got/util/typer"
 	"github.com/khicago/irr"
 
+	"github.com/bagaking/botheater/call"
 	"github.com/bagaking/botheater/call/tool"
 	"github.com/bagaking/botheater/history"
 )
@@ -27,6 +30,26 @@ type (
 		PrefabName string `yaml:"prefab_name,omitempty" json:"prefab_name,omitempty"`
 		Usage      string `yaml:"usage,omitempty" json:"usage,omitempty"`
 
+		// Timeout 每次请求 driver 的超时时间 (如 90s)，不填时只受调用方 ctx 的限制
+		Timeout time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+
+		// DisableNativeTools 关闭原生工具调用，driver 支持 (driver.ToolCaller) 时默认使用原生协议下发 functions
+		DisableNativeTools bool `yaml:"disable_native_tools,omitempty" json:"disable_native_tools,omitempty"`
+
+		// Guard 函数调用的限制，不填时使用 DefaultCallGuard
+		Guard *CallGuard `yaml:"guard,omitempty" json:"guard,omitempty"`
+
+		// ToolBudgets tool 名到输出预算，只对这个 bot 生效，"*" 对没有单独设置的 tool 生效
+		// 不填时使用 tool 自己声明的预算或 tool.DefaultBudget
+		ToolBudgets map[string]*tool.Budget `yaml:"tool_budgets,omitempty" json:"tool_budgets,omitempty"`
+
+		// NodeRetry 作为 workflow 的 bot 节点时，请求或者解析失败的重试策略，节点上 WithRetry 设置的优先
+		// 不填时使用 utils.DefaultNodeRetry；driver 请求本身的重试由 retry 配置
+		NodeRetry *utils.RetryPolicy `yaml:"node_retry,omitempty" json:"node_retry,omitempty"`
+
+		// EmbedderConf 获取向量时使用的 embedder，格式与 driver 的配置相同，如 {driver: ollama, endpoint: nomic-embed-text}
+		EmbedderConf *driver.Config `yaml:"embedder,omitempty" json:"embedder,omitempty"`
+
 		Prompt *Prompt `yaml:"prompt,omitempty" json:"prompt,omitempty"`
 
 		// AckAs 表示这个 agent 的固有角色，用于支持多 Agent 模式
@@ -40,6 +63,7 @@ type (
 		*Config
 
 		driver       driver.Driver
+		embedder     driver.Embedder
 		tm           *tool.Manager
 		argsReplacer map[string]any // 替换 prompt 中的占位符
 
@@ -53,13 +77,51 @@ func New(conf Config, driver driver.Driver, tm *tool.Manager) *Bot {
 	bot := &Bot{
 		Config:       &conf,
 		driver:       driver,
-		tm:           tm,
+		tm:           scopeTools(tm, conf.Prompt, conf.ToolBudgets),
 		localHistory: history.NewHistory(),
 		UUID:         base64.StdEncoding.EncodeToString([]byte(uuid.New().String())),
 	}
 	return bot
 }
 
+// scopeTools bot 只能执行 prompt 中声明的 functions，输出预算只在 bot 的作用域上设置
+func scopeTools(tm *tool.Manager, p *Prompt, budgets map[string]*tool.Budget) *tool.Manager {
+	if tm == nil {
+		return nil
+	}
+	var scope *tool.Manager
+	if p == nil {
+		scope = tm.Scope()
+	} else {
+		scope = tm.Scope(p.Functions...)
+	}
+	for name, b := range budgets {
+		scope.WithBudget(name, b)
+	}
+	return scope
+}
+
+// withoutTools 返回不能调用任何 tool 的副本，prompt 中也不再声明 functions
+func (b *Bot) withoutTools() *Bot {
+	cp := *b
+	conf := *b.Config
+	if conf.Prompt != nil {
+		p := *conf.Prompt
+		p.Functions = nil
+		conf.Prompt = &p
+	}
+	cp.Config = &conf
+	if b.tm != nil {
+		cp.tm = b.tm.Scope()
+	}
+	return &cp
+}
+
+// Tools 返回 bot 可以使用的 tool，是创建时传入的 Manager 按 Prompt.Functions 限定的作用域
+func (b *Bot) Tools() *tool.Manager {
+	return b.tm
+}
+
 // WithArgsReplacer 注入参数替换器，用于替换 prompt 中的占位符
 func (b *Bot) WithArgsReplacer(argsReplacer map[string]any) *Bot {
 	b.argsReplacer = argsReplacer
@@ -73,10 +135,25 @@ func (b *Bot) Logger(ctx context.Context, funcName string) (*logrus.Entry, conte
 	return log.Entry, ctx
 }
 
+// requester 发起一次对 driver 的请求，阻塞请求使用 chatWithTools，流式请求使用 streamer
+// 走原生工具调用协议时，模型发起的调用以结构化的方式返回，文本协议下 calls 总是为空
+type requester func(ctx context.Context, messages history.Messages) (content string, calls []driver.ToolCall, err error)
+
+// chat 请求 driver，配置了 Timeout 时为单次请求设置超时
+func (b *Bot) chat(ctx context.Context, messages history.Messages) (string, error) {
+	if b.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Timeout)
+		defer cancel()
+	}
+	return b.driver.Chat(ctx, messages)
+}
+
 func (b *Bot) MakeSystemMessage(ctx context.Context, appends ...string) *history.Message {
 	ctx = utils.InjectAgentLogKey(ctx, b.PrefabName)
+	tc, _ := b.nativeTools(ctx) // 原生工具调用时，functions 通过 driver 下发，不需要文本协议的说明
 	msg := b.Prompt.
-		BuildSystemMessage(ctx, b.tm, b.argsReplacer). // 注入 system prompt
+		buildSystemMessage(ctx, b.tm, b.argsReplacer, tc == nil). // 注入 system prompt
 		AppendContent(b.ActAsContext)
 	for _, apd := range appends {
 		msg = msg.AppendContent(apd)
@@ -97,20 +174,24 @@ func (b *Bot) Messages(ctx context.Context, globalHistory *history.History) hist
 // NormalReq 递归结构，会处理函数调用，不会改变 History
 func (b *Bot) NormalReq(ctx context.Context, mergedHistory history.Messages) (string, error) {
 	log, ctx := b.Logger(ctx, "normal_req")
+	return b.request(ctx, log, mergedHistory, b.chatWithTools)
+}
 
-	got, err := b.driver.Chat(ctx, mergedHistory)
+// request NormalReq 和 StreamReq 的公共流程，send 决定以阻塞还是流式的方式请求 driver
+func (b *Bot) request(ctx context.Context, log *logrus.Entry, mergedHistory history.Messages, send requester) (string, error) {
+	got, calls, err := send(ctx, mergedHistory)
 	if err != nil {
 		return "", irr.Wrap(err, "normal req failed")
 	}
 
 	got = strings.TrimSpace(got)
-	if got == "" {
+	if got == "" && len(calls) == 0 {
 		return b.PrefabName + " 开小差了，请重试", nil
 	}
 
 	tempMessages := make(history.Messages, 0) // 创建函数调用过程的临时队列
 	log.Debugf("try execute functions")
-	got, err = b.ExecuteFunctions(ctx, mergedHistory, got, &tempMessages)
+	got, err = b.executeFunctionsBy(ctx, send, mergedHistory, got, calls, &tempMessages)
 	if err != nil {
 		return "", irr.Wrap(err, "execute functions failed")
 	}
@@ -134,9 +215,14 @@ func (b *Bot) NormalReq(ctx context.Context, mergedHistory history.Messages) (st
 }
 
 func (b *Bot) ExecuteFunctions(ctx context.Context, historyBeforeFunctionCall history.Messages, trigger string, tempMessages *history.Messages) (string, error) {
+	return b.executeFunctionsBy(ctx, b.chatWithTools, historyBeforeFunctionCall, trigger, nil, tempMessages)
+}
+
+// executeFunctionsBy nativeCalls 是原生工具调用协议返回的调用，为空时从 trigger 中按文本协议解析
+func (b *Bot) executeFunctionsBy(ctx context.Context, send requester, historyBeforeFunctionCall history.Messages, trigger string, nativeCalls []driver.ToolCall, tempMessages *history.Messages) (string, error) {
 	log, ctx := b.Logger(ctx, "E")
 	// 如果没有新的函数调用，则将 trigger返回，否则将 trigger 推入临时队列
-	if !tool.Caller.HasCall(trigger) {
+	if len(nativeCalls) == 0 && !tool.Caller.HasCall(trigger) {
 		// 如果没有后续的函数调用就 **直接返回**
 		log.Infof("\n%s",
 			utils.SPrintWithFrameCard(
@@ -165,57 +251,135 @@ func (b *Bot) ExecuteFunctions(ctx context.Context, historyBeforeFunctionCall hi
 		}
 	}
 
-	return b.executeFunctions(ctx, historyBeforeFunctionCall, tempMessages, trigger, 0)
+	return b.executeFunctions(ctx, send, historyBeforeFunctionCall, tempMessages, trigger, nativeCalls, newGuardState(b.Guard), 0)
 }
 
-func (b *Bot) executeFunctions(ctx context.Context, reqHistory history.Messages, tempMessages *history.Messages, funcCallMessage string, stackDepth int) (string, error) {
+func (b *Bot) executeFunctions(ctx context.Context, send requester, reqHistory history.Messages, tempMessages *history.Messages, funcCallMessage string, nativeCalls []driver.ToolCall, guard *guardState, stackDepth int) (string, error) {
 	log, ctx := b.Logger(ctx, fmt.Sprintf("ef-%d", stackDepth))
 
 	// 考虑 trigger 是否要包含在临时队列，目前看效果不错
 	//*tempMessages = append(*tempMessages, history.NewUserMsg(trigger, b.PrefabName))
 	//history.PushFunctionResultMSG(*tempMessages, trigger) // 用 function 身份就看不懂需求了
-	*tempMessages = append(*tempMessages, history.NewBotMsg(funcCallMessage, b.PrefabName))
+	*tempMessages = append(*tempMessages, history.NewBotMsg(funcCallMessage, b.PrefabName).WithToolCalls(nativeCalls...))
+	if len(nativeCalls) > 0 {
+		return b.executeToolCalls(ctx, send, reqHistory, tempMessages, nativeCalls, guard, stackDepth)
+	}
 
-	// 还有函数调用则进入递归 todo: 处理一次有多个的情况
-	funcName, paramValues, err := tool.Caller.ParseCall(ctx, funcCallMessage)
-	functionReturns := ""
-	if err != nil {
-		log.WithError(err).Warnf("failed to parse function call")
-		functionReturns = err.Error() + "，请检查后重试"
-	} else {
-		result := b.tm.Execute(ctx, funcName, paramValues)
-		functionReturns = result.ToPrompt()
-		// todo：要求错误修正的 prompt 在最终正确后可以去掉
+	// 一次回复中可能有多个调用，格式错误之前的调用照常执行，错误本身也作为结果返回给模型
+	calls, parseErr := tool.Caller.ParseAll(ctx, funcCallMessage)
+	if e := guard.check(stackDepth, calls); e != nil {
+		e.Bot = b.PrefabName
+		emitGuardEvent(ctx, *e)
+		return b.forceFinalAnswer(ctx, send, reqHistory, tempMessages, nil, e)
 	}
+	returns := make([]string, 0, len(calls)+1)
+	for _, result := range b.tm.ExecuteCalls(ctx, calls) {
+		parts := takeParts(&result)
+		functionReturns := result.ToPrompt()
+		// todo：要求错误修正的 prompt 在最终正确后可以去掉
 
-	// 将执行结果推入临时栈
-	*tempMessages = history.PushFunctionResultMSG(*tempMessages, functionReturns) // 将函数调用结果推入临时队列
+		// 将执行结果按调用顺序推入临时栈，工具返回的图片等片段附加在结果消息上，随下一轮请求发给模型
+		*tempMessages = history.PushFunctionResultWithParts(*tempMessages, functionReturns, parts...) // 将函数调用结果推入临时队列
+		returns = append(returns, functionReturns)
+	}
+	if parseErr != nil {
+		log.WithError(parseErr).Warnf("failed to parse function call")
+		functionReturns := parseErr.Error() + "\n请检查后重试"
+		*tempMessages = history.PushFunctionResultMSG(*tempMessages, functionReturns)
+		returns = append(returns, functionReturns)
+	}
 
 	req := append(make(history.Messages, 0), reqHistory...) // 注入当前历史
 	req = append(req, *tempMessages...)                     // 注入临时指令
 	req = append(req, history.MSGFunctionContinue)          // 注入驱动指令
 
-	got, err := b.driver.Chat(ctx, req)
+	return b.continueFunctions(ctx, send, reqHistory, tempMessages, req, calls, returns, guard, stackDepth)
+}
+
+// continueFunctions 带着这一轮的调用结果再次请求模型，模型继续发起调用时进入下一轮
+func (b *Bot) continueFunctions(ctx context.Context, send requester, reqHistory history.Messages, tempMessages *history.Messages, req history.Messages, calls []*call.Call, returns []string, guard *guardState, stackDepth int) (string, error) {
+	log, ctx := b.Logger(ctx, fmt.Sprintf("ef-%d", stackDepth))
+
+	got, next, err := send(ctx, req)
 	if err != nil {
 		return "", irr.Wrap(err, "function call failed, depth= %d", stackDepth)
 	}
 
 	log.Infof(
 		utils.SPrintWithFrameCard(
-			fmt.Sprintf("<-- function call stack --> %s(%v) [%d]", funcName, strings.Join(paramValues, ", "), stackDepth),
-			functionReturns,
+			fmt.Sprintf("<-- function call stack --> %s [%d]", strings.Join(typer.SliceMap(calls, callSignature), " | "), stackDepth),
+			strings.Join(returns, "\n\n"),
 			utils.PrintWidthL1,
 			utils.StyFunctionStack,
 		),
 	)
 
 	// 如果没有后续的函数调用就 **直接返回**，否则使用 got 继续调用
-	if !tool.Caller.HasCall(got) {
+	if len(next) == 0 && !tool.Caller.HasCall(got) {
 		return got, nil
 	}
 	log.WithField("stackDepth", stackDepth).Debugf("find function call, trigger= %s", got)
 
-	return b.executeFunctions(ctx, reqHistory, tempMessages, got, stackDepth+1)
+	return b.executeFunctions(ctx, send, reqHistory, tempMessages, strings.TrimSpace(got), next, guard, stackDepth+1)
+}
+
+// forceFinalAnswer 触发调用限制后不再执行调用，要求模型根据已有的结果直接回答，回答中仍然出现的调用会被去掉
+// pending 是原生工具调用协议下没有执行的调用，每个调用都要有对应的 tool 消息，限制的说明作为它们的结果返回
+func (b *Bot) forceFinalAnswer(ctx context.Context, send requester, reqHistory history.Messages, tempMessages *history.Messages, pending []driver.ToolCall, e *GuardEvent) (string, error) {
+	if len(pending) == 0 {
+		*tempMessages = history.PushFunctionResultMSG(*tempMessages, e.ToPrompt())
+	}
+	for _, c := range pending {
+		*tempMessages = append(*tempMessages, history.NewToolResultMsg(c.ID, c.Name, e.ToPrompt()))
+	}
+
+	req := append(make(history.Messages, 0), reqHistory...)
+	req = append(req, *tempMessages...)
+	req = append(req, MSGFunctionFinal)
+
+	got, _, err := send(ctx, req)
+	if err != nil {
+		return "", irr.Wrap(err, "force final answer failed, limit= %s", e.Limit)
+	}
+	if got = strings.TrimSpace(stripCalls(ctx, got)); got == "" {
+		return b.PrefabName + " 调用 function 的次数过多，没能给出回答", nil
+	}
+	return got, nil
+}
+
+// stripCalls 去掉 content 中的函数调用，格式错误的调用从出错的调用开始截断
+func stripCalls(ctx context.Context, content string) string {
+	calls, err := tool.Caller.ParseAll(ctx, content)
+	for _, c := range calls {
+		content = strings.Replace(content, c.Raw, "", 1)
+	}
+	if err != nil {
+		if loc := tool.Caller.Regex.FindStringIndex(content); loc != nil {
+			content = content[:loc[0]]
+		}
+	}
+	return content
+}
+
+func callSignature(c *call.Call) string {
+	return fmt.Sprintf("%s(%v)", c.Name, strings.Join(c.RawArgs(), ", "))
+}
+
+// takeParts 工具返回 history.Part 时取出片段，并把结果替换成片段的描述
+func takeParts(result *call.Result) []history.Part {
+	var parts []history.Part
+	switch resp := result.Response.(type) {
+	case history.Part:
+		parts = []history.Part{resp}
+	case *history.Part:
+		parts = []history.Part{*resp}
+	case []history.Part:
+		parts = resp
+	default:
+		return nil
+	}
+	result.Response = strings.Join(typer.SliceMap(parts, history.Part.Describe), "\n")
+	return parts
 }
 
 func (b *Bot) Summarize(ctx context.Context, messages2Summary history.Messages) (string, error) {
@@ -229,7 +393,7 @@ func (b *Bot) Summarize(ctx context.Context, messages2Summary history.Messages)
 `))
 	req = append(req, messages2Summary...)
 	req = append(req, history.MSGFunctionSummarize) // 注入驱动指令
-	got, err := b.driver.Chat(ctx, req)
+	got, err := b.chat(ctx, req)
 	if err != nil {
 		return "", irr.Wrap(err, "summarize failed")
 	}
@@ -242,7 +406,7 @@ func (b *Bot) Introduce(ctx context.Context, historyMessages history.Messages) (
 	log, ctx := b.Logger(ctx, "introduce")
 
 	req := append(historyMessages, history.MSGFunctionIntroduce) // 注入驱动指令
-	got, err := b.driver.Chat(ctx, req)
+	got, err := b.chat(ctx, req)
 	if err != nil {
 		return "", irr.Wrap(err, "summarize failed")
 	}
@@ -264,6 +428,7 @@ func (b *Bot) SendChat(ctx context.Context, globalHistory *history.History) (str
 	got, err := b.NormalReq(ctx, messages)
 	if err != nil {
 		log.WithError(err).Error("normal chat failed")
+		return "", err // 调用方需要区分超时、取消等错误
 	}
 	// 最终结果返回，由外部决定是否组装到全局历史中
 	return got, nil
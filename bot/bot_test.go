@@ -0,0 +1,795 @@
+package bot_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/bagaking/botheater/bot"
+	"github.com/bagaking/botheater/call/tool"
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/driver/cache"
+	"github.com/bagaking/botheater/driver/mock"
+	"github.com/bagaking/botheater/driver/ratelimit"
+	"github.com/bagaking/botheater/history"
+)
+
+// echoTool 把参数原样返回，并记录调用次数
+type echoTool struct {
+	calls []string
+}
+
+func (e *echoTool) Execute(params map[string]string) (any, error) {
+	e.calls = append(e.calls, params["text"])
+	return "echo:" + params["text"], nil
+}
+func (e *echoTool) Name() string         { return "echo" }
+func (e *echoTool) Usage() string        { return "原样返回输入" }
+func (e *echoTool) Examples() []string   { return []string{`echo("hi")`} }
+func (e *echoTool) ParamNames() []string { return []string{"text"} }
+
+func newTestBot(mode bot.FunctionMode, d *mock.Driver) (*bot.Bot, *echoTool) {
+	et := &echoTool{}
+	tm := tool.NewToolManager()
+	tm.RegisterTool(et)
+	b := bot.New(bot.Config{
+		PrefabName: "tester",
+		Prompt: &bot.Prompt{
+			Content:      "你是测试机器人",
+			Functions:    []string{"echo"},
+			FunctionCtx:  bot.FunctionCtxAll,
+			FunctionMode: mode,
+		},
+	}, d, tm)
+	return b, et
+}
+
+// isLast 最后一条消息是 msg 时命中
+func isLast(msg *history.Message, reply string) mock.Rule {
+	return mock.Func(func(messages history.Messages) (string, bool, error) {
+		return reply, len(messages) > 0 && messages[len(messages)-1].Content == msg.Content, nil
+	})
+}
+
+func TestBot_NormalReq_NoFunctionCall(t *testing.T) {
+	d := mock.New(mock.Sequence("  直接回答  "))
+	b, et := newTestBot(bot.FunctionModeDump, d)
+
+	got, err := b.Question(context.Background(), history.NewHistory(), "你好")
+	if err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if got != "直接回答" {
+		t.Errorf("got %q", got)
+	}
+	if d.CallCount() != 1 || len(et.calls) != 0 {
+		t.Errorf("expected one driver call and no tool call, got %d / %d", d.CallCount(), len(et.calls))
+	}
+
+	req := d.Call(0)
+	if req[0].Role != history.RoleSystem || !strings.Contains(req[0].Content, "你是测试机器人") || !strings.Contains(req[0].Content, "echo") {
+		t.Errorf("system message should contain prompt and functions, got %s", req[0].Content)
+	}
+	if last := req[len(req)-1]; last.Role != history.RoleUser || last.Content != "你好" {
+		t.Errorf("unexpected last message %+v", last)
+	}
+}
+
+func TestBot_NormalReq_FunctionRecursion(t *testing.T) {
+	d := mock.New(
+		mock.Match(`^查两次$`, `需要查询。func_call::echo("a")`),
+		mock.Sequence(`还要再查。func_call::echo("b")`, "查完了: a b"),
+	)
+	b, et := newTestBot(bot.FunctionModeDump, d)
+
+	got, err := b.Question(context.Background(), history.NewHistory(), "查两次")
+	if err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if got != "查完了: a b" {
+		t.Errorf("got %q", got)
+	}
+	if strings.Join(et.calls, ",") != "a,b" {
+		t.Errorf("unexpected tool calls %v", et.calls)
+	}
+	if d.CallCount() != 3 {
+		t.Fatalf("expected 3 driver calls, got %d", d.CallCount())
+	}
+
+	// 第二次请求: 原始上下文 + 调用消息 + 函数结果 + 驱动指令
+	second := d.Call(1)
+	n := len(second)
+	if second[n-1].Content != history.MSGFunctionContinue.Content {
+		t.Errorf("function continue should be the last message, got %s", second[n-1].Content)
+	}
+	if res := second[n-2]; res.Identity != tool.Caller.Prefix || !strings.Contains(res.Content, "echo:a") {
+		t.Errorf("function result should be pushed, got %+v", res)
+	}
+	if callMsg := second[n-3]; callMsg.Role != history.RoleBot || !strings.Contains(callMsg.Content, `func_call::echo("a")`) {
+		t.Errorf("function call should be kept, got %+v", callMsg)
+	}
+
+	// 第三次请求: 上一轮的驱动指令被移除，两次调用过程都保留
+	third := mock.Transcript(d.Call(2))
+	if strings.Count(third, history.MSGFunctionContinue.Content) != 1 {
+		t.Errorf("only one continue message expected:\n%s", third)
+	}
+	if !strings.Contains(third, "echo:a") || !strings.Contains(third, "echo:b") {
+		t.Errorf("both function results expected:\n%s", third)
+	}
+}
+
+func TestBot_NormalReq_UnknownFunction(t *testing.T) {
+	d := mock.New(
+		mock.Match(`^用不存在的函数$`, `func_call::nope("x")`),
+		mock.Sequence("好的，换个办法"),
+	)
+	b, _ := newTestBot(bot.FunctionModeDump, d)
+
+	got, err := b.Question(context.Background(), history.NewHistory(), "用不存在的函数")
+	if err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if got != "好的，换个办法" {
+		t.Errorf("got %q", got)
+	}
+	second := mock.Transcript(d.Call(1))
+	if !strings.Contains(second, "没有找到名字是 nope 的调用") {
+		t.Errorf("tool not found should be reported to the model:\n%s", second)
+	}
+}
+
+func TestBot_NormalReq_MalformedCall(t *testing.T) {
+	d := mock.New(
+		mock.Match(`^格式错误$`, `func_call::echo("a, b)`),
+		mock.Match(`^具名参数$`, `func_call::echo(text="a, b")`),
+		mock.Sequence("重新调用了", "完成"),
+	)
+	b, et := newTestBot(bot.FunctionModeDump, d)
+
+	if _, err := b.Question(context.Background(), history.NewHistory(), "格式错误"); err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if len(et.calls) != 0 {
+		t.Errorf("malformed call should not be executed, got %v", et.calls)
+	}
+	second := mock.Transcript(d.Call(1))
+	if !strings.Contains(second, "第 1 行第 17 列") || !strings.Contains(second, "字符串没有结束") {
+		t.Errorf("parse error should be reported to the model:\n%s", second)
+	}
+
+	if _, err := b.Question(context.Background(), history.NewHistory(), "具名参数"); err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if len(et.calls) != 1 || et.calls[0] != "a, b" {
+		t.Errorf("named quoted arg should be passed as is, got %v", et.calls)
+	}
+}
+
+// barrierTool 可以并发执行，n 个调用同时到达后才返回，用于验证并发
+type barrierTool struct {
+	wg sync.WaitGroup
+}
+
+func (bt *barrierTool) Execute(params map[string]string) (any, error) {
+	bt.wg.Done()
+	done := make(chan struct{})
+	go func() { bt.wg.Wait(); close(done) }()
+	select {
+	case <-done:
+		return "got " + params["path"], nil
+	case <-time.After(time.Second):
+		return nil, errors.New("calls are not executed concurrently")
+	}
+}
+func (bt *barrierTool) Name() string         { return "fetch" }
+func (bt *barrierTool) Usage() string        { return "读取文件" }
+func (bt *barrierTool) Examples() []string   { return []string{`fetch("a.txt")`} }
+func (bt *barrierTool) ParamNames() []string { return []string{"path"} }
+func (bt *barrierTool) Concurrent() bool     { return true }
+
+func TestBot_NormalReq_MultipleCalls(t *testing.T) {
+	d := mock.New(
+		mock.Match(`^读三个文件$`, "需要三个文件。\nfunc_call::fetch(\"a.txt\")\nfunc_call::fetch(\"b.txt\")\nfunc_call::fetch(\"c.txt\")"),
+		mock.Match(`^混合调用$`, `func_call::echo("x") func_call::nope() func_call::echo("y`),
+		mock.Sequence("三个都拿到了", "部分完成"),
+	)
+	et, bt := &echoTool{}, &barrierTool{}
+	bt.wg.Add(3)
+	tm := tool.NewToolManager()
+	tm.RegisterTool(et)
+	tm.RegisterTool(bt)
+	b := bot.New(bot.Config{
+		PrefabName: "tester",
+		Prompt:     &bot.Prompt{Content: "你是测试机器人", Functions: []string{"echo", "fetch"}, FunctionCtx: bot.FunctionCtxAll},
+	}, d, tm)
+
+	got, err := b.Question(context.Background(), history.NewHistory(), "读三个文件")
+	if err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if got != "三个都拿到了" || d.CallCount() != 2 {
+		t.Fatalf("all calls should be handled in one round, got %q after %d driver calls", got, d.CallCount())
+	}
+	second := d.Call(1)
+	res := second[len(second)-2]
+	ia, ib, ic := strings.Index(res.Content, "got a.txt"), strings.Index(res.Content, "got b.txt"), strings.Index(res.Content, "got c.txt")
+	if res.Identity != tool.Caller.Prefix || ia < 0 || !(ia < ib && ib < ic) {
+		t.Errorf("results should be merged into one message in call order, got %q", res.Content)
+	}
+
+	// 每个调用单独报告错误，格式错误之前的调用照常执行
+	if _, err = b.Question(context.Background(), history.NewHistory(), "混合调用"); err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if strings.Join(et.calls, ",") != "x" {
+		t.Errorf("calls before the malformed one should be executed, got %v", et.calls)
+	}
+	third := mock.Transcript(d.Call(3))
+	if !strings.Contains(third, "echo:x") || !strings.Contains(third, "没有找到名字是 nope 的调用") || !strings.Contains(third, "字符串没有结束") {
+		t.Errorf("every call should be reported:\n%s", third)
+	}
+}
+
+func TestBot_NormalReq_SampleMode(t *testing.T) {
+	d := mock.New(
+		isLast(history.MSGFunctionSummarize, "## 目标和计划\n查询 a"),
+		mock.Match(`^查一次$`, `func_call::echo("a")`),
+		mock.Sequence("结论是 a"),
+	)
+	b, _ := newTestBot(bot.FunctionModeSampleOnly, d)
+
+	got, err := b.Question(context.Background(), history.NewHistory(), "查一次")
+	if err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if !strings.Contains(got, "# 结论\n结论是 a") || !strings.Contains(got, "# 过程\n## 目标和计划") {
+		t.Errorf("sample mode should attach summarize, got %q", got)
+	}
+
+	// 结论被记录到 bot 的本地 history，下一次请求会带上
+	messages := b.Messages(context.Background(), history.NewHistory())
+	last := messages[len(messages)-1]
+	if last.Identity != tool.Caller.Prefix || !strings.Contains(last.Content, "可以参考之前的结论") {
+		t.Errorf("sample should be kept in local history, got %+v", last)
+	}
+}
+
+func TestBot_NormalReq_PrivateMode(t *testing.T) {
+	d := mock.New(
+		mock.Match(`^查一次$`, `func_call::echo("a")`),
+		mock.Sequence("结论是 a"),
+	)
+	b, _ := newTestBot(bot.FunctionModePrivateOnly, d)
+
+	got, err := b.Question(context.Background(), history.NewHistory(), "查一次")
+	if err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if got != "结论是 a" || d.CallCount() != 2 {
+		t.Errorf("private mode should not summarize, got %q with %d calls", got, d.CallCount())
+	}
+	messages := b.Messages(context.Background(), history.NewHistory())
+	if len(messages) != 1 {
+		t.Errorf("private mode should not touch local history, got %d messages", len(messages))
+	}
+}
+
+func TestPushFunctionResultMSG(t *testing.T) {
+	msgs := history.Messages{history.NewUserMsg("q", "")}
+	msgs = history.PushFunctionResultMSG(msgs, "r1")
+	msgs = append(msgs, history.MSGFunctionContinue)
+	msgs = history.PushFunctionResultMSG(msgs, "r2", "r3")
+
+	if len(msgs) != 2 {
+		t.Fatalf("continue should be removed and results merged, got:\n%s", mock.Transcript(msgs))
+	}
+	if msgs[1].Content != "r1\n\nr2\n\nr3" || msgs[1].Identity != tool.Caller.Prefix {
+		t.Errorf("unexpected merged message %+v", msgs[1])
+	}
+}
+
+// blockingDriver 一直等到 ctx 结束
+type blockingDriver struct{}
+
+func (blockingDriver) Chat(ctx context.Context, _ []*history.Message) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func (blockingDriver) StreamChat(ctx context.Context, _ []*history.Message, _ func(string)) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestBot_Timeout(t *testing.T) {
+	b := bot.New(bot.Config{
+		PrefabName: "slow",
+		Timeout:    30 * time.Millisecond,
+		Prompt:     &bot.Prompt{Content: "你是测试机器人"},
+	}, blockingDriver{}, tool.NewToolManager())
+
+	start := time.Now()
+	_, err := b.Question(context.Background(), history.NewHistory(), "你好")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("timeout should interrupt the request")
+	}
+
+	// 调用方取消时同样返回 context.Canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = b.Question(ctx, history.NewHistory(), "你好"); !errors.Is(err, context.Canceled) {
+		t.Errorf("want canceled, got %v", err)
+	}
+}
+
+// nativeDriver 在 mock 的基础上支持原生工具调用，按顺序返回 calls
+type nativeDriver struct {
+	*mock.Driver
+	calls [][]driver.ToolCall
+	tools [][]driver.ToolDef
+}
+
+func (d *nativeDriver) ChatWithTools(ctx context.Context, messages []*history.Message, tools []driver.ToolDef) (string, []driver.ToolCall, error) {
+	d.tools = append(d.tools, tools)
+	got, err := d.Chat(ctx, messages)
+	if err != nil || len(d.calls) == 0 {
+		return got, nil, err
+	}
+	calls := d.calls[0]
+	d.calls = d.calls[1:]
+	return got, calls, nil
+}
+
+func TestBot_NormalReq_NativeToolCall(t *testing.T) {
+	d := &nativeDriver{
+		Driver: mock.New(mock.Sequence("我来查一下", "查到了")),
+		calls:  [][]driver.ToolCall{{{Name: "echo", Arguments: map[string]any{"text": `说 "hi"`}}}},
+	}
+	et := &echoTool{}
+	tm := tool.NewToolManager()
+	tm.RegisterTool(et)
+	b := bot.New(bot.Config{
+		PrefabName: "tester",
+		Prompt:     &bot.Prompt{Content: "你是测试机器人", Functions: []string{"echo"}, FunctionCtx: bot.FunctionCtxAll},
+	}, d, tm)
+
+	got, err := b.Question(context.Background(), history.NewHistory(), "查一下")
+	if err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if got != "查到了" || strings.Join(et.calls, ",") != `说 "hi"` {
+		t.Errorf("got %q, tool calls %v", got, et.calls)
+	}
+	if len(d.tools) != 2 || len(d.tools[0]) != 1 || d.tools[0][0].Name != "echo" || d.tools[0][0].Params[0].Name != "text" {
+		t.Errorf("tools should be sent natively, got %+v", d.tools)
+	}
+
+	// 结构化调用原样写入 history，结果作为对应 id 的 tool 消息返回，不再附加文本协议的驱动指令
+	req := d.Call(1)
+	callMsg, result := req[len(req)-2], req[len(req)-1]
+	if callMsg.Role != history.RoleBot || callMsg.Content != "我来查一下" || len(callMsg.ToolCalls) != 1 || callMsg.ToolCalls[0].ID == "" {
+		t.Errorf("unexpected call message %+v", callMsg)
+	}
+	if result.Role != history.RoleTool || result.ToolCallID != callMsg.ToolCalls[0].ID || !strings.Contains(result.Content, "echo:") {
+		t.Errorf("unexpected tool result %+v", result)
+	}
+	// system prompt 中不再包含文本协议的说明
+	if sys := d.Call(0)[0]; sys.Role != history.RoleSystem || strings.Contains(sys.Content, tool.Caller.Prefix) {
+		t.Errorf("system prompt should not describe the text protocol, got %q", sys.Content)
+	}
+}
+
+func TestBot_StreamReq_NativeDriverKeepsTextProtocol(t *testing.T) {
+	d := &nativeDriver{Driver: mock.New(mock.Sequence("直接回答"))}
+	tm := tool.NewToolManager()
+	tm.RegisterTool(&echoTool{})
+	b := bot.New(bot.Config{
+		PrefabName: "tester",
+		Prompt:     &bot.Prompt{Content: "你是测试机器人", Functions: []string{"echo"}},
+	}, d, tm)
+
+	if _, err := b.StreamChat(context.Background(), history.NewHistory(), func(string) {}); err != nil {
+		t.Fatalf("stream chat failed: %v", err)
+	}
+	// 流式请求拿不到结构化的调用，system prompt 保留文本协议
+	if sys := d.Call(0)[0]; !strings.Contains(sys.Content, tool.Caller.Prefix) {
+		t.Errorf("stream should keep the text protocol prompt, got %q", sys.Content)
+	}
+}
+
+func TestBot_NormalReq_NativeToolCall_Wrapped(t *testing.T) {
+	d := &nativeDriver{
+		Driver: mock.New(mock.Sequence("我来查一下", "查到了")),
+		calls:  [][]driver.ToolCall{{{Name: "echo", Arguments: map[string]any{"text": "hi"}}}},
+	}
+	et := &echoTool{}
+	tm := tool.NewToolManager()
+	tm.RegisterTool(et)
+	// 包装的 driver 转发原生工具调用
+	wrapped := ratelimit.New(cache.New(d, nil), ratelimit.NewLimiter(ratelimit.Limits{}))
+	b := bot.New(bot.Config{
+		PrefabName: "tester",
+		Prompt:     &bot.Prompt{Content: "你是测试机器人", Functions: []string{"echo"}, FunctionCtx: bot.FunctionCtxAll},
+	}, wrapped, tm)
+
+	got, err := b.Question(context.Background(), history.NewHistory(), "查一下")
+	if err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if got != "查到了" || strings.Join(et.calls, ",") != "hi" || len(d.tools) != 2 {
+		t.Errorf("wrapped driver should use native tools, got %q, calls %v, tools %d", got, et.calls, len(d.tools))
+	}
+}
+
+func TestBot_NormalReq_DisableNativeTools(t *testing.T) {
+	d := &nativeDriver{Driver: mock.New(mock.Sequence("直接回答"))}
+	et := &echoTool{}
+	tm := tool.NewToolManager()
+	tm.RegisterTool(et)
+	b := bot.New(bot.Config{
+		PrefabName:         "tester",
+		DisableNativeTools: true,
+		Prompt:             &bot.Prompt{Content: "你是测试机器人", Functions: []string{"echo"}},
+	}, d, tm)
+
+	if _, err := b.Question(context.Background(), history.NewHistory(), "你好"); err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if len(d.tools) != 0 || d.CallCount() != 1 {
+		t.Errorf("native tools should not be used, got %+v", d.tools)
+	}
+}
+
+// imageTool 返回一张图片
+type imageTool struct{}
+
+func (imageTool) Execute(map[string]string) (any, error) {
+	return history.ImagePart([]byte("png"), "image/png"), nil
+}
+func (imageTool) Name() string         { return "snapshot" }
+func (imageTool) Usage() string        { return "截图" }
+func (imageTool) Examples() []string   { return []string{`snapshot()`} }
+func (imageTool) ParamNames() []string { return nil }
+
+func TestBot_NormalReq_ToolReturnsImage(t *testing.T) {
+	d := mock.New(mock.Sequence(`先截个图。func_call::snapshot()`, "图里是一只猫"))
+	tm := tool.NewToolManager()
+	tm.RegisterTool(imageTool{})
+	b := bot.New(bot.Config{
+		PrefabName: "tester",
+		Prompt:     &bot.Prompt{Content: "你是测试机器人", Functions: []string{"snapshot"}, FunctionCtx: bot.FunctionCtxAll},
+	}, d, tm)
+
+	got, err := b.Question(context.Background(), history.NewHistory(), "看看屏幕")
+	if err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if got != "图里是一只猫" {
+		t.Errorf("got %q", got)
+	}
+
+	second := d.Call(1)
+	res := second[len(second)-2]
+	if res.Identity != tool.Caller.Prefix || len(res.Parts) != 1 || string(res.Parts[0].Data) != "png" {
+		t.Fatalf("image should be attached to the function result, got %+v", res)
+	}
+	if !strings.Contains(res.Content, "[image: image/png") {
+		t.Errorf("function result should describe the image, got %q", res.Content)
+	}
+}
+
+func TestPushFunctionResultWithParts(t *testing.T) {
+	img := history.ImageURLPart("https://example.com/a.png")
+	msgs := history.PushFunctionResultWithParts(history.Messages{history.NewUserMsg("q", "")}, "r1", img)
+	msgs = history.PushFunctionResultWithParts(msgs, "r2")
+	if len(msgs) != 2 || len(msgs[1].Parts) != 1 || msgs[1].Parts[0].URL != img.URL {
+		t.Errorf("parts should survive merging, got %+v", msgs[1])
+	}
+}
+
+func TestBot_Embed(t *testing.T) {
+	driver.Register("bot_test_mock", func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		return mock.New(), nil
+	})
+	bl := bot.NewBotLoader(tool.NewToolManager()).
+		LoadBot(context.Background(), &bot.Config{PrefabName: "plain", DriverConf: driver.Config{Driver: "bot_test_mock"}}).
+		LoadBot(context.Background(), &bot.Config{
+			PrefabName:   "embedder",
+			DriverConf:   driver.Config{Driver: "bot_test_mock"},
+			EmbedderConf: &driver.Config{Driver: "hash", Options: map[string]any{"dim": 8}},
+		})
+
+	b, err := bl.GetBot("embedder")
+	if err != nil {
+		t.Fatalf("load bot failed: %v", err)
+	}
+	vectors, err := b.Embed(context.Background(), []string{"你好", "hello"})
+	if err != nil || len(vectors) != 2 || len(vectors[0]) != 8 {
+		t.Errorf("embed failed: %v %v", err, vectors)
+	}
+
+	plain, _ := bl.GetBot("plain")
+	if _, err = plain.Embed(context.Background(), []string{"你好"}); !errors.Is(err, bot.ErrEmbedderNotSet) {
+		t.Errorf("want ErrEmbedderNotSet, got %v", err)
+	}
+}
+
+func newGuardedBot(d *mock.Driver, guard string) (*bot.Bot, *echoTool, error) {
+	conf := bot.Config{}
+	if err := yaml.Unmarshal([]byte("prefab_name: tester\nguard:\n"+guard), &conf); err != nil {
+		return nil, nil, err
+	}
+	conf.Prompt = &bot.Prompt{Content: "你是测试机器人", Functions: []string{"echo"}, FunctionCtx: bot.FunctionCtxAll}
+	et := &echoTool{}
+	tm := tool.NewToolManager()
+	tm.RegisterTool(et)
+	return bot.New(conf, d, tm), et, nil
+}
+
+func TestBot_Guard(t *testing.T) {
+	n := 0
+	cases := []struct {
+		name  string
+		guard string
+		reply mock.Rule // 每次 continue 时的回复
+		calls int
+		want  bot.GuardEvent
+	}{
+		{
+			name:  "repeats",
+			guard: "  max_repeats: 2\n",
+			reply: mock.Func(func(history.Messages) (string, bool, error) {
+				return `还是看看根目录 func_call::echo(.)`, true, nil
+			}),
+			calls: 2,
+			want:  bot.GuardEvent{Bot: "tester", Limit: bot.GuardLimitRepeats, Value: 3, Max: 2, Depth: 2, Calls: 2, Call: "echo(.)"},
+		},
+		{
+			name:  "depth",
+			guard: "  max_depth: 3\n  max_repeats: -1\n",
+			reply: mock.Func(func(history.Messages) (string, bool, error) {
+				n++
+				return fmt.Sprintf(`func_call::echo("%d")`, n), true, nil
+			}),
+			calls: 3,
+			want:  bot.GuardEvent{Bot: "tester", Limit: bot.GuardLimitDepth, Value: 4, Max: 3, Depth: 3, Calls: 3},
+		},
+		{
+			name:  "calls",
+			guard: "  max_calls: 3\n",
+			reply: mock.Func(func(history.Messages) (string, bool, error) {
+				return "func_call::echo(x)\nfunc_call::echo(y)", true, nil
+			}),
+			calls: 3,
+			want:  bot.GuardEvent{Bot: "tester", Limit: bot.GuardLimitCalls, Value: 5, Max: 3, Depth: 2, Calls: 3},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := mock.New(
+				isLast(bot.MSGFunctionFinal, "只能这样回答了 func_call::echo(z)"),
+				mock.Match(`^开始$`, `func_call::echo(".")`),
+				c.reply,
+			)
+			b, et, err := newGuardedBot(d, c.guard)
+			if err != nil {
+				t.Fatalf("load config failed: %v", err)
+			}
+
+			var events []bot.GuardEvent
+			ctx := bot.WithGuardListener(context.Background(), func(e bot.GuardEvent) { events = append(events, e) })
+			got, err := b.Question(ctx, history.NewHistory(), "开始")
+			if err != nil {
+				t.Fatalf("question failed: %v", err)
+			}
+			if got != "只能这样回答了" {
+				t.Errorf("bot should be forced to a final answer without calls, got %q", got)
+			}
+			if len(et.calls) != c.calls {
+				t.Errorf("expected %d tool calls, got %v", c.calls, et.calls)
+			}
+			if len(events) != 1 || events[0] != c.want {
+				t.Errorf("unexpected guard events %+v", events)
+			}
+		})
+	}
+}
+
+// fetchSchemaTool 声明了参数定义的 tool
+type fetchSchemaTool struct{ echoTool }
+
+func (f *fetchSchemaTool) Name() string         { return "fetch_page" }
+func (f *fetchSchemaTool) ParamNames() []string { return []string{"text", "page"} }
+func (f *fetchSchemaTool) ParamSchemas() []tool.ParamSchema {
+	return []tool.ParamSchema{
+		{Name: "text", Description: "地址", Required: true},
+		{Name: "page", Type: tool.ParamTypeInteger, Default: "1", Description: "页码"},
+	}
+}
+
+func TestBot_NativeToolCall_Schema(t *testing.T) {
+	ft := &fetchSchemaTool{}
+	def := bot.ToolDef(ft)
+	if len(def.Params) != 2 || def.Params[1].Type != "integer" || def.Params[1].Required || def.Params[1].Description != "页码 (默认 1)" {
+		t.Errorf("schema should be used in tool def, got %+v", def.Params)
+	}
+
+	d := &nativeDriver{
+		Driver: mock.New(mock.Sequence("我来查一下", "查到了")),
+		calls:  [][]driver.ToolCall{{{Name: "fetch_page", Arguments: map[string]any{"text": "a, b"}}}},
+	}
+	tm := tool.NewToolManager()
+	tm.RegisterTool(ft)
+	b := bot.New(bot.Config{
+		PrefabName: "tester",
+		Prompt:     &bot.Prompt{Content: "你是测试机器人", Functions: []string{"fetch_page"}, FunctionCtx: bot.FunctionCtxAll},
+	}, d, tm)
+	if _, err := b.Question(context.Background(), history.NewHistory(), "查一下"); err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if strings.Join(ft.calls, ",") != "a, b" {
+		t.Errorf("got tool calls %v", ft.calls)
+	}
+	if second := mock.Transcript(d.Call(1)); !strings.Contains(second, `func_call::fetch_page(text="a, b")`) {
+		t.Errorf("optional params should be omitted in rendered call:\n%s", second)
+	}
+}
+
+// hangTool 支持 ctx 的 tool，一直等到 ctx 结束
+type hangTool struct{ echoTool }
+
+func (h *hangTool) Name() string { return "hang" }
+func (h *hangTool) ExecuteContext(ctx context.Context, _ map[string]string) (any, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestBot_NormalReq_ToolCanceled(t *testing.T) {
+	d := mock.New(mock.Match(`^等一下$`, `func_call::hang("x")`), mock.Sequence("不会走到这里"))
+	tm := tool.NewToolManager()
+	tm.RegisterTool(&hangTool{})
+	b := bot.New(bot.Config{
+		PrefabName: "tester",
+		Prompt:     &bot.Prompt{Content: "你是测试机器人", Functions: []string{"hang"}, FunctionCtx: bot.FunctionCtxAll},
+	}, d, tm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := b.Question(ctx, history.NewHistory(), "等一下"); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancellation should reach the tool and abort the request, got %v", err)
+	}
+	if time.Since(start) > time.Second || d.CallCount() != 1 {
+		t.Errorf("request should stop right after cancellation, %v, %d driver calls", time.Since(start), d.CallCount())
+	}
+}
+
+func TestBot_NormalReq_ToolNotAllowed(t *testing.T) {
+	d := mock.New(mock.Match(`^越权$`, `func_call::fetch_page("x")`), mock.Sequence("好的"))
+	b, _ := newTestBot(bot.FunctionModeDump, d)
+	ft := &fetchSchemaTool{}
+	b.Tools().RegisterTool(ft)
+
+	if got := b.Tools().Allowed(); len(got) != 1 || got[0] != "echo" {
+		t.Errorf("bot should only see its functions, got %v", got)
+	}
+	if _, err := b.Question(context.Background(), history.NewHistory(), "越权"); err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if len(ft.calls) != 0 {
+		t.Errorf("tool outside the allowlist should not be executed, got %v", ft.calls)
+	}
+	if second := mock.Transcript(d.Call(1)); !strings.Contains(second, "fetch_page 不在你可以使用的 functions 中") {
+		t.Errorf("not allowed should be reported to the model:\n%s", second)
+	}
+}
+
+func TestBot_NormalReq_ToolDenied(t *testing.T) {
+	d := mock.New(mock.Match(`^删掉$`, `func_call::echo("rm -rf /")`), mock.Sequence("那就不删了"))
+	b, et := newTestBot(bot.FunctionModeDump, d)
+	err := b.Tools().SetPolicy(&tool.Policy{Rules: []*tool.PolicyRule{
+		{Tool: "echo", Params: map[string]string{"text": `^rm `}, Action: tool.PolicyConfirm, Reason: "危险命令"},
+	}})
+	if err != nil {
+		t.Fatalf("set policy failed: %v", err)
+	}
+	b.Tools().WithApprover(tool.DenyApprover{Reason: "CI 中不允许"})
+
+	got, err := b.Question(context.Background(), history.NewHistory(), "删掉")
+	if err != nil {
+		t.Fatalf("question failed: %v", err)
+	}
+	if got != "那就不删了" || len(et.calls) != 0 {
+		t.Errorf("denied call should not be executed, got %q, %v", got, et.calls)
+	}
+	second := d.Call(1)
+	if res := second[len(second)-2]; res.Identity != tool.Caller.Prefix || !strings.Contains(res.Content, "调用被拒绝 (理由: CI 中不允许)") {
+		t.Errorf("denial should be fed back as a function result, got %+v", res)
+	}
+}
+
+func TestBot_NormalReq_ToolBudget(t *testing.T) {
+	long := strings.Repeat("0123456789\n", 5)
+	tokenRe := regexp.MustCompile(`read_more\("([^"]+)"\)`)
+	d := mock.New(
+		mock.Match(`^读长文$`, fmt.Sprintf("func_call::echo(%q)", long)),
+		mock.Func(func(messages history.Messages) (string, bool, error) {
+			m := tokenRe.FindStringSubmatch(mock.Transcript(messages))
+			if m == nil || strings.Contains(mock.Transcript(messages), "第 2/2 页") {
+				return "", false, nil
+			}
+			return fmt.Sprintf("继续读 func_call::read_more(%q)", m[1]), true, nil
+		}),
+		mock.Sequence("读完了"),
+	)
+
+	conf := bot.Config{}
+	if err := yaml.Unmarshal([]byte("prefab_name: tester\ntool_budgets:\n  echo: {max_tokens: 40, strategy: page}\n"), &conf); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	conf.Prompt = &bot.Prompt{Content: "你是测试机器人", Functions: []string{"echo"}, FunctionCtx: bot.FunctionCtxAll}
+	tm := tool.NewToolManager()
+	tm.RegisterTool(&echoTool{})
+	b := bot.New(conf, d, tm)
+
+	got, err := b.Question(context.Background(), history.NewHistory(), "读长文")
+	if err != nil || got != "读完了" {
+		t.Fatalf("question failed: %q, %v", got, err)
+	}
+	if second := mock.Transcript(d.Call(1)); !strings.Contains(second, "第 1/2 页") || strings.Contains(second, strings.TrimRight(long, "\n")) {
+		t.Errorf("output over budget should be paged:\n%s", second)
+	}
+	if third := mock.Transcript(d.Call(2)); !strings.Contains(third, "0123456789\n\n(第 2/2 页，已经是最后一页)") {
+		t.Errorf("read_more should return the next page:\n%s", third)
+	}
+
+	// 预算只对这个 bot 生效
+	if ret := tm.Execute(context.Background(), "echo", []string{long}); ret.Response != "echo:"+strings.TrimSpace(long) {
+		t.Errorf("budget of the bot should not affect the manager, got %v", ret.Response)
+	}
+}
+
+func TestLoader_Summarize_WithoutTools(t *testing.T) {
+	d := mock.New(mock.Sequence(`func_call::echo("again")`, "总结", "总结"))
+	driver.Register("bot_test_summarizer", func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		return d, nil
+	})
+	et := &echoTool{}
+	tm := tool.NewToolManager()
+	tm.RegisterTool(et)
+	bl := bot.NewBotLoader(tm).LoadBot(context.Background(), &bot.Config{
+		PrefabName: "summarizer",
+		DriverConf: driver.Config{Driver: "bot_test_summarizer"},
+		Prompt:     &bot.Prompt{Content: "你是总结机器人", Functions: []string{"echo"}},
+	})
+	if err := bl.Error(); err != nil {
+		t.Fatalf("load bot failed: %v", err)
+	}
+
+	if _, err := bl.Summarize(context.Background(), "summarizer", "browser", strings.Repeat("很长的内容\n", 10), 20); err != nil {
+		t.Fatalf("summarize failed: %v", err)
+	}
+	if len(et.calls) != 0 {
+		t.Errorf("summarizer should not call tools, got %v", et.calls)
+	}
+	if first := mock.Transcript(d.Call(0)); strings.Contains(first, "原样返回输入") {
+		t.Errorf("functions should not be declared when summarizing:\n%s", first)
+	}
+
+	// 总结以外的时候 bot 仍然可以使用自己的 tool
+	b, _ := bl.GetBot("summarizer")
+	if !b.Tools().Allows("echo") {
+		t.Errorf("tools of the bot should not be changed")
+	}
+}
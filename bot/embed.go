@@ -0,0 +1,38 @@
+package bot
+
+import (
+	"context"
+
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/driver"
+)
+
+var ErrEmbedderNotSet = irr.Error("embedder not set")
+
+var _ driver.Embedder = new(Bot)
+
+// WithEmbedder 设置 bot 使用的 embedder，通常由 Loader 根据配置中的 embedder 创建
+func (b *Bot) WithEmbedder(e driver.Embedder) *Bot {
+	b.embedder = e
+	return b
+}
+
+// Embed 获取文本的向量
+// 没有配置 embedder 时，如果 bot 的 driver 本身实现了 driver.Embedder (如 ollama) 则直接使用
+func (b *Bot) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	log, ctx := b.Logger(ctx, "embed")
+	e := b.embedder
+	if e == nil {
+		ok := false
+		if e, ok = b.driver.(driver.Embedder); !ok {
+			return nil, irr.Wrap(ErrEmbedderNotSet, "bot %s", b.PrefabName)
+		}
+	}
+	vectors, err := e.Embed(ctx, texts)
+	if err != nil {
+		log.WithError(err).Errorf("embed %d texts failed", len(texts))
+		return nil, err
+	}
+	return vectors, nil
+}
@@ -0,0 +1,159 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bagaking/goulp/wlog"
+
+	"github.com/bagaking/botheater/call"
+	"github.com/bagaking/botheater/history"
+)
+
+type (
+	// CallGuard 限制一次请求中的函数调用，避免模型反复调用导致上下文溢出
+	// 字段为 0 时使用 DefaultCallGuard 中的值，小于 0 时不限制
+	CallGuard struct {
+		// MaxDepth 函数调用的最大轮数 (一次回复中的多个调用算一轮)
+		MaxDepth int `yaml:"max_depth,omitempty" json:"max_depth,omitempty"`
+
+		// MaxCalls 函数调用的总次数上限
+		MaxCalls int `yaml:"max_calls,omitempty" json:"max_calls,omitempty"`
+
+		// MaxRepeats 相同调用 (函数名和参数都相同) 的次数上限
+		MaxRepeats int `yaml:"max_repeats,omitempty" json:"max_repeats,omitempty"`
+	}
+
+	// GuardLimit 触发的限制
+	GuardLimit string
+
+	// GuardEvent 限制被触发时发出的事件，通过 WithGuardListener 监听
+	GuardEvent struct {
+		Bot   string
+		Limit GuardLimit
+
+		// Value 触发时的值，Max 对应的上限
+		Value int
+		Max   int
+
+		// Depth 和 Calls 触发时的轮数和已经执行的调用次数
+		Depth int
+		Calls int
+
+		// Call 触发 GuardLimitRepeats 的调用
+		Call string
+	}
+
+	// guardState 记录一次请求中的调用情况
+	guardState struct {
+		guard CallGuard
+		calls int
+		seen  map[string]int
+	}
+
+	ctxKeyGuardListener struct{}
+)
+
+const (
+	GuardLimitDepth   GuardLimit = "max_depth"
+	GuardLimitCalls   GuardLimit = "max_calls"
+	GuardLimitRepeats GuardLimit = "max_repeats"
+)
+
+// DefaultCallGuard 没有配置时使用的限制
+var DefaultCallGuard = CallGuard{
+	MaxDepth:   10,
+	MaxCalls:   30,
+	MaxRepeats: 3,
+}
+
+// MSGFunctionFinal 触发限制后的驱动指令，要求模型不再调用函数，直接给出回答
+var MSGFunctionFinal = &history.Message{
+	Role:     history.RoleUser,
+	Content:  "不能再调用 function 了，根据已有的 function 调用结果，直接给出最终回答",
+	Identity: "botheater::function::final",
+}
+
+// WithGuardListener 注册调用限制事件的监听，可以多次注册，事件按注册顺序依次通知
+func WithGuardListener(ctx context.Context, listener func(GuardEvent)) context.Context {
+	listeners, _ := ctx.Value(ctxKeyGuardListener{}).([]func(GuardEvent))
+	return context.WithValue(ctx, ctxKeyGuardListener{}, append(listeners[:len(listeners):len(listeners)], listener))
+}
+
+func emitGuardEvent(ctx context.Context, e GuardEvent) {
+	wlog.ByCtx(ctx, "guard").Warnf("%s tripped %s (%d/%d) at depth %d after %d calls %s", e.Bot, e.Limit, e.Value, e.Max, e.Depth, e.Calls, e.Call)
+	listeners, _ := ctx.Value(ctxKeyGuardListener{}).([]func(GuardEvent))
+	for _, l := range listeners {
+		l(e)
+	}
+}
+
+// withDefaults 返回补全默认值后的限制
+func (g *CallGuard) withDefaults() CallGuard {
+	ret := DefaultCallGuard
+	if g == nil {
+		return ret
+	}
+	if g.MaxDepth != 0 {
+		ret.MaxDepth = g.MaxDepth
+	}
+	if g.MaxCalls != 0 {
+		ret.MaxCalls = g.MaxCalls
+	}
+	if g.MaxRepeats != 0 {
+		ret.MaxRepeats = g.MaxRepeats
+	}
+	return ret
+}
+
+func newGuardState(g *CallGuard) *guardState {
+	return &guardState{guard: g.withDefaults(), seen: make(map[string]int)}
+}
+
+// check 在执行一轮调用之前检查限制，没有触发时记录这些调用并返回 nil
+func (s *guardState) check(depth int, calls []*call.Call) *GuardEvent {
+	exceeds := func(v, max int) bool { return max >= 0 && v > max }
+	e := &GuardEvent{Depth: depth, Calls: s.calls}
+	switch {
+	case exceeds(depth+1, s.guard.MaxDepth):
+		e.Limit, e.Value, e.Max = GuardLimitDepth, depth+1, s.guard.MaxDepth
+		return e
+	case exceeds(s.calls+len(calls), s.guard.MaxCalls):
+		e.Limit, e.Value, e.Max = GuardLimitCalls, s.calls+len(calls), s.guard.MaxCalls
+		return e
+	}
+
+	round := make(map[string]int, len(calls))
+	for _, c := range calls {
+		sig := guardSignature(c)
+		round[sig]++
+		if n := s.seen[sig] + round[sig]; exceeds(n, s.guard.MaxRepeats) {
+			e.Limit, e.Value, e.Max, e.Call = GuardLimitRepeats, n, s.guard.MaxRepeats, callSignature(c)
+			return e
+		}
+	}
+
+	s.calls += len(calls)
+	for sig, n := range round {
+		s.seen[sig] += n
+	}
+	return nil
+}
+
+// guardSignature 判断调用是否相同，使用解析后的参数值，所以 "." 和 . 是相同的调用
+func guardSignature(c *call.Call) string {
+	return c.Name + "(" + strings.Join(c.Positional(), "\x00") + ")"
+}
+
+// ToPrompt 告知模型触发了限制
+func (e *GuardEvent) ToPrompt() string {
+	switch e.Limit {
+	case GuardLimitDepth:
+		return fmt.Sprintf("function 调用已经进行了 %d 轮，达到上限，不再执行新的调用", e.Max)
+	case GuardLimitCalls:
+		return fmt.Sprintf("function 调用已经执行了 %d 次，达到上限 %d 次，不再执行新的调用", e.Calls, e.Max)
+	default:
+		return fmt.Sprintf("%s 已经调用过 %d 次，结果不会变化，不再执行", e.Call, e.Max)
+	}
+}
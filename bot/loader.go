@@ -2,15 +2,25 @@ package bot
 
 import (
 	"context"
-	"github.com/bagaking/botheater/driver"
-	"github.com/bagaking/botheater/driver/coze"
-	"github.com/bagaking/botheater/driver/ollama"
+	"fmt"
 	"reflect"
 
 	"github.com/bagaking/botheater/call/tool"
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
 	"github.com/bagaking/goulp/wlog"
 	"github.com/khicago/got/util/typer"
 	"github.com/khicago/irr"
+
+	// 内置的 driver, 通过 init 注册到 driver 包中
+	_ "github.com/bagaking/botheater/driver/cache"
+	_ "github.com/bagaking/botheater/driver/composite"
+	_ "github.com/bagaking/botheater/driver/coze"
+	_ "github.com/bagaking/botheater/driver/hashembed"
+	_ "github.com/bagaking/botheater/driver/ollama"
+	_ "github.com/bagaking/botheater/driver/openai"
+	_ "github.com/bagaking/botheater/driver/ratelimit"
+	_ "github.com/bagaking/botheater/driver/replay"
 )
 
 var (
@@ -25,11 +35,18 @@ type Loader struct {
 	err  error
 }
 
+var _ tool.Summarizer = &Loader{}
+
 // NewBotLoader creates a new Loader instance.
+// 加载的 bot 可以作为 tm 中 summarize 策略的总结者
 func NewBotLoader(tm *tool.Manager) *Loader {
-	return &Loader{
+	bl := &Loader{
 		tm: tm,
 	}
+	if tm != nil {
+		tm.WithSummarizer(bl)
+	}
+	return bl
 }
 
 func (bl *Loader) Error() error {
@@ -61,17 +78,36 @@ func (bl *Loader) LoadBot(ctx context.Context, conf *Config) *Loader {
 		return bl
 	}
 
-	var d driver.Driver
-	switch conf.DriverConf.Driver {
-	case "ollama":
-		d = ollama.New(ollama.NewClient(ctx), conf.DriverConf.Endpoint)
-	case "coze":
-		fallthrough
-	default:
-		d = coze.New(coze.NewClient(ctx), conf.DriverConf.Endpoint)
+	// 自定义的 driver 可以在自己的 module 中通过 driver.Register 注册
+	d, err := driver.New(ctx, conf.DriverConf)
+	if err != nil {
+		wlog.ByCtx(ctx, "load_bot").WithError(err).Errorf("create driver for prefab %s failed", conf.PrefabName)
+		bl.err = irr.Wrap(err, "load bot %s failed", conf.PrefabName)
+		return bl
+	}
+
+	for name, budget := range conf.ToolBudgets {
+		if err = budget.Validate(); err != nil {
+			bl.err = irr.Wrap(err, "load bot %s failed, tool budget of %s", conf.PrefabName, name)
+			return bl
+		}
+	}
+
+	if err = conf.NodeRetry.Validate(); err != nil {
+		bl.err = irr.Wrap(err, "load bot %s failed, node_retry", conf.PrefabName)
+		return bl
 	}
 
 	b := New(*conf, d, bl.tm)
+	if conf.EmbedderConf != nil {
+		e, err := driver.NewEmbedder(ctx, *conf.EmbedderConf)
+		if err != nil {
+			wlog.ByCtx(ctx, "load_bot").WithError(err).Errorf("create embedder for prefab %s failed", conf.PrefabName)
+			bl.err = irr.Wrap(err, "load bot %s failed", conf.PrefabName)
+			return bl
+		}
+		b.WithEmbedder(e)
+	}
 	bl.bots = append(bl.bots, b)
 	return bl
 }
@@ -92,6 +128,19 @@ func (bl *Loader) GetBot(name string) (*Bot, error) {
 	return bl.bots[i], bl.err
 }
 
+// Summarize 使用名字为 name 的 bot 总结 tool 过长的输出，总结时 bot 不能调用任何 tool，避免再次产生过长的输出
+func (bl *Loader) Summarize(ctx context.Context, name, toolName, content string, maxTokens int) (string, error) {
+	b, err := bl.GetBot(name)
+	if err != nil {
+		return "", irr.Wrap(err, "summarizer %s", name)
+	}
+	question := fmt.Sprintf(`下面是 function %s 的输出，内容太长了，请总结其中的关键信息，保留结论、数据和链接等细节，不超过 %d 字。
+只输出总结，不要调用 function，也不要解释。
+
+%s`, toolName, maxTokens, content)
+	return b.withoutTools().Question(ctx, history.NewHistory(), question)
+}
+
 // StaplingBots loads bots based on struct tags.
 func (bl *Loader) StaplingBots(ctx context.Context, botsStructure any) error {
 	if bl.err != nil {
@@ -0,0 +1,171 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bagaking/botheater/call"
+	"github.com/bagaking/botheater/call/tool"
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
+)
+
+// ToolDef 把 tool 转换成原生工具调用的定义，没有实现 tool.ISchemaTool 时所有参数都是必填的字符串
+func ToolDef(t tool.ITool) driver.ToolDef {
+	def := driver.ToolDef{
+		Name:        t.Name(),
+		Description: t.Usage(),
+	}
+	for _, p := range tool.Schemas(t) {
+		desc := p.Description
+		if p.Default != "" {
+			desc = strings.TrimSpace(fmt.Sprintf("%s (默认 %s)", desc, p.Default))
+		}
+		def.Params = append(def.Params, driver.ToolParam{
+			Name:        p.Name,
+			Type:        string(p.ParamType()),
+			Description: desc,
+			Required:    p.Required,
+			Enum:        p.Enum,
+		})
+	}
+	return def
+}
+
+// textProtocolKey 标记请求只能使用文本协议，流式请求拿不到结构化的调用，需要在 system prompt 中保留文本协议的说明
+type textProtocolKey struct{}
+
+func withTextProtocol(ctx context.Context) context.Context {
+	return context.WithValue(ctx, textProtocolKey{}, true)
+}
+
+// nativeTools driver 支持原生工具调用且 bot 配置了 functions 时，返回 driver 和工具定义
+func (b *Bot) nativeTools(ctx context.Context) (driver.ToolCaller, []driver.ToolDef) {
+	tc, ok := driver.AsToolCaller(b.driver)
+	if !ok || b.DisableNativeTools || b.Prompt == nil {
+		return nil, nil
+	}
+	if textOnly, _ := ctx.Value(textProtocolKey{}).(bool); textOnly {
+		return nil, nil
+	}
+	defs := make([]driver.ToolDef, 0, len(b.Prompt.Functions))
+	for _, name := range b.Prompt.Functions {
+		if t, exists := b.tm.GetTool(name); exists {
+			defs = append(defs, ToolDef(t))
+		}
+	}
+	if len(defs) == 0 {
+		return nil, nil
+	}
+	return tc, defs
+}
+
+// chatWithTools 函数调用流程中使用的请求，driver 支持时走原生工具调用协议，结构化的调用原样返回
+// driver 没有给出调用 id 时按消息数和序号生成，同一次对话中的 id 不会重复，重放时也保持一致
+func (b *Bot) chatWithTools(ctx context.Context, messages history.Messages) (string, []driver.ToolCall, error) {
+	tc, defs := b.nativeTools(ctx)
+	if tc == nil {
+		got, err := b.chat(ctx, messages)
+		return got, nil, err
+	}
+	if b.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Timeout)
+		defer cancel()
+	}
+
+	content, calls, err := tc.ChatWithTools(ctx, messages, defs)
+	if err != nil {
+		return "", nil, err
+	}
+	for i := range calls {
+		if calls[i].ID == "" {
+			calls[i].ID = fmt.Sprintf("call_%d_%d", len(messages), i)
+		}
+	}
+	return strings.TrimSpace(content), calls, nil
+}
+
+// executeToolCalls 执行原生工具调用协议返回的调用，每个调用的结果作为对应 id 的 tool 消息返回给模型
+// tool 消息只能携带文本，工具返回的图片等片段在所有结果之后用一条用户消息附带
+func (b *Bot) executeToolCalls(ctx context.Context, send requester, reqHistory history.Messages, tempMessages *history.Messages, nativeCalls []driver.ToolCall, guard *guardState, stackDepth int) (string, error) {
+	log, ctx := b.Logger(ctx, fmt.Sprintf("ef-%d", stackDepth))
+
+	calls := make([]*call.Call, 0, len(nativeCalls))
+	executed := make([]driver.ToolCall, 0, len(nativeCalls))
+	failures := make(history.Messages, 0)
+	for _, nc := range nativeCalls {
+		c, err := tool.Caller.Parse(ctx, b.renderToolCall(nc))
+		if err != nil {
+			log.WithError(err).Warnf("failed to parse tool call %s", nc.Name)
+			failures = append(failures, history.NewToolResultMsg(nc.ID, nc.Name, err.Error()+"\n请检查后重试"))
+			continue
+		}
+		calls = append(calls, c)
+		executed = append(executed, nc)
+	}
+	if e := guard.check(stackDepth, calls); e != nil {
+		e.Bot = b.PrefabName
+		emitGuardEvent(ctx, *e)
+		return b.forceFinalAnswer(ctx, send, reqHistory, tempMessages, nativeCalls, e)
+	}
+
+	returns := make([]string, 0, len(nativeCalls))
+	attachments := make(history.Messages, 0)
+	for i, result := range b.tm.ExecuteCalls(ctx, calls) {
+		parts := takeParts(&result)
+		functionReturns := result.ToPrompt()
+		*tempMessages = append(*tempMessages, history.NewToolResultMsg(executed[i].ID, executed[i].Name, functionReturns))
+		if len(parts) > 0 {
+			attachments = append(attachments, history.NewUserMsg(
+				fmt.Sprintf("%s 返回的附件", executed[i].Name), tool.Caller.Prefix,
+			).WithParts(parts...))
+		}
+		returns = append(returns, functionReturns)
+	}
+	for _, f := range failures {
+		returns = append(returns, f.Content)
+	}
+	*tempMessages = append(*tempMessages, failures...)
+	*tempMessages = append(*tempMessages, attachments...)
+
+	req := append(make(history.Messages, 0), reqHistory...) // 注入当前历史
+	req = append(req, *tempMessages...)                     // 注入调用和结果，tool 消息本身就会驱动模型继续
+
+	return b.continueFunctions(ctx, send, reqHistory, tempMessages, req, calls, returns, guard, stackDepth)
+}
+
+// renderToolCall 按 tool 声明的参数顺序把结构化调用渲染成文本协议，字符串参数会被 JSON 转义
+// 声明了参数定义的 tool 使用具名参数，没有传入的可选参数会被省略
+func (b *Bot) renderToolCall(c driver.ToolCall) string {
+	var (
+		names []string
+		named bool
+	)
+	if t, ok := b.tm.GetTool(c.Name); ok {
+		_, named = t.(tool.ISchemaTool)
+		names = t.ParamNames()
+	}
+	args := make([]string, 0, len(names))
+	for _, name := range names {
+		v, ok := c.Arguments[name]
+		if !ok && named {
+			continue
+		}
+		if !ok {
+			v = ""
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			raw = []byte(`""`)
+		}
+		if named {
+			args = append(args, name+"="+string(raw))
+			continue
+		}
+		args = append(args, string(raw))
+	}
+	return tool.Caller.Prefix + c.Name + "(" + strings.Join(args, ", ") + ")"
+}
@@ -41,15 +41,18 @@ const (
 	FunctionCtxAll   FunctionCtx = "all"
 )
 
-// 获取函数信息
-func (p *Prompt) makeFunctionsPrompt(tm *tool.Manager) (string, error) {
+// 获取函数信息，textProtocol 为 false 时 functions 以原生工具调用的方式下发，不需要文本协议的说明
+func (p *Prompt) makeFunctionsPrompt(tm *tool.Manager, textProtocol bool) (string, error) {
 	if p == nil || tm == nil || len(p.Functions) == 0 {
 		return "", nil
 	}
 
-	ret, err := tm.ToPrompt(p.Functions)
-	if err != nil {
-		return "", irr.Wrap(err, "make functions prompt failed")
+	ret := ""
+	if textProtocol {
+		var err error
+		if ret, err = tm.ToPrompt(p.Functions); err != nil {
+			return "", irr.Wrap(err, "make functions prompt failed")
+		}
 	}
 	if p.FunctionMode == FunctionModeSampleOnly { // 不同的采样模式，影响函数调用的提示
 		ret += `没有调用函数的时候，要对过去发生的事情进行总结`
@@ -59,6 +62,10 @@ func (p *Prompt) makeFunctionsPrompt(tm *tool.Manager) (string, error) {
 }
 
 func (p *Prompt) BuildSystemMessage(ctx context.Context, tm *tool.Manager, arguments map[string]any) *history.Message {
+	return p.buildSystemMessage(ctx, tm, arguments, true)
+}
+
+func (p *Prompt) buildSystemMessage(ctx context.Context, tm *tool.Manager, arguments map[string]any, textProtocol bool) *history.Message {
 	log := wlog.ByCtx(ctx, "BuildSystemMessage")
 	if p == nil {
 		return &history.Message{
@@ -68,7 +75,7 @@ func (p *Prompt) BuildSystemMessage(ctx context.Context, tm *tool.Manager, argum
 	}
 	all := p.Content
 
-	functionInfo, err := p.makeFunctionsPrompt(tm)
+	functionInfo, err := p.makeFunctionsPrompt(tm, textProtocol)
 	if err != nil { // todo: 考虑下，当任一 function 没有加载，则都不会加载
 		log.WithError(err).Warnf("build functions failed")
 	}
@@ -0,0 +1,216 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/bagaking/botheater/call"
+	"github.com/bagaking/botheater/call/tool"
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
+)
+
+type (
+	// callDetector 转发流式返回的增量，发现 func_call:: 或 agent_call:: 后不再转发，
+	// 调用完整以后忽略之后的增量
+	callDetector struct {
+		handle  func(delta string)
+		sb      strings.Builder
+		emitted int  // 已经转发的字节数
+		calling bool // 已经发现了调用前缀
+		done    bool // 调用已经完整
+	}
+)
+
+// StreamQuestion 与 Question 相同，但是会通过 handle 实时返回生成的内容
+// 回答中出现函数调用时，会在调用完整后停止接收、执行函数，并继续流式返回后续的回答
+func (b *Bot) StreamQuestion(ctx context.Context, h *history.History, question string, handle func(delta string)) (string, error) {
+	h.EnqueueUserMsg(question)
+	return b.StreamChat(ctx, h, handle)
+}
+
+// StreamQuestionChan 与 StreamQuestion 相同，但是通过 channel 返回增量
+// 回答结束或失败时 deltas 被关闭，之后可以通过 wait 获取最终结果
+func (b *Bot) StreamQuestionChan(ctx context.Context, h *history.History, question string) (deltas <-chan string, wait func() (string, error)) {
+	ch := make(chan string, 64)
+	var (
+		got string
+		err error
+	)
+	go func() {
+		defer close(ch)
+		got, err = b.StreamQuestion(ctx, h, question, func(delta string) {
+			select {
+			case ch <- delta:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return ch, func() (string, error) {
+		for range ch { // 等待结束，没有被读走的增量直接丢弃
+		}
+		return got, err
+	}
+}
+
+// StreamChat 与 SendChat 相同，但是会通过 handle 实时返回生成的内容
+func (b *Bot) StreamChat(ctx context.Context, globalHistory *history.History, handle func(delta string)) (string, error) {
+	log, ctx := b.Logger(ctx, "stream_chat")
+	ctx = withTextProtocol(ctx)
+	messages := b.Messages(ctx, globalHistory)
+	got, err := b.StreamReq(ctx, messages, handle)
+	if err != nil {
+		log.WithError(err).Error("stream chat failed")
+		return "", err
+	}
+	return got, nil
+}
+
+// StreamReq 与 NormalReq 相同，但是请求 driver 时使用流式接口
+func (b *Bot) StreamReq(ctx context.Context, mergedHistory history.Messages, handle func(delta string)) (string, error) {
+	log, ctx := b.Logger(ctx, "stream_req")
+	ctx = withTextProtocol(ctx) // 流式请求只支持文本协议
+	return b.request(ctx, log, mergedHistory, b.streamer(handle))
+}
+
+// streamer 流式请求 driver，得到完整的调用后不再转发和记录增量，但是会等待 driver 把这次请求读完
+// 不主动取消请求，replay、cache 等包装才能完整地录制和缓存这一轮回复，usage 也能正常上报
+func (b *Bot) streamer(handle func(delta string)) requester {
+	return func(ctx context.Context, messages history.Messages) (string, []driver.ToolCall, error) {
+		if b.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, b.Timeout)
+			defer cancel()
+		}
+
+		d := &callDetector{handle: handle}
+		if err := b.driver.StreamChat(ctx, messages, func(got string) { d.write(got) }); err != nil {
+			return "", nil, err
+		}
+		d.flush()
+		return d.sb.String(), nil, nil
+	}
+}
+
+// write 写入一个增量，已经得到完整的调用后忽略之后的增量
+func (d *callDetector) write(delta string) {
+	if d.done {
+		return
+	}
+	d.sb.WriteString(delta)
+	text := d.sb.String()
+
+	if !d.calling {
+		pending := text[d.emitted:]
+		if i := indexCallPrefix(pending); i >= 0 {
+			d.emit(text[:d.emitted+i])
+			d.calling = true
+		} else {
+			d.emit(text[:d.emitted+safePrefixLen(pending)])
+		}
+	}
+	if d.calling && callsDone(text) {
+		d.done = true
+	}
+}
+
+// callsDone 调用已经完整，并且之后出现了调用以外的内容 (或者调用格式错误) 时返回 true
+// 多个调用连续出现时 (如每行一个) 会继续接收，直到最后一个调用之后出现其他内容或流结束
+func callsDone(text string) bool {
+	return scanCalls(text, false)
+}
+
+// callsComplete 流结束时使用，至少有一个完整的调用时返回 true
+func callsComplete(text string) bool {
+	return scanCalls(text, true)
+}
+
+// scanCalls 依次解析 text 中的调用，ended 表示流已经结束，不会再有后续内容
+func scanCalls(text string, ended bool) bool {
+	complete := false
+	for offset := 0; ; {
+		rest := strings.TrimLeft(text[offset:], " \t\r\n")
+		if complete && !mayBeCall(rest) {
+			return true
+		}
+
+		name, start := "", -1
+		for _, ct := range []*call.Caller{tool.Caller, Caller} {
+			if loc := ct.Regex.FindStringIndex(text[offset:]); loc != nil && (start < 0 || offset+loc[1] < start) {
+				name, start = text[offset+loc[0]:offset+loc[1]], offset+loc[1]
+			}
+		}
+		if start < 0 {
+			return ended && complete // 调用还没有完整出现
+		}
+		if complete && !strings.HasPrefix(rest, name) {
+			return true // 前缀之后不是合法的调用
+		}
+
+		_, end, err := call.ParseArgs(text, start)
+		if err != nil {
+			if ended {
+				return complete
+			}
+			pe := &call.ParseError{}
+			return !(errors.As(err, &pe) && pe.Incomplete)
+		}
+		complete, offset = true, end
+	}
+}
+
+// mayBeCall s 是调用的开头，或者还不足以判断 (为空或是调用前缀的一部分)
+func mayBeCall(s string) bool {
+	for _, prefix := range callPrefixes() {
+		if strings.HasPrefix(s, prefix) || strings.HasPrefix(prefix, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// flush 流结束后，如果没有得到完整的调用，把剩余的内容都转发出去
+// 回复以调用结尾时 (调用之后没有其他内容) 调用同样不转发
+func (d *callDetector) flush() {
+	if !d.done && d.calling && callsComplete(d.sb.String()) {
+		d.done = true
+	}
+	if !d.done {
+		d.emit(d.sb.String())
+	}
+}
+
+func (d *callDetector) emit(upTo string) {
+	if len(upTo) > d.emitted {
+		d.handle(upTo[d.emitted:])
+		d.emitted = len(upTo)
+	}
+}
+
+func callPrefixes() []string {
+	return []string{tool.Caller.Prefix, Caller.Prefix}
+}
+
+// indexCallPrefix 返回第一个调用前缀的位置，没有时返回 -1
+func indexCallPrefix(s string) int {
+	ret := -1
+	for _, prefix := range callPrefixes() {
+		if i := strings.Index(s, prefix); i >= 0 && (ret < 0 || i < ret) {
+			ret = i
+		}
+	}
+	return ret
+}
+
+// safePrefixLen 返回可以安全转发的长度，结尾可能是调用前缀开头的部分需要等待后续内容
+func safePrefixLen(s string) int {
+	for i := 0; i < len(s); i++ {
+		for _, prefix := range callPrefixes() {
+			if strings.HasPrefix(prefix, s[i:]) {
+				return i
+			}
+		}
+	}
+	return len(s)
+}
@@ -0,0 +1,182 @@
+package bot_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bagaking/botheater/bot"
+	"github.com/bagaking/botheater/call/tool"
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/driver/mock"
+	"github.com/bagaking/botheater/driver/replay"
+	"github.com/bagaking/botheater/history"
+)
+
+func TestBot_StreamQuestion_NoFunctionCall(t *testing.T) {
+	d := mock.New(mock.Sequence("这是一个比较长的直接回答，会被分成很多片")).WithStreamChunkSize(3)
+	b, _ := newTestBot(bot.FunctionModeDump, d)
+
+	var deltas []string
+	got, err := b.StreamQuestion(context.Background(), history.NewHistory(), "你好", func(delta string) {
+		deltas = append(deltas, delta)
+	})
+	if err != nil {
+		t.Fatalf("stream question failed: %v", err)
+	}
+	if got != "这是一个比较长的直接回答，会被分成很多片" || strings.Join(deltas, "") != got {
+		t.Errorf("got %q, deltas %v", got, deltas)
+	}
+	if len(deltas) < 2 {
+		t.Errorf("answer should be streamed in pieces, got %v", deltas)
+	}
+}
+
+func TestBot_StreamQuestion_FunctionCall(t *testing.T) {
+	d := mock.New(
+		mock.Match(`^查一下$`, `我先查一下。func_call::echo("a") 这之后的内容不会被接收`),
+		isLast(history.MSGFunctionContinue, "查到了: a"),
+	).WithStreamChunkSize(2)
+	b, et := newTestBot(bot.FunctionModeDump, d)
+
+	var deltas []string
+	got, err := b.StreamQuestion(context.Background(), history.NewHistory(), "查一下", func(delta string) {
+		deltas = append(deltas, delta)
+	})
+	if err != nil {
+		t.Fatalf("stream question failed: %v", err)
+	}
+	if got != "查到了: a" || strings.Join(et.calls, ",") != "a" {
+		t.Errorf("got %q, tool calls %v", got, et.calls)
+	}
+
+	// 调用本身不会被转发，调用之后的内容在停止接收后被丢弃，后续回答继续流式返回
+	if streamed := strings.Join(deltas, ""); streamed != "我先查一下。查到了: a" {
+		t.Errorf("unexpected streamed content %q", streamed)
+	}
+	callMsg := d.Call(1)[len(d.Call(1))-3]
+	if strings.Contains(callMsg.Content, "不会被接收") || !strings.Contains(callMsg.Content, `func_call::echo("a")`) {
+		t.Errorf("stream should stop once the call is complete, got %q", callMsg.Content)
+	}
+}
+
+func TestBot_StreamQuestion_EndsWithCall(t *testing.T) {
+	d := mock.New(
+		mock.Match(`^查一下$`, `我先查一下。func_call::echo("a")`),
+		isLast(history.MSGFunctionContinue, "查到了"),
+	).WithStreamChunkSize(2)
+	b, et := newTestBot(bot.FunctionModeDump, d)
+
+	var sb strings.Builder
+	got, err := b.StreamQuestion(context.Background(), history.NewHistory(), "查一下", func(delta string) {
+		sb.WriteString(delta)
+	})
+	if err != nil {
+		t.Fatalf("stream question failed: %v", err)
+	}
+	if got != "查到了" || strings.Join(et.calls, ",") != "a" {
+		t.Errorf("got %q, tool calls %v", got, et.calls)
+	}
+	// 回复以调用结尾时调用同样不会被转发
+	if sb.String() != "我先查一下。查到了" {
+		t.Errorf("unexpected streamed content %q", sb.String())
+	}
+}
+
+func TestBot_StreamQuestion_MultipleCalls(t *testing.T) {
+	d := mock.New(
+		mock.Match(`^查两个$`, "分别查一下。\nfunc_call::echo(\"a\")\n  func_call::echo(\"b\")\n这之后的内容不会被接收 func_call::echo(\"c\")"),
+		isLast(history.MSGFunctionContinue, "查到了: a b"),
+	).WithStreamChunkSize(3)
+	b, et := newTestBot(bot.FunctionModeDump, d)
+
+	var sb strings.Builder
+	got, err := b.StreamQuestion(context.Background(), history.NewHistory(), "查两个", func(delta string) {
+		sb.WriteString(delta)
+	})
+	if err != nil {
+		t.Fatalf("stream question failed: %v", err)
+	}
+	// 连续的调用都会被接收，之后出现其他内容时停止
+	if got != "查到了: a b" || strings.Join(et.calls, ",") != "a,b" {
+		t.Errorf("got %q, tool calls %v", got, et.calls)
+	}
+	if sb.String() != "分别查一下。\n查到了: a b" {
+		t.Errorf("unexpected streamed content %q", sb.String())
+	}
+}
+
+func TestBot_StreamQuestion_AgentCall(t *testing.T) {
+	d := mock.New(mock.Sequence(`交给写手 agent_call::writer("写笑话") 多余的内容`)).WithStreamChunkSize(4)
+	b, _ := newTestBot(bot.FunctionModeDump, d)
+
+	deltas, wait := b.StreamQuestionChan(context.Background(), history.NewHistory(), "写个笑话")
+	streamed := ""
+	for delta := range deltas {
+		streamed += delta
+	}
+	got, err := wait()
+	if err != nil {
+		t.Fatalf("stream question failed: %v", err)
+	}
+	if streamed != "交给写手 " || !bot.Caller.HasCall(got) || strings.Contains(got, "多余") {
+		t.Errorf("streamed %q, got %q", streamed, got)
+	}
+}
+
+func TestBot_StreamQuestion_PrefixWithoutCall(t *testing.T) {
+	// 只有前缀但不是合法的调用时，剩余内容在结束时补发
+	d := mock.New(mock.Sequence("示例写法是 func_call::name 这样")).WithStreamChunkSize(3)
+	b, _ := newTestBot(bot.FunctionModeDump, d)
+
+	var sb strings.Builder
+	got, err := b.StreamQuestion(context.Background(), history.NewHistory(), "你好", func(delta string) {
+		sb.WriteString(delta)
+	})
+	if err != nil {
+		t.Fatalf("stream question failed: %v", err)
+	}
+	if sb.String() != got || got != "示例写法是 func_call::name 这样" {
+		t.Errorf("got %q, streamed %q", got, sb.String())
+	}
+}
+
+func TestBot_StreamQuestion_FunctionCallRecordThenReplay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "stream.cassette.json")
+	newBot := func(d driver.Driver) (*bot.Bot, *echoTool) {
+		et := &echoTool{}
+		tm := tool.NewToolManager()
+		tm.RegisterTool(et)
+		return bot.New(bot.Config{
+			PrefabName: "tester",
+			Prompt:     &bot.Prompt{Content: "你是测试机器人", Functions: []string{"echo"}, FunctionCtx: bot.FunctionCtxAll},
+		}, d, tm), et
+	}
+	ask := func(b *bot.Bot) (string, string) {
+		var deltas []string
+		got, err := b.StreamQuestion(ctx, history.NewHistory(), "查一下", func(delta string) { deltas = append(deltas, delta) })
+		if err != nil {
+			t.Fatalf("stream question failed: %v", err)
+		}
+		return got, strings.Join(deltas, "")
+	}
+
+	inner := mock.New(
+		mock.Match(`^查一下$`, `我先查一下。func_call::echo("a") 这之后的内容不会被转发`),
+		isLast(history.MSGFunctionContinue, "查到了: a"),
+	).WithStreamChunkSize(2)
+	recorded, recordedDeltas := ask(func() *bot.Bot { b, _ := newBot(replay.NewRecorder(inner, path)); return b }())
+
+	// 发现调用后 driver 的流照常读完，带有调用的这一轮也会被录制
+	player, err := replay.NewPlayer(path)
+	if err != nil {
+		t.Fatalf("create player failed: %v", err)
+	}
+	b, et := newBot(player)
+	replayed, replayedDeltas := ask(b)
+	if replayed != recorded || replayedDeltas != recordedDeltas || strings.Join(et.calls, ",") != "a" {
+		t.Errorf("replayed %q (%q), recorded %q (%q), tool calls %v", replayed, replayedDeltas, recorded, recordedDeltas, et.calls)
+	}
+}
@@ -9,29 +9,84 @@ import (
 	"github.com/khicago/irr"
 )
 
+// Caller 调用协议，如 func_call::name(params)
+// Regex 用于定位调用的开头，需要匹配到左括号为止，并且第一个分组是调用的名字
 type Caller struct {
 	Prefix string
 	Regex  *regexp.Regexp
 }
 
-func (ct *Caller) ParseCall(ctx context.Context, content string) (name string, params []string, err error) {
+// NewCaller 根据前缀创建 Caller，调用名由字母、数字和下划线组成
+func NewCaller(prefix string) *Caller {
+	return &Caller{
+		Prefix: prefix,
+		Regex:  regexp.MustCompile(regexp.QuoteMeta(prefix) + `(\w+)\(`),
+	}
+}
+
+// Parse 解析 content 中的第一个调用，格式错误时返回 *ParseError，其中包含出错的行列
+func (ct *Caller) Parse(ctx context.Context, content string) (*Call, error) {
+	c, _, err := ct.parseFrom(ctx, content, 0)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, irr.Error("invalid call format")
+	}
+	return c, nil
+}
+
+// ParseAll 按出现顺序解析 content 中的所有调用
+// 遇到格式错误时停止，返回之前已经解析出的调用和该错误
+func (ct *Caller) ParseAll(ctx context.Context, content string) ([]*Call, error) {
+	calls := make([]*Call, 0)
+	for offset := 0; ; {
+		c, end, err := ct.parseFrom(ctx, content, offset)
+		if err != nil {
+			return calls, err
+		}
+		if c == nil {
+			return calls, nil
+		}
+		calls = append(calls, c)
+		offset = end
+	}
+}
+
+// parseFrom 解析 content[offset:] 中的第一个调用，没有调用时返回 nil，end 是调用结束的位置
+func (ct *Caller) parseFrom(ctx context.Context, content string, offset int) (c *Call, end int, err error) {
 	log := wlog.ByCtx(ctx, "parse_call")
-	matches := ct.Regex.FindStringSubmatch(content)
-	if len(matches) < 2 {
-		return "", nil, irr.Error("invalid call format")
+	loc := ct.Regex.FindStringSubmatchIndex(content[offset:])
+	if len(loc) < 4 {
+		return nil, offset, nil
+	}
+	for i := range loc {
+		loc[i] += offset
 	}
 
-	name = matches[1]
-	paramsStr := matches[2]
-	if paramsStr == "" {
-		return name, []string{}, nil
+	args, end, err := ParseArgs(content, loc[1])
+	if err != nil {
+		return nil, end, err
 	}
-	params = strings.Split(paramsStr, ",")
+	c = &Call{
+		Name: content[loc[2]:loc[3]],
+		Args: args,
+		Raw:  content[loc[0]:end],
+	}
+	log.Infof("find caller %s%s ( %v )", ct.Prefix, c.Name, strings.Join(c.RawArgs(), ", "))
+	return c, end, nil
+}
 
-	log.Infof("find caller %s%s ( %v )", ct.Prefix, name, strings.Join(params, ","))
-	return name, params, nil
+// ParseCall 解析 content 中的第一个调用，返回调用名和参数值，具名参数以 name=value 的形式返回
+func (ct *Caller) ParseCall(ctx context.Context, content string) (name string, params []string, err error) {
+	c, err := ct.Parse(ctx, content)
+	if err != nil {
+		return "", nil, err
+	}
+	return c.Name, c.Positional(), nil
 }
 
+// HasCall content 中出现了调用的开头，调用本身可能格式错误，此时 Parse 会返回具体的错误
 func (ct *Caller) HasCall(content string) bool {
 	return ct.Regex.MatchString(content)
 }
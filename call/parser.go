@@ -0,0 +1,378 @@
+package call
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/khicago/irr"
+)
+
+type (
+	// Call 解析出的一次调用
+	Call struct {
+		Name string
+		Args []Arg
+
+		// Raw 调用的原文，从前缀开始到右括号结束
+		Raw string
+	}
+
+	// Arg 调用的一个参数
+	Arg struct {
+		// Name 具名参数 (name=value) 的名字，位置参数为空
+		Name string
+
+		// Value 参数的值: 字符串去掉引号并处理转义，JSON 对象和数组保留 JSON 原文，其他取原文并去掉首尾空白
+		Value string
+
+		// Raw 参数值的原文
+		Raw string
+
+		// JSON 值是 JSON 对象或数组
+		JSON bool
+	}
+
+	// ParseError 解析失败时返回，Line 和 Column 从 1 开始，按字符计算
+	ParseError struct {
+		Line   int
+		Column int
+		Msg    string
+
+		// Incomplete 内容在调用结束前就结束了 (如流式返回还没收完)
+		Incomplete bool
+
+		line string // 出错的那一行，用于展示
+	}
+
+	argParser struct {
+		src string
+		pos int
+	}
+)
+
+var ErrParseCall = irr.Error("parse call failed")
+
+func (e *ParseError) Error() string {
+	caret := strings.Repeat(" ", max(e.Column-1, 0)) + "^"
+	return fmt.Sprintf("调用格式错误 (第 %d 行第 %d 列): %s\n%s\n%s", e.Line, e.Column, e.Msg, e.line, caret)
+}
+
+func (e *ParseError) Unwrap() error {
+	return ErrParseCall
+}
+
+// Positional 返回所有参数的值，具名参数以 name=value 的形式返回
+func (c *Call) Positional() []string {
+	ret := make([]string, 0, len(c.Args))
+	for _, a := range c.Args {
+		if a.Name != "" {
+			ret = append(ret, a.Name+"="+a.Value)
+			continue
+		}
+		ret = append(ret, a.Value)
+	}
+	return ret
+}
+
+// RawArgs 返回参数的原文，用于回显给模型
+func (c *Call) RawArgs() []string {
+	ret := make([]string, 0, len(c.Args))
+	for _, a := range c.Args {
+		if a.Name != "" {
+			ret = append(ret, a.Name+"="+a.Raw)
+			continue
+		}
+		ret = append(ret, a.Raw)
+	}
+	return ret
+}
+
+// ParseArgs 从 src[start:] 开始解析参数列表，start 指向左括号之后的位置
+// 支持双引号/单引号字符串 (含转义)、嵌套括号、JSON 对象和数组，以及 name=value 形式的具名参数
+// 返回右括号之后的位置
+func ParseArgs(src string, start int) (args []Arg, end int, err error) {
+	p := &argParser{src: src, pos: start}
+	args = make([]Arg, 0)
+
+	p.skipSpace()
+	if p.peek() == ')' {
+		return args, p.pos + 1, nil
+	}
+	for {
+		arg, err := p.parseArg()
+		if err != nil {
+			return nil, p.pos, err
+		}
+		args = append(args, arg)
+
+		p.skipSpace()
+		switch p.peek() {
+		case ')':
+			return args, p.pos + 1, nil
+		case ',':
+			p.pos++
+			p.skipSpace()
+			if p.peek() == ')' { // 允许结尾多一个逗号
+				return args, p.pos + 1, nil
+			}
+		case 0:
+			return nil, p.pos, p.incomplete("调用没有结束，缺少 )")
+		default:
+			return nil, p.pos, p.errorf("参数之间需要用 , 分隔，这里是 %q", p.peekRune())
+		}
+	}
+}
+
+func (p *argParser) parseArg() (Arg, error) {
+	arg := Arg{}
+	if name, next, ok := p.namedPrefix(); ok {
+		arg.Name = name
+		p.pos = next
+		p.skipSpace()
+	}
+
+	start := p.pos
+	switch c := p.peek(); c {
+	case '"', '\'':
+		value, err := p.parseString(c)
+		if err != nil {
+			return arg, err
+		}
+		arg.Value = value
+	case '{', '[':
+		if err := p.skipBalanced(); err != nil {
+			return arg, err
+		}
+		raw := p.src[start:p.pos]
+		if !json.Valid([]byte(raw)) {
+			p.pos = start
+			return arg, p.errorf("JSON 参数格式不正确: %s", raw)
+		}
+		arg.Value, arg.JSON = raw, true
+	case ',', ')':
+		return arg, p.errorf("缺少参数值")
+	case 0:
+		return arg, p.incomplete("调用没有结束，缺少参数")
+	default:
+		if err := p.skipBare(); err != nil {
+			return arg, err
+		}
+		arg.Value = strings.TrimSpace(p.src[start:p.pos])
+	}
+	arg.Raw = strings.TrimSpace(p.src[start:p.pos])
+	return arg, nil
+}
+
+// namedPrefix 识别 name= 形式的前缀，== 不算
+func (p *argParser) namedPrefix() (name string, next int, ok bool) {
+	i := p.pos
+	for i < len(p.src) {
+		r, size := utf8.DecodeRuneInString(p.src[i:])
+		if !(r == '_' || unicode.IsLetter(r) || (i > p.pos && unicode.IsDigit(r))) {
+			break
+		}
+		i += size
+	}
+	if i == p.pos {
+		return "", 0, false
+	}
+	name = p.src[p.pos:i]
+	for i < len(p.src) && (p.src[i] == ' ' || p.src[i] == '\t') {
+		i++
+	}
+	if i >= len(p.src) || p.src[i] != '=' || (i+1 < len(p.src) && p.src[i+1] == '=') {
+		return "", 0, false
+	}
+	return name, i + 1, true
+}
+
+// parseString 解析引号包裹的字符串，转义规则与 JSON 相同，另外支持 \' ；无法识别的转义保留原文
+func (p *argParser) parseString(quote byte) (string, error) {
+	start := p.pos
+	p.pos++ // 跳过左引号
+	sb := strings.Builder{}
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch c {
+		case quote:
+			p.pos++
+			return sb.String(), nil
+		case '\\':
+			if p.pos+1 >= len(p.src) {
+				break
+			}
+			esc := p.src[p.pos+1]
+			switch esc {
+			case '"', '\'', '\\', '/':
+				sb.WriteByte(esc)
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'u':
+				r, n, err := p.unicodeEscape()
+				if err != nil {
+					return "", err
+				}
+				sb.WriteRune(r)
+				p.pos += n
+				continue
+			default:
+				sb.WriteByte('\\')
+				sb.WriteByte(esc)
+			}
+			p.pos += 2
+			continue
+		}
+		sb.WriteByte(c)
+		p.pos++
+	}
+	p.pos = start
+	return "", p.incomplete(fmt.Sprintf("字符串没有结束，缺少 %c", quote))
+}
+
+// unicodeEscape 解析 \uXXXX，高位代理后面紧跟低位代理时合并成一个字符
+func (p *argParser) unicodeEscape() (r rune, n int, err error) {
+	hex := func(at int) (rune, bool) {
+		if at+6 > len(p.src) || p.src[at:at+2] != `\u` {
+			return 0, false
+		}
+		v, err := strconv.ParseUint(p.src[at+2:at+6], 16, 16)
+		return rune(v), err == nil
+	}
+	r, ok := hex(p.pos)
+	if !ok {
+		if p.pos+6 > len(p.src) {
+			return 0, 0, p.incomplete("\\u 转义不完整")
+		}
+		return 0, 0, p.errorf("无法识别的转义 %s", p.src[p.pos:p.pos+6])
+	}
+	if utf16.IsSurrogate(r) {
+		if low, ok := hex(p.pos + 6); ok {
+			if pair := utf16.DecodeRune(r, low); pair != utf8.RuneError {
+				return pair, 12, nil
+			}
+		}
+	}
+	return r, 6, nil
+}
+
+// skipBalanced 跳过一个括号配对的片段 ({}、[]、())，其中的字符串会被整体跳过
+func (p *argParser) skipBalanced() error {
+	start := p.pos
+	stack := make([]byte, 0, 4)
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch c {
+		case '"':
+			if _, err := p.parseString(c); err != nil {
+				return err
+			}
+			continue
+		case '{', '[', '(':
+			stack = append(stack, closing(c))
+		case '}', ']', ')':
+			if len(stack) == 0 || stack[len(stack)-1] != c {
+				return p.errorf("括号不匹配，这里是 %q", rune(c))
+			}
+			stack = stack[:len(stack)-1]
+		}
+		p.pos++
+		if len(stack) == 0 {
+			return nil
+		}
+	}
+	p.pos = start
+	return p.incomplete(fmt.Sprintf("%c 没有闭合", p.src[start]))
+}
+
+// skipBare 跳过没有引号的参数，直到顶层的 , 或 )，其中的括号需要配对
+func (p *argParser) skipBare() error {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; c {
+		case ',', ')':
+			return nil
+		case '(', '[', '{':
+			if err := p.skipBalanced(); err != nil {
+				return err
+			}
+		case '\n':
+			return p.errorf("参数中不能换行，多行内容请使用引号")
+		default:
+			p.pos++
+		}
+	}
+	return p.incomplete("调用没有结束，缺少 )")
+}
+
+func (p *argParser) skipSpace() {
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case ' ', '\t', '\n', '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *argParser) peek() byte {
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *argParser) peekRune() rune {
+	r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+	return r
+}
+
+func (p *argParser) errorf(format string, args ...any) *ParseError {
+	return NewParseError(p.src, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *argParser) incomplete(msg string) *ParseError {
+	e := NewParseError(p.src, p.pos, msg)
+	e.Incomplete = true
+	return e
+}
+
+// NewParseError 根据字节偏移计算行列
+func NewParseError(src string, offset int, msg string) *ParseError {
+	offset = min(max(offset, 0), len(src))
+	lineStart := strings.LastIndexByte(src[:offset], '\n') + 1
+	lineEnd := strings.IndexByte(src[offset:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(src)
+	} else {
+		lineEnd += offset
+	}
+	return &ParseError{
+		Line:   strings.Count(src[:offset], "\n") + 1,
+		Column: utf8.RuneCountInString(src[lineStart:offset]) + 1,
+		Msg:    msg,
+		line:   src[lineStart:lineEnd],
+	}
+}
+
+func closing(c byte) byte {
+	switch c {
+	case '{':
+		return '}'
+	case '[':
+		return ']'
+	}
+	return ')'
+}
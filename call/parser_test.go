@@ -0,0 +1,130 @@
+package call_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bagaking/botheater/call"
+)
+
+var testCaller = call.NewCaller("func_call::")
+
+func TestCaller_Parse(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"empty", `func_call::now()`, []string{}},
+		{"bare", `前面的文字 func_call::echo(hello world) 后面的文字`, []string{"hello world"}},
+		{"quoted comma", `func_call::echo("a, b", 'c')`, []string{"a, b", "c"}},
+		{"paren in string", `func_call::echo("f(x) = )")`, []string{"f(x) = )"}},
+		{"escapes", `func_call::echo("line1\nline2 \"q\" 你😀", 'it\'s')`, []string{"line1\nline2 \"q\" 你😀", "it's"}},
+		{"nested parens", `func_call::calc(max(1, min(2, 3)), 4)`, []string{"max(1, min(2, 3))", "4"}},
+		{"json", `func_call::post({"a": [1, "}"], "b": {"c": null}}, [1, 2])`, []string{`{"a": [1, "}"], "b": {"c": null}}`, `[1, 2]`}},
+		{"named", `func_call::search(query="golang", limit = 3, a==b)`, []string{"query=golang", "limit=3", "a==b"}},
+		{"trailing comma", "func_call::echo(\n  \"a\",\n  \"b\",\n)", []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := testCaller.Parse(context.Background(), c.content)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if p := got.Positional(); strings.Join(p, "|") != strings.Join(c.want, "|") || len(p) != len(c.want) {
+				t.Errorf("got %q, want %q", p, c.want)
+			}
+			if !strings.HasPrefix(got.Raw, "func_call::") || !strings.HasSuffix(got.Raw, ")") {
+				t.Errorf("unexpected raw %q", got.Raw)
+			}
+		})
+	}
+}
+
+func TestCaller_Parse_JSONFlag(t *testing.T) {
+	got, err := testCaller.Parse(context.Background(), `func_call::post(body={"a": 1}, "x")`)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if a := got.Args[0]; a.Name != "body" || !a.JSON || a.Value != `{"a": 1}` {
+		t.Errorf("unexpected arg %+v", a)
+	}
+	if a := got.Args[1]; a.JSON || a.Value != "x" || a.Raw != `"x"` {
+		t.Errorf("unexpected arg %+v", a)
+	}
+}
+
+func TestCaller_Parse_Errors(t *testing.T) {
+	cases := []struct {
+		name       string
+		content    string
+		line, col  int
+		incomplete bool
+	}{
+		{"unterminated string", `func_call::echo("abc, 1)`, 1, 17, true},
+		{"missing paren", `func_call::echo("abc"`, 1, 22, true},
+		{"missing comma", `func_call::echo("a" "b")`, 1, 21, false},
+		{"bad json", `func_call::post({"a": })`, 1, 17, false},
+		{"empty arg", `func_call::echo("a", , "b")`, 1, 22, false},
+		{"multiline", "说明\nfunc_call::echo(\"a\",\n  b\n  c)", 3, 4, false},
+		{"column by rune", `你好 func_call::echo("好", x y z`, 1, 30, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := testCaller.Parse(context.Background(), c.content)
+			pe := &call.ParseError{}
+			if !errors.As(err, &pe) {
+				t.Fatalf("expected ParseError, got %v", err)
+			}
+			if !errors.Is(err, call.ErrParseCall) {
+				t.Errorf("ParseError should wrap ErrParseCall")
+			}
+			if pe.Line != c.line || pe.Column != c.col || pe.Incomplete != c.incomplete {
+				t.Errorf("got line %d col %d incomplete %v, want %d %d %v: %v", pe.Line, pe.Column, pe.Incomplete, c.line, c.col, c.incomplete, err)
+			}
+		})
+	}
+}
+
+func TestParseError_Error(t *testing.T) {
+	_, err := testCaller.Parse(context.Background(), `func_call::echo("a" "b")`)
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("error should contain message, source line and caret, got %q", err.Error())
+	}
+	if !strings.Contains(lines[0], "第 1 行第 21 列") || lines[1] != `func_call::echo("a" "b")` || lines[2] != strings.Repeat(" ", 20)+"^" {
+		t.Errorf("unexpected error %q", err.Error())
+	}
+}
+
+func TestCaller_ParseCall_Legacy(t *testing.T) {
+	name, params, err := testCaller.ParseCall(context.Background(), `func_call::echo("a, b", c)`)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if name != "echo" || len(params) != 2 || params[0] != "a, b" || params[1] != "c" {
+		t.Errorf("got %s %q", name, params)
+	}
+	if testCaller.HasCall("func_call ::echo()") || !testCaller.HasCall(`func_call::echo("`) {
+		t.Errorf("HasCall should only check the call head")
+	}
+}
+
+func TestCaller_ParseAll(t *testing.T) {
+	content := "先查两个\nfunc_call::echo(\"func_call::fake()\")\nfunc_call::now()\nfunc_call::echo(\"x"
+	calls, err := testCaller.ParseAll(context.Background(), content)
+	if len(calls) != 2 || calls[0].Args[0].Value != "func_call::fake()" || calls[1].Name != "now" {
+		t.Errorf("calls in string args should be skipped, got %+v", calls)
+	}
+	pe := &call.ParseError{}
+	if !errors.As(err, &pe) || pe.Line != 4 || !pe.Incomplete {
+		t.Errorf("parse error of the last call expected, got %v", err)
+	}
+
+	calls, err = testCaller.ParseAll(context.Background(), "没有调用")
+	if err != nil || len(calls) != 0 {
+		t.Errorf("got %v, %v", calls, err)
+	}
+}
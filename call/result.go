@@ -11,23 +11,67 @@ import (
 )
 
 type (
+	// ParamError 参数值不符合 tool 的参数定义
+	ParamError struct {
+		Param string
+		Value string
+		Msg   string
+	}
+
+	// ApprovalDecision 审批的结果
+	ApprovalDecision string
+
+	// Approval 需要审批的调用的审批结果，会在调用结果中告知模型
+	Approval struct {
+		Decision ApprovalDecision `json:"decision"`
+		Reason   string           `json:"reason,omitempty"`
+		Approver string           `json:"approver,omitempty"`
+	}
+
 	Result struct {
 		*Caller
-		FunctionName       string   `json:"function_name,omitempty"`
-		ParamValues        []string `json:"param_values,omitempty"`
-		ExpectedParamNames []string `json:"expected_param_names,omitempty"`
-		Response           any      `json:"response,omitempty"`
-		Error              error    `json:"error,omitempty"`
+		FunctionName       string    `json:"function_name,omitempty"`
+		ParamValues        []string  `json:"param_values,omitempty"`
+		ExpectedParamNames []string  `json:"expected_param_names,omitempty"`
+		Signature          string    `json:"signature,omitempty"` // 调用的签名，如 search(query: string, limit?: integer = 10)
+		Response           any       `json:"response,omitempty"`
+		Error              error     `json:"error,omitempty"`
+		Approval           *Approval `json:"approval,omitempty"` // 不需要审批时为空
 	}
 )
 
 var (
 	ErrHasNoFunctionCall       = irr.Error("has no function call")
 	ErrToolNotFound            = irr.Error("tool not found")
+	ErrToolNotAllowed          = irr.Error("tool not allowed")
 	ErrParamsLenNotMet         = irr.Error("params length not met")
 	ErrExecFailedInvalidParams = irr.Error("invalid params")
+	ErrToolTimeout             = irr.Error("tool execution timeout")
+	ErrToolPanic               = irr.Error("tool panicked")
+	ErrToolDenied              = irr.Error("tool call denied")
 )
 
+const (
+	ApprovalApproved ApprovalDecision = "approved"
+	ApprovalDenied   ApprovalDecision = "denied"
+)
+
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("参数 %s 的值 %q %s", e.Param, e.Value, e.Msg)
+}
+
+func (e *ParamError) Unwrap() error {
+	return ErrExecFailedInvalidParams
+}
+
+// expected 期望的参数，有签名时使用签名
+func (result *Result) expected() string {
+	if result.Signature != "" {
+		return result.Signature
+	}
+	return strings.Join(result.ExpectedParamNames, ",")
+}
+
 func (result *Result) ToPrompt() string {
 	ct := result.Caller
 	if result.Error != nil {
@@ -37,8 +81,20 @@ func (result *Result) ToPrompt() string {
 		if errors.Is(result.Error, ErrToolNotFound) {
 			return fmt.Sprintf(ct.Prefix+"%s(%s) 调用错误!\n因为没有找到名字是 %s 的调用，请检查输入是否正确.", result.FunctionName, strings.Join(result.ParamValues, ","), result.FunctionName)
 		}
+		if errors.Is(result.Error, ErrToolDenied) {
+			return fmt.Sprintf(ct.Prefix+"%s(%s) 没有被执行!\n调用被拒绝%s，不要重复这个调用，换一种方式解决问题或者直接说明情况.", result.FunctionName, strings.Join(result.ParamValues, ","), result.Approval.describeReason())
+		}
+		if errors.Is(result.Error, ErrToolNotAllowed) {
+			return fmt.Sprintf(ct.Prefix+"%s(%s) 调用错误!\n%s 不在你可以使用的 functions 中，请只使用 functions 中列出的调用.", result.FunctionName, strings.Join(result.ParamValues, ","), result.FunctionName)
+		}
 		if errors.Is(result.Error, ErrParamsLenNotMet) {
-			return fmt.Sprintf(ct.Prefix+"%s(%s) 调用错误!\n调用 %s 的参数应该是 %s，请检查输入是否正确.", result.FunctionName, strings.Join(result.ParamValues, ","), result.FunctionName, strings.Join(result.ExpectedParamNames, ","))
+			return fmt.Sprintf(ct.Prefix+"%s(%s) 调用错误!\n调用 %s 的参数应该是 %s，请检查输入是否正确.", result.FunctionName, strings.Join(result.ParamValues, ","), result.FunctionName, result.expected())
+		}
+		if errors.Is(result.Error, ErrToolTimeout) {
+			return fmt.Sprintf(ct.Prefix+"%s(%s) 调用超时!\n%v，可以稍后重试，或者换一种方式解决问题.", result.FunctionName, strings.Join(result.ParamValues, ","), result.Error)
+		}
+		if pe := (*ParamError)(nil); errors.As(result.Error, &pe) {
+			return fmt.Sprintf(ct.Prefix+"%s(%s) 调用错误!\n%v，调用 %s 的参数应该是 %s，请检查输入是否正确.", result.FunctionName, strings.Join(result.ParamValues, ","), pe, result.FunctionName, result.expected())
 		}
 		return fmt.Sprintf(ct.Prefix+"%s(%s) 调用错误!\n具体错误是: %v", result.FunctionName, strings.Join(result.ParamValues, ","), result.Error)
 	}
@@ -49,5 +105,16 @@ func (result *Result) ToPrompt() string {
 		strResp = jsonex.MustMarshalToString(result.Response)
 	}
 
+	if result.Approval != nil {
+		return fmt.Sprintf(ct.Prefix+"%s(%s) 经过审批后调用成功%s!\n结果为: %s", result.FunctionName, strings.Join(result.ParamValues, ","), result.Approval.describeReason(), strResp)
+	}
 	return fmt.Sprintf(ct.Prefix+"%s(%s) 调用成功!\n结果为: %s", result.FunctionName, strings.Join(result.ParamValues, ","), strResp)
 }
+
+// describeReason 渲染审批理由，没有理由时为空
+func (a *Approval) describeReason() string {
+	if a == nil || a.Reason == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (理由: %s)", a.Reason)
+}
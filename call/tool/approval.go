@@ -0,0 +1,341 @@
+package tool
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/call"
+)
+
+type (
+	// PolicyAction 调用前的处理方式
+	PolicyAction string
+
+	// PolicyRule 审批规则，Tool 和 Params 都匹配时生效
+	PolicyRule struct {
+		// Tool tool 名，支持 path.Match 的通配符，如 * 或 file_*
+		Tool string `yaml:"tool" json:"tool"`
+
+		// Params 参数名到正则的映射，所有参数都匹配时规则才生效，为空时只看 Tool
+		Params map[string]string `yaml:"params,omitempty" json:"params,omitempty"`
+
+		Action PolicyAction `yaml:"action" json:"action"`
+
+		// Reason 规则的说明，需要审批或拒绝时告知审批人和模型
+		Reason string `yaml:"reason,omitempty" json:"reason,omitempty"`
+
+		params map[string]*regexp.Regexp
+	}
+
+	// Policy 审批策略，按顺序匹配第一条生效的规则，都不匹配时使用 Default (为空时是 auto)
+	Policy struct {
+		Rules   []*PolicyRule `yaml:"rules" json:"rules"`
+		Default PolicyAction  `yaml:"default,omitempty" json:"default,omitempty"`
+	}
+
+	// ApprovalRequest 需要审批的调用
+	ApprovalRequest struct {
+		Tool   string            `json:"tool"`
+		Params map[string]string `json:"params"`
+		Reason string            `json:"reason,omitempty"` // 规则的说明
+	}
+
+	// Approver 审批人，返回 call.Approval 的 Decision 和 Reason 会记录在调用结果中返回给模型
+	Approver interface {
+		Approve(ctx context.Context, req ApprovalRequest) (call.Approval, error)
+	}
+
+	// DenyApprover 拒绝所有需要审批的调用，用于 CI 等没有人值守的环境
+	DenyApprover struct {
+		Reason string
+	}
+
+	// StdinApprover 在终端中询问，输入 y 批准，其他内容拒绝，y 或 n 之后的内容作为理由
+	// 多个调用同时需要审批时依次询问；等待时 ctx 结束的询问不会占用之后输入的行
+	StdinApprover struct {
+		In  io.Reader
+		Out io.Writer
+
+		once    sync.Once
+		turn    chan struct{} // 同一时间只有一个询问
+		lines   chan string   // 由单独的 goroutine 从 In 中读取，读取失败后关闭
+		readErr error
+	}
+
+	// HTTPApprover 把 ApprovalRequest 以 JSON POST 到 URL，返回 {"approved": bool, "reason": string}
+	HTTPApprover struct {
+		URL    string
+		Client *http.Client
+	}
+)
+
+const (
+	PolicyAuto    PolicyAction = "auto"
+	PolicyConfirm PolicyAction = "confirm"
+	PolicyDeny    PolicyAction = "deny"
+)
+
+var ErrInvalidPolicy = irr.Error("invalid policy")
+
+// Compile 校验规则并编译参数的正则
+func (p *Policy) Compile() error {
+	if err := checkAction(p.Default); err != nil {
+		return err
+	}
+	for i, r := range p.Rules {
+		if _, err := path.Match(r.Tool, ""); err != nil || r.Tool == "" {
+			return irr.Wrap(ErrInvalidPolicy, "rule %d: invalid tool pattern %q", i, r.Tool)
+		}
+		if err := checkAction(r.Action); err != nil {
+			return irr.Wrap(err, "rule %d", i)
+		}
+		r.params = make(map[string]*regexp.Regexp, len(r.Params))
+		for name, pattern := range r.Params {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return irr.Wrap(ErrInvalidPolicy, "rule %d: invalid pattern of param %s, %v", i, name, err)
+			}
+			r.params[name] = re
+		}
+	}
+	return nil
+}
+
+func checkAction(a PolicyAction) error {
+	switch a {
+	case "", PolicyAuto, PolicyConfirm, PolicyDeny:
+		return nil
+	}
+	return irr.Wrap(ErrInvalidPolicy, "unknown action %q, should be auto, confirm or deny", a)
+}
+
+// Evaluate 返回调用的处理方式和命中的规则，没有命中时 rule 为 nil
+func (p *Policy) Evaluate(name string, params map[string]string) (action PolicyAction, rule *PolicyRule) {
+	if p == nil {
+		return PolicyAuto, nil
+	}
+	for _, r := range p.Rules {
+		if r.match(name, params) {
+			return orAuto(r.Action), r
+		}
+	}
+	return orAuto(p.Default), nil
+}
+
+func (r *PolicyRule) match(name string, params map[string]string) bool {
+	if ok, _ := path.Match(r.Tool, name); !ok {
+		return false
+	}
+	for param, pattern := range r.Params {
+		re, ok := r.params[param]
+		if !ok { // 没有经过 Compile 的规则
+			var err error
+			if re, err = regexp.Compile(pattern); err != nil {
+				return false
+			}
+		}
+		if v, ok := params[param]; !ok || !re.MatchString(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func orAuto(a PolicyAction) PolicyAction {
+	if a == "" {
+		return PolicyAuto
+	}
+	return a
+}
+
+func (d DenyApprover) Approve(context.Context, ApprovalRequest) (call.Approval, error) {
+	reason := d.Reason
+	if reason == "" {
+		reason = "当前环境不允许需要审批的调用"
+	}
+	return call.Approval{Decision: call.ApprovalDenied, Reason: reason, Approver: "deny"}, nil
+}
+
+// NewStdinApprover 使用标准输入输出询问
+func NewStdinApprover() *StdinApprover {
+	return &StdinApprover{In: os.Stdin, Out: os.Stdout}
+}
+
+// start 启动读取 In 的 goroutine，只会启动一次
+func (s *StdinApprover) start() {
+	s.once.Do(func() {
+		s.turn = make(chan struct{}, 1)
+		s.lines = make(chan string)
+		go func() {
+			reader := bufio.NewReader(s.In)
+			for {
+				line, err := reader.ReadString('\n')
+				if line != "" {
+					s.lines <- line
+				}
+				if err != nil {
+					s.readErr = err
+					close(s.lines)
+					return
+				}
+			}
+		}()
+	})
+}
+
+func (s *StdinApprover) Approve(ctx context.Context, req ApprovalRequest) (call.Approval, error) {
+	s.start()
+	select {
+	case s.turn <- struct{}{}:
+		defer func() { <-s.turn }()
+	case <-ctx.Done():
+		return call.Approval{}, ctx.Err()
+	}
+
+	names := make([]string, 0, len(req.Params))
+	for name := range req.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("\n[审批] %s", req.Tool))
+	if req.Reason != "" {
+		sb.WriteString(fmt.Sprintf(" (%s)", req.Reason))
+	}
+	sb.WriteString("\n")
+	for _, name := range names {
+		sb.WriteString(fmt.Sprintf("  %s = %s\n", name, req.Params[name]))
+	}
+	sb.WriteString("是否允许执行? [y/N] (可以在后面写上理由): ")
+	if _, err := io.WriteString(s.Out, sb.String()); err != nil {
+		return call.Approval{}, err
+	}
+
+	var line string
+	select {
+	case l, ok := <-s.lines:
+		if !ok {
+			return call.Approval{}, irr.Wrap(s.readErr, "read approval from stdin failed")
+		}
+		line = l
+	case <-ctx.Done():
+		_, _ = io.WriteString(s.Out, "\n(审批已取消)\n")
+		return call.Approval{}, ctx.Err()
+	}
+	line = strings.TrimSpace(line)
+	answer, reason, _ := strings.Cut(line, " ")
+	ret := call.Approval{Decision: call.ApprovalDenied, Reason: strings.TrimSpace(reason), Approver: "stdin"}
+	if strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes") {
+		ret.Decision = call.ApprovalApproved
+	}
+	return ret, nil
+}
+
+func (h *HTTPApprover) Approve(ctx context.Context, req ApprovalRequest) (call.Approval, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return call.Approval{}, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return call.Approval{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return call.Approval{}, irr.Wrap(err, "request approver %s failed", h.URL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return call.Approval{}, irr.Error("approver %s responded %d", h.URL, resp.StatusCode)
+	}
+
+	got := struct {
+		Approved bool   `json:"approved"`
+		Reason   string `json:"reason"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		return call.Approval{}, irr.Wrap(err, "decode approval failed")
+	}
+	ret := call.Approval{Decision: call.ApprovalDenied, Reason: got.Reason, Approver: "http"}
+	if got.Approved {
+		ret.Decision = call.ApprovalApproved
+	}
+	return ret, nil
+}
+
+// approve 按策略决定调用是否可以执行，需要审批时等待审批人，ctx 结束时视为拒绝
+// 返回 nil 表示不需要审批
+func (tm *Manager) approve(ctx context.Context, name string, params map[string]string) *call.Approval {
+	base := tm.base()
+	action, rule := base.policy.Evaluate(name, params)
+	reason := ""
+	if rule != nil {
+		reason = rule.Reason
+	}
+
+	switch action {
+	case PolicyAuto:
+		return nil
+	case PolicyDeny:
+		return &call.Approval{Decision: call.ApprovalDenied, Reason: reason, Approver: "policy"}
+	}
+	approver := base.approver
+	if approver == nil {
+		return &call.Approval{Decision: call.ApprovalDenied, Reason: "需要审批，但是没有配置审批人", Approver: "policy"}
+	}
+
+	type output struct {
+		approval call.Approval
+		err      error
+	}
+	done := make(chan output, 1)
+	go func() {
+		a, err := approver.Approve(ctx, ApprovalRequest{Tool: name, Params: params, Reason: reason})
+		done <- output{a, err}
+	}()
+	select {
+	case o := <-done:
+		if o.err != nil {
+			return &call.Approval{Decision: call.ApprovalDenied, Reason: fmt.Sprintf("审批失败: %v", o.err), Approver: o.approval.Approver}
+		}
+		return &o.approval
+	case <-ctx.Done():
+		return &call.Approval{Decision: call.ApprovalDenied, Reason: fmt.Sprintf("等待审批时请求结束: %v", ctx.Err())}
+	}
+}
+
+// SetPolicy 设置审批策略，在作用域上设置时修改的是来源 Manager 的配置
+func (tm *Manager) SetPolicy(p *Policy) error {
+	if p != nil {
+		if err := p.Compile(); err != nil {
+			return err
+		}
+	}
+	tm.base().policy = p
+	return nil
+}
+
+// WithApprover 设置审批人，策略为 confirm 的调用会等待审批人的决定，没有设置时这些调用会被拒绝
+func (tm *Manager) WithApprover(a Approver) *Manager {
+	tm.base().approver = a
+	return tm
+}
@@ -0,0 +1,203 @@
+package tool_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bagaking/botheater/call"
+	"github.com/bagaking/botheater/call/tool"
+)
+
+// blockApprover 一直等到 ctx 结束
+type blockApprover struct{}
+
+func (blockApprover) Approve(ctx context.Context, _ tool.ApprovalRequest) (call.Approval, error) {
+	<-ctx.Done()
+	return call.Approval{}, ctx.Err()
+}
+
+func testPolicy() *tool.Policy {
+	return &tool.Policy{
+		Rules: []*tool.PolicyRule{
+			{Tool: "search", Params: map[string]string{"query": `(?i)password`}, Action: tool.PolicyDeny, Reason: "不能搜索密码"},
+			{Tool: "search", Params: map[string]string{"mode": `^full$`}, Action: tool.PolicyConfirm, Reason: "全量搜索比较贵"},
+			{Tool: "sl*", Action: tool.PolicyAuto},
+		},
+		Default: tool.PolicyConfirm,
+	}
+}
+
+func TestPolicy_Evaluate(t *testing.T) {
+	p := testPolicy()
+	if err := p.Compile(); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	cases := []struct {
+		name   string
+		params map[string]string
+		want   tool.PolicyAction
+		rule   int // 命中的规则，-1 表示使用 Default
+	}{
+		{"search", map[string]string{"query": "my PASSWORD", "mode": "full"}, tool.PolicyDeny, 0},
+		{"search", map[string]string{"query": "golang", "mode": "full"}, tool.PolicyConfirm, 1},
+		{"slow", nil, tool.PolicyAuto, 2},
+		{"crash", nil, tool.PolicyConfirm, -1},
+	}
+	for _, c := range cases {
+		action, rule := p.Evaluate(c.name, c.params)
+		if action != c.want || (c.rule < 0 && rule != nil) || (c.rule >= 0 && rule != p.Rules[c.rule]) {
+			t.Errorf("%s %v: got %s %+v", c.name, c.params, action, rule)
+		}
+	}
+	if action, _ := (*tool.Policy)(nil).Evaluate("any", nil); action != tool.PolicyAuto {
+		t.Errorf("nil policy should be auto, got %s", action)
+	}
+
+	for _, bad := range []*tool.Policy{
+		{Default: "ask"},
+		{Rules: []*tool.PolicyRule{{Tool: "[", Action: tool.PolicyDeny}}},
+		{Rules: []*tool.PolicyRule{{Tool: "a", Params: map[string]string{"x": "("}, Action: tool.PolicyDeny}}},
+	} {
+		if err := tool.NewToolManager().SetPolicy(bad); !errors.Is(err, tool.ErrInvalidPolicy) {
+			t.Errorf("expected invalid policy for %+v, got %v", bad, err)
+		}
+	}
+}
+
+func TestManager_ExecuteCall_Approval(t *testing.T) {
+	st := &searchTool{}
+	tm := tool.NewToolManager()
+	tm.RegisterTool(st)
+	tm.RegisterTool(&slowTool{})
+	if err := tm.SetPolicy(testPolicy()); err != nil {
+		t.Fatalf("set policy failed: %v", err)
+	}
+
+	// 没有审批人时需要审批的调用被拒绝，auto 的调用不受影响
+	ret := execute(t, tm, `func_call::search("golang", mode=full)`)
+	if !errors.Is(ret.Error, call.ErrToolDenied) || st.got != nil || !strings.Contains(ret.ToPrompt(), "没有配置审批人") {
+		t.Errorf("confirm without approver should be denied, got %v, %s", ret.Error, ret.ToPrompt())
+	}
+	if ret = tm.Scope("slow").Execute(context.Background(), "slow", nil); ret.Error != nil || ret.Approval != nil {
+		t.Errorf("auto call should be executed without approval, got %+v", ret)
+	}
+
+	// 策略拒绝时不询问审批人
+	in := strings.NewReader("y 可以\nn 太贵了\n")
+	out := &strings.Builder{}
+	tm.WithApprover(&tool.StdinApprover{In: in, Out: out})
+	ret = execute(t, tm, `func_call::search("password")`)
+	if !errors.Is(ret.Error, call.ErrToolDenied) || ret.Approval.Approver != "policy" || out.Len() != 0 {
+		t.Errorf("deny rule should not ask the approver, got %+v", ret.Approval)
+	}
+	if !strings.Contains(ret.ToPrompt(), "调用被拒绝 (理由: 不能搜索密码)") {
+		t.Errorf("unexpected prompt %s", ret.ToPrompt())
+	}
+
+	ret = execute(t, tm, `func_call::search("golang", mode=full)`)
+	if ret.Error != nil || ret.Approval.Decision != call.ApprovalApproved || st.got["query"] != "golang" {
+		t.Errorf("approved call should be executed, got %v %+v", ret.Error, ret.Approval)
+	}
+	if !strings.Contains(out.String(), "[审批] search (全量搜索比较贵)") || !strings.Contains(out.String(), "query = golang") {
+		t.Errorf("approver should see the call, got %q", out.String())
+	}
+	if !strings.Contains(ret.ToPrompt(), "经过审批后调用成功 (理由: 可以)") {
+		t.Errorf("unexpected prompt %s", ret.ToPrompt())
+	}
+	ret = execute(t, tm, `func_call::search("rust", mode=full)`)
+	if !errors.Is(ret.Error, call.ErrToolDenied) || ret.Approval.Reason != "太贵了" || st.got["query"] != "golang" {
+		t.Errorf("denied call should not be executed, got %v %+v", ret.Error, ret.Approval)
+	}
+
+	// 等待审批时请求结束
+	tm.WithApprover(blockApprover{})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	c, _ := tool.Caller.Parse(ctx, `func_call::crash()`)
+	tm.RegisterTool(panicTool{})
+	if ret = tm.ExecuteCall(ctx, c); !errors.Is(ret.Error, call.ErrToolDenied) || !strings.Contains(ret.Approval.Reason, "请求结束") {
+		t.Errorf("call should be denied when ctx is done, got %v %+v", ret.Error, ret.Approval)
+	}
+
+	tm.WithApprover(tool.DenyApprover{})
+	if ret = execute(t, tm, `func_call::crash()`); !errors.Is(ret.Error, call.ErrToolDenied) || ret.Approval.Approver != "deny" {
+		t.Errorf("deny approver should deny, got %+v", ret.Approval)
+	}
+}
+
+func TestStdinApprover_CanceledPrompt(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	out := &strings.Builder{}
+	approver := &tool.StdinApprover{In: pr, Out: out}
+
+	// 等待输入时请求结束，不会占用之后输入的行
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := approver.Approve(ctx, tool.ApprovalRequest{Tool: "search"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("canceled prompt should return ctx error, got %v", err)
+	}
+
+	done := make(chan call.Approval, 1)
+	go func() {
+		got, err := approver.Approve(context.Background(), tool.ApprovalRequest{Tool: "search"})
+		if err != nil {
+			t.Errorf("approve failed: %v", err)
+		}
+		done <- got
+	}()
+	if _, err := io.WriteString(pw, "y ok\n"); err != nil {
+		t.Fatalf("write input failed: %v", err)
+	}
+	select {
+	case got := <-done:
+		if got.Decision != call.ApprovalApproved || got.Reason != "ok" {
+			t.Errorf("next prompt should get the next line, got %+v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("next prompt is blocked by the canceled one")
+	}
+	if !strings.Contains(out.String(), "审批已取消") {
+		t.Errorf("operator should be told the prompt is canceled, got %q", out.String())
+	}
+}
+
+func TestHTTPApprover(t *testing.T) {
+	var got tool.ApprovalRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if got.Params["query"] == "boom" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"approved": true, "reason": "ok"}`))
+	}))
+	defer srv.Close()
+
+	tm := tool.NewToolManager().WithApprover(&tool.HTTPApprover{URL: srv.URL})
+	tm.RegisterTool(&searchTool{})
+	if err := tm.SetPolicy(&tool.Policy{Default: tool.PolicyConfirm}); err != nil {
+		t.Fatalf("set policy failed: %v", err)
+	}
+
+	ret := execute(t, tm, `func_call::search("golang")`)
+	if ret.Error != nil || ret.Approval.Decision != call.ApprovalApproved || ret.Approval.Approver != "http" {
+		t.Errorf("http approver should approve, got %v %+v", ret.Error, ret.Approval)
+	}
+	if got.Tool != "search" || got.Params["limit"] != "10" {
+		t.Errorf("approver should receive the bound params, got %+v", got)
+	}
+	if ret = execute(t, tm, `func_call::search("boom")`); !errors.Is(ret.Error, call.ErrToolDenied) || !strings.Contains(ret.Approval.Reason, "审批失败") {
+		t.Errorf("failed approval should be a denial, got %v %+v", ret.Error, ret.Approval)
+	}
+}
@@ -0,0 +1,278 @@
+package tool
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/bagaking/goulp/jsonex"
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/call"
+	"github.com/bagaking/botheater/utils"
+)
+
+type (
+	// BudgetStrategy 输出超出预算时的处理方式
+	BudgetStrategy string
+
+	// Budget tool 单次输出的预算，按 utils.CountTokens 计算
+	Budget struct {
+		MaxTokens int            `yaml:"max_tokens" json:"max_tokens"`
+		Strategy  BudgetStrategy `yaml:"strategy,omitempty" json:"strategy,omitempty"` // 为空时是 truncate
+
+		// Summarizer summarize 时负责总结的 bot (prefab name)，没有设置或者总结失败时按 truncate 处理
+		Summarizer string `yaml:"summarizer,omitempty" json:"summarizer,omitempty"`
+	}
+
+	// IBudgetTool 声明默认的输出预算，Manager 上设置的预算优先
+	IBudgetTool interface {
+		Budget() *Budget
+	}
+
+	// Summarizer 总结过长的输出，name 是 Budget.Summarizer
+	Summarizer interface {
+		Summarize(ctx context.Context, name, toolName, content string, maxTokens int) (string, error)
+	}
+
+	// pageStore 保存分页输出的剩余部分，只保留最近的 maxPagedOutputs 个输出
+	pageStore struct {
+		mu    sync.Mutex
+		seq   int
+		pages map[string][]string // id -> 所有的页
+		order []string
+	}
+)
+
+const (
+	BudgetTruncate  BudgetStrategy = "truncate"
+	BudgetPage      BudgetStrategy = "page"
+	BudgetSummarize BudgetStrategy = "summarize"
+
+	// ReadMoreToolName 获取分页输出的下一页，不需要在 functions 中声明
+	ReadMoreToolName = "read_more"
+
+	// BudgetAllTools 作为 tool 名设置预算时，对没有单独设置的 tool 生效
+	BudgetAllTools = "*"
+
+	maxPagedOutputs = 32
+)
+
+// DefaultBudget 没有任何设置时使用的预算
+var DefaultBudget = Budget{MaxTokens: 8000, Strategy: BudgetTruncate}
+
+var ErrInvalidBudget = irr.Error("invalid budget")
+
+// Validate 检查预算的设置
+func (b *Budget) Validate() error {
+	if b == nil {
+		return irr.Wrap(ErrInvalidBudget, "budget is empty")
+	}
+	if b.MaxTokens <= 0 {
+		return irr.Wrap(ErrInvalidBudget, "max_tokens should be positive, got %d", b.MaxTokens)
+	}
+	switch b.Strategy {
+	case "", BudgetTruncate, BudgetPage, BudgetSummarize:
+		return nil
+	}
+	return irr.Wrap(ErrInvalidBudget, "unknown strategy %q, should be truncate, page or summarize", b.Strategy)
+}
+
+// WithBudget 设置 tool 的输出预算，name 为 BudgetAllTools 时对没有单独设置的 tool 生效
+// 作用域上设置的预算只对这个作用域生效，并且优先于来源 Manager 上的设置
+func (tm *Manager) WithBudget(name string, b *Budget) *Manager {
+	if tm.budgets == nil {
+		tm.budgets = make(map[string]*Budget)
+	}
+	tm.budgets[name] = b
+	return tm
+}
+
+// WithSummarizer 设置 summarize 策略使用的 Summarizer，在作用域上设置时修改的是来源 Manager 的配置
+func (tm *Manager) WithSummarizer(s Summarizer) *Manager {
+	tm.base().summarizer = s
+	return tm
+}
+
+// BudgetOf 返回 tool 生效的输出预算
+// 单独设置的预算优先于 BudgetAllTools：依次是作用域和来源 Manager 上对这个 tool 的设置、tool 自己声明的预算、
+// 作用域和来源 Manager 上的 BudgetAllTools，最后是 DefaultBudget
+func (tm *Manager) BudgetOf(name string) Budget {
+	levels := []*Manager{tm, tm.root}
+	for _, m := range levels {
+		if b := m.budgetOf(name); b != nil {
+			return orTruncate(*b)
+		}
+	}
+	if t, ok := tm.tools[name]; ok {
+		if bt, ok := t.(IBudgetTool); ok && bt.Budget() != nil {
+			return orTruncate(*bt.Budget())
+		}
+	}
+	for _, m := range levels {
+		if b := m.budgetOf(BudgetAllTools); b != nil {
+			return orTruncate(*b)
+		}
+	}
+	return DefaultBudget
+}
+
+func (tm *Manager) budgetOf(name string) *Budget {
+	if tm == nil {
+		return nil
+	}
+	return tm.budgets[name]
+}
+
+func orTruncate(b Budget) Budget {
+	if b.Strategy == "" {
+		b.Strategy = BudgetTruncate
+	}
+	return b
+}
+
+// describer 图片等片段 (如 history.Part)，由 bot 附加到对话中，不计入预算
+type describer interface{ Describe() string }
+
+var describerType = reflect.TypeOf((*describer)(nil)).Elem()
+
+// applyBudget 输出超出预算时按策略处理，片段和片段的列表不处理
+func (tm *Manager) applyBudget(ctx context.Context, name string, resp any) any {
+	if resp == nil {
+		return resp
+	}
+	if t := reflect.TypeOf(resp); t.Implements(describerType) ||
+		(t.Kind() == reflect.Slice && (t.Elem().Implements(describerType) || reflect.PointerTo(t.Elem()).Implements(describerType))) {
+		return resp
+	}
+	content, ok := resp.(string)
+	if !ok {
+		content = jsonex.MustMarshalToString(resp)
+	}
+	b := tm.BudgetOf(name)
+	total := utils.CountTokens(content)
+	if b.MaxTokens <= 0 || total <= b.MaxTokens {
+		return resp
+	}
+
+	log := wlog.ByCtx(ctx, "Manager.budget")
+	log.Infof("=== output of %s has %d tokens, over budget %d, strategy= %s", name, total, b.MaxTokens, b.Strategy)
+	switch b.Strategy {
+	case BudgetPage:
+		pages := splitTokens(content, b.MaxTokens)
+		id := tm.base().pages.put(pages)
+		return pageOf(pages, 0, id)
+	case BudgetSummarize:
+		s := tm.base().summarizer
+		if s == nil || b.Summarizer == "" {
+			log.Warnf("summarizer of %s is not set, fall back to truncate", name)
+			break
+		}
+		summary, err := s.Summarize(ctx, b.Summarizer, name, content, b.MaxTokens)
+		if err != nil {
+			log.WithError(err).Warnf("summarize output of %s failed, fall back to truncate", name)
+			break
+		}
+		head, _ := cutTokens(summary, b.MaxTokens)
+		return fmt.Sprintf("(内容过长，共 %d tokens，以下是 %s 的总结)\n%s", total, b.Summarizer, head)
+	}
+	head, _ := cutTokens(content, b.MaxTokens)
+	return fmt.Sprintf("%s\n\n...(内容过长，共 %d tokens，只保留了前 %d tokens，后面还有更多内容没有显示)", strings.TrimRight(head, "\n"), total, utils.CountTokens(head))
+}
+
+// readMore 执行 read_more(token)，返回分页输出的下一页
+func (tm *Manager) readMore(c *call.Call) call.Result {
+	ret := call.Result{
+		FunctionName:       c.Name,
+		ParamValues:        c.RawArgs(),
+		Caller:             Caller,
+		ExpectedParamNames: []string{"token"},
+		Signature:          ReadMoreToolName + "(token: string)",
+	}
+	params, err := BindArgs(ret.ExpectedParamNames, c.Args)
+	if err != nil {
+		ret.Error = err
+		return ret
+	}
+	id, page, ok := parsePageToken(params["token"])
+	pages := tm.base().pages.get(id)
+	if !ok || page >= len(pages) {
+		ret.Error = irr.Wrap(call.ErrExecFailedInvalidParams, "token %s 不存在或者已经过期", params["token"])
+		return ret
+	}
+	ret.Response = pageOf(pages, page, id)
+	return ret
+}
+
+func pageOf(pages []string, i int, id string) string {
+	page := strings.TrimRight(pages[i], "\n")
+	if i == len(pages)-1 {
+		return fmt.Sprintf("%s\n\n(第 %d/%d 页，已经是最后一页)", page, i+1, len(pages))
+	}
+	return fmt.Sprintf("%s\n\n...(内容过长，这是第 %d/%d 页，需要后面的内容时使用 %s%s(%q) 获取下一页)",
+		page, i+1, len(pages), Caller.Prefix, ReadMoreToolName, fmt.Sprintf("%s.%d", id, i+2))
+}
+
+// parsePageToken token 的格式是 id.页码，页码从 1 开始，每一页的 token 都不同，避免被当作重复调用
+func parsePageToken(token string) (id string, page int, ok bool) {
+	id, p, found := strings.Cut(strings.TrimSpace(token), ".")
+	if !found {
+		return "", 0, false
+	}
+	if _, err := fmt.Sscanf(p, "%d", &page); err != nil || page < 1 {
+		return "", 0, false
+	}
+	return id, page - 1, true
+}
+
+func (s *pageStore) put(pages []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pages == nil {
+		s.pages = make(map[string][]string)
+	}
+	s.seq++
+	id := fmt.Sprintf("out%d", s.seq)
+	s.pages[id] = pages
+	s.order = append(s.order, id)
+	if len(s.order) > maxPagedOutputs {
+		delete(s.pages, s.order[0])
+		s.order = s.order[1:]
+	}
+	return id
+}
+
+func (s *pageStore) get(id string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pages[id]
+}
+
+// cutTokens 取出不超过 max tokens 的开头部分，尽量在换行处截断
+func cutTokens(s string, max int) (head, rest string) {
+	if utils.CountTokens(s) <= max {
+		return s, ""
+	}
+	runes := []rune(s)
+	cut := max
+	if i := strings.LastIndex(string(runes[:max]), "\n"); i >= 0 {
+		if n := len([]rune(s[:i])); n >= max/2 { // 换行太靠前时直接截断
+			cut = n + 1
+		}
+	}
+	return string(runes[:cut]), string(runes[cut:])
+}
+
+// splitTokens 把 s 切分成每段不超过 max tokens 的多页
+func splitTokens(s string, max int) []string {
+	pages := make([]string, 0, utils.CountTokens(s)/max+1)
+	for s != "" {
+		var head string
+		head, s = cutTokens(s, max)
+		pages = append(pages, head)
+	}
+	return pages
+}
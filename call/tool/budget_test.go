@@ -0,0 +1,181 @@
+package tool_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/bagaking/botheater/call"
+	"github.com/bagaking/botheater/call/tool"
+)
+
+// bigTool 返回很长的内容，可以声明自己的预算
+type bigTool struct {
+	content string
+	budget  *tool.Budget
+}
+
+func (b *bigTool) Execute(map[string]string) (any, error) { return b.content, nil }
+func (b *bigTool) Name() string                           { return "big" }
+func (b *bigTool) Usage() string                          { return "很长" }
+func (b *bigTool) Examples() []string                     { return nil }
+func (b *bigTool) ParamNames() []string                   { return nil }
+func (b *bigTool) Budget() *tool.Budget                   { return b.budget }
+
+// fakeSummarizer 记录收到的请求，返回固定的总结
+type fakeSummarizer struct {
+	name, toolName string
+	err            error
+}
+
+func (f *fakeSummarizer) Summarize(_ context.Context, name, toolName, content string, maxTokens int) (string, error) {
+	f.name, f.toolName = name, toolName
+	if f.err != nil {
+		return "", f.err
+	}
+	return fmt.Sprintf("共 %d 行", strings.Count(content, "\n")), nil
+}
+
+func lines(n int) string {
+	sb := strings.Builder{}
+	for i := 0; i < n; i++ {
+		sb.WriteString(fmt.Sprintf("line %03d\n", i))
+	}
+	return sb.String()
+}
+
+func TestManager_ExecuteCall_BudgetTruncate(t *testing.T) {
+	bt := &bigTool{content: lines(100)}
+	tm := tool.NewToolManager()
+	tm.RegisterTool(bt)
+
+	// 没有超出默认预算时原样返回
+	if ret := tm.Execute(context.Background(), "big", nil); ret.Response != bt.content {
+		t.Errorf("output within budget should not be changed, got %v", ret.Response)
+	}
+
+	tm.WithBudget("big", &tool.Budget{MaxTokens: 95})
+	ret := tm.Execute(context.Background(), "big", nil)
+	got, _ := ret.Response.(string)
+	if !strings.HasPrefix(got, "line 000\n") || !strings.Contains(got, "line 009\n\n...(内容过长，共 900 tokens，只保留了前 90 tokens") || strings.Contains(got, "line 010") {
+		t.Errorf("output should be truncated at a line boundary, got %q", got)
+	}
+}
+
+func TestManager_ExecuteCall_BudgetPage(t *testing.T) {
+	bt := &bigTool{content: lines(100)}
+	tm := tool.NewToolManager()
+	tm.RegisterTool(bt)
+	tm.RegisterTool(&slowTool{})
+	scope := tm.Scope("big").WithBudget(tool.BudgetAllTools, &tool.Budget{MaxTokens: 200, Strategy: tool.BudgetPage})
+
+	tokenRe := regexp.MustCompile(`func_call::read_more\("([^"]+)"\)`)
+	ret := scope.Execute(context.Background(), "big", nil)
+	var sb strings.Builder
+	seen := map[string]bool{}
+	for i := 0; ; i++ {
+		if ret.Error != nil || i > 10 {
+			t.Fatalf("paging failed at page %d: %v", i+1, ret.Error)
+		}
+		page := ret.Response.(string)
+		body, tail, _ := strings.Cut(page, "\n\n")
+		sb.WriteString(body + "\n")
+		if strings.Contains(tail, "已经是最后一页") {
+			if !strings.Contains(tail, "第 5/5 页") {
+				t.Errorf("unexpected last page %q", tail)
+			}
+			break
+		}
+		m := tokenRe.FindStringSubmatch(tail)
+		if m == nil || seen[m[1]] {
+			t.Fatalf("page %d should point to a new token, got %q", i+1, tail)
+		}
+		seen[m[1]] = true
+		ret = execute(t, scope, fmt.Sprintf(`func_call::read_more(%q)`, m[1]))
+	}
+	if sb.String() != bt.content {
+		t.Errorf("pages should add up to the whole output, got %q", sb.String())
+	}
+
+	// 作用域上的预算不影响来源 Manager
+	if ret = tm.Execute(context.Background(), "big", nil); ret.Response != bt.content {
+		t.Errorf("budget of the scope should not leak, got %v", ret.Response)
+	}
+	for _, token := range []string{"out1", "out1.9", "missing.2"} {
+		if ret = execute(t, scope, fmt.Sprintf(`func_call::read_more(%q)`, token)); !errors.Is(ret.Error, call.ErrExecFailedInvalidParams) {
+			t.Errorf("token %s should be invalid, got %v", token, ret.Error)
+		}
+	}
+}
+
+func TestManager_ExecuteCall_BudgetSummarize(t *testing.T) {
+	bt := &bigTool{content: lines(100), budget: &tool.Budget{MaxTokens: 50, Strategy: tool.BudgetSummarize, Summarizer: "summarizer"}}
+	tm := tool.NewToolManager()
+	tm.RegisterTool(bt)
+
+	// 没有 Summarizer 时截断
+	ret := tm.Execute(context.Background(), "big", nil)
+	if got := ret.Response.(string); !strings.Contains(got, "只保留了前 45 tokens") {
+		t.Errorf("should fall back to truncate, got %q", got)
+	}
+
+	fs := &fakeSummarizer{}
+	tm.WithSummarizer(fs)
+	ret = tm.Scope("big").Execute(context.Background(), "big", nil)
+	if got := ret.Response.(string); got != "(内容过长，共 900 tokens，以下是 summarizer 的总结)\n共 100 行" || fs.name != "summarizer" || fs.toolName != "big" {
+		t.Errorf("output should be summarized, got %q, %+v", got, fs)
+	}
+
+	fs.err = errors.New("boom")
+	if ret = tm.Execute(context.Background(), "big", nil); !strings.Contains(ret.Response.(string), "只保留了前") {
+		t.Errorf("should fall back to truncate when summarize failed, got %v", ret.Response)
+	}
+}
+
+func TestBudget_Config(t *testing.T) {
+	budgets := map[string]*tool.Budget{}
+	err := yaml.Unmarshal([]byte(`
+browser: {max_tokens: 2000, strategy: summarize, summarizer: botheater_summarizer}
+"*": {max_tokens: 4000, strategy: page}
+`), &budgets)
+	if err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if b := budgets["browser"]; b.MaxTokens != 2000 || b.Strategy != tool.BudgetSummarize || b.Summarizer != "botheater_summarizer" {
+		t.Errorf("unexpected budget %+v", b)
+	}
+
+	tm := tool.NewToolManager()
+	tm.RegisterTool(&bigTool{budget: &tool.Budget{MaxTokens: 10}})
+	if got := tm.BudgetOf("big"); got.MaxTokens != 10 {
+		t.Errorf("budget declared by the tool should be used, got %+v", got)
+	}
+	if got := tm.BudgetOf("slow"); got != tool.DefaultBudget {
+		t.Errorf("default budget should be used, got %+v", got)
+	}
+	scope := tm.Scope("big", "slow").WithBudget(tool.BudgetAllTools, budgets["*"])
+	if got := scope.BudgetOf("big"); got.MaxTokens != 10 {
+		t.Errorf("budget declared by the tool should override the wildcard, got %+v", got)
+	}
+	if got := scope.BudgetOf("slow"); got.MaxTokens != 4000 {
+		t.Errorf("wildcard of the scope should override the default, got %+v", got)
+	}
+	tm.WithBudget("big", &tool.Budget{MaxTokens: 20})
+	if got := scope.BudgetOf("big"); got.MaxTokens != 20 {
+		t.Errorf("budget set for the tool on the root should override the wildcard of the scope, got %+v", got)
+	}
+	if got := scope.WithBudget("big", &tool.Budget{MaxTokens: 30}).BudgetOf("big"); got.MaxTokens != 30 {
+		t.Errorf("budget set for the tool on the scope should be used first, got %+v", got)
+	}
+
+	for _, bad := range []*tool.Budget{nil, {}, {MaxTokens: 10, Strategy: "drop"}} {
+		if err = bad.Validate(); !errors.Is(err, tool.ErrInvalidBudget) {
+			t.Errorf("expected invalid budget for %+v, got %v", bad, err)
+		}
+	}
+}
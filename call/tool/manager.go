@@ -3,9 +3,13 @@ package tool
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"regexp"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/khicago/irr"
 
@@ -15,28 +19,43 @@ import (
 	"github.com/bagaking/botheater/call"
 )
 
-var Caller = &call.Caller{
-	Prefix: CallPrefix,
-	Regex:  regexp.MustCompile(`func_call::(\w+)\((.*?)\)`),
-}
+var Caller = call.NewCaller(CallPrefix)
 
 const (
 	CallPrefix = "func_call::"
 
+	// DefaultToolTimeout tool 单次执行的默认超时时间
+	DefaultToolTimeout = 60 * time.Second
+
 	FuncPromptStart = `# 现在支持了以下 functions (example 中省略了 func_call:: 前缀)
 `
 	FuncPromptTail = `
 ## Constrains - Functions
 - 当且仅当要使用 function 时，回复 func_call::name(params)
 - 要调用 function 时，你只说两句话，第一句是判断依据，第二句是就是 func_call::search(\"用户的问题\")  调用，然后就不任何内容
+- 需要多个 function 的结果时，可以在一次回复中进行多个调用，每个调用单独一行
+- 参数中有逗号、括号或换行时用双引号包裹 (转义规则同 JSON)，也可以用 name="value" 的形式指定参数名
 - 如果不需要调用 function, 你的回复一定不要包含这种格式
 - 不允许输出空内容，不知道能做什么时说明即可
 `
 )
 
 type (
+	// Manager 管理 tool 的注册和执行
+	// 通过 Scope 创建的 Manager 与创建它的 Manager 共享 tool 和配置，但只能获取和执行允许的 tool
 	Manager struct {
-		tools map[string]ITool
+		tools          map[string]ITool
+		defaultTimeout time.Duration
+
+		policy   *Policy
+		approver Approver
+
+		budgets    map[string]*Budget // tool 名到输出预算，作用域上的设置只对这个作用域生效
+		summarizer Summarizer
+		pages      pageStore
+
+		root    *Manager            // 作用域的来源，不是作用域时为 nil
+		allowed map[string]struct{} // 作用域允许的 tool，不是作用域时不限制
 	}
 )
 
@@ -47,67 +66,252 @@ func (tm *Manager) ToPrompt(functions []string) (string, error) {
 		if !ok {
 			return "", irr.Error("Error: function %s not found", fnName)
 		}
+		if st, ok := t.(ISchemaTool); ok {
+			info += fmt.Sprintf("%d. %s ; usage: %s ;\n%s  example: %v;\n", i+1, Signature(t.Name(), st.ParamSchemas()), t.Usage(), paramsPrompt(st.ParamSchemas()), t.Examples())
+			continue
+		}
 		info += fmt.Sprintf("%d. %s ; usage: %s ;\n  example: %v;\n", i+1, t.Name(), t.Usage(), t.Examples())
 	}
 	return info + FuncPromptTail, nil
 }
 
+// paramsPrompt 列出参数的说明，没有说明时为空
+func paramsPrompt(schemas []ParamSchema) string {
+	lines := ""
+	for _, p := range schemas {
+		if p.Description != "" {
+			lines += fmt.Sprintf("  - %s: %s\n", p.Name, p.Description)
+		}
+	}
+	if lines == "" {
+		return ""
+	}
+	return "  params:\n" + lines
+}
+
 func NewToolManager() *Manager {
 	return &Manager{
-		tools: make(map[string]ITool),
+		tools:          make(map[string]ITool),
+		defaultTimeout: DefaultToolTimeout,
 	}
 }
 
+// GetTool 获取 tool，不在作用域内的 tool 也返回 false
 func (tm *Manager) GetTool(name string) (ITool, bool) {
+	if !tm.Allows(name) {
+		return nil, false
+	}
 	t, ok := tm.tools[name]
 	return t, ok
 }
 
+// Count 可以使用的 tool 数量
 func (tm *Manager) Count() int {
-	return len(tm.tools)
+	return len(tm.Allowed())
+}
+
+// Scope 创建只允许使用 names 中的 tool 的作用域，在作用域上再次调用时取交集
+// 作用域与原来的 Manager 共享 tool 和配置，之后注册的 tool 在名字允许时同样可以使用
+func (tm *Manager) Scope(names ...string) *Manager {
+	allowed := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if tm.root == nil || tm.Allows(name) {
+			allowed[name] = struct{}{}
+		}
+	}
+	return &Manager{
+		tools:   tm.tools,
+		root:    tm.base(),
+		allowed: allowed,
+	}
+}
+
+// Scoped 是否是通过 Scope 创建的作用域
+func (tm *Manager) Scoped() bool {
+	return tm.root != nil
+}
+
+// Allows 作用域是否允许使用名字为 name 的 tool，不是作用域时总是返回 true
+func (tm *Manager) Allows(name string) bool {
+	if tm.root == nil {
+		return true
+	}
+	_, ok := tm.allowed[name]
+	return ok
+}
+
+// Allowed 返回已经注册并且可以使用的 tool 名字，按名字排序
+func (tm *Manager) Allowed() []string {
+	ret := make([]string, 0, len(tm.tools))
+	for name := range tm.tools {
+		if tm.Allows(name) {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// base 返回作用域的来源，不是作用域时返回自己
+func (tm *Manager) base() *Manager {
+	if tm.root != nil {
+		return tm.root
+	}
+	return tm
 }
 
 func (tm *Manager) RegisterTool(t ITool) {
 	tm.tools[t.Name()] = t
 }
 
+// Execute 按位置参数执行，参数值以 " 开头时按 JSON 字符串解码
 func (tm *Manager) Execute(ctx context.Context, name string, paramValues []string) call.Result {
+	args := make([]call.Arg, len(paramValues))
+	for i, v := range paramValues {
+		val := strings.TrimSpace(v)
+		args[i] = call.Arg{Value: val, Raw: val}
+		if strs.StartsWith(val, "\"") {
+			if err := json.Unmarshal([]byte(val), &val); err == nil {
+				args[i].Value = val
+			}
+		}
+	}
+	ret := tm.ExecuteCall(ctx, &call.Call{Name: name, Args: args})
+	ret.ParamValues = paramValues
+	return ret
+}
+
+// ExecuteCall 执行解析出的调用，位置参数按 ParamNames 的顺序对应，具名参数按名字对应
+// tool 实现了 ISchemaTool 时按参数定义校验和转换参数，输出超出预算时按 BudgetOf 的策略处理
+func (tm *Manager) ExecuteCall(ctx context.Context, c *call.Call) call.Result {
 	log := wlog.ByCtx(ctx, "Manager.Execute")
 	ret := call.Result{
-		FunctionName: name,
-		ParamValues:  paramValues,
+		FunctionName: c.Name,
+		ParamValues:  c.RawArgs(),
 		Caller:       Caller,
 	}
 
-	log.Debugf("=== try %s with params %v", name, paramValues)
-	tool, exists := tm.GetTool(name)
+	log.Debugf("=== try %s with params %v", c.Name, ret.ParamValues)
+	_, registered := tm.tools[c.Name]
+	if !registered && c.Name == ReadMoreToolName { // 分页输出的下一页，不受作用域限制
+		return tm.readMore(c)
+	}
+	if registered && !tm.Allows(c.Name) {
+		ret.Error = irr.Wrap(call.ErrToolNotAllowed, "%s is not in %v", c.Name, tm.Allowed())
+		return ret
+	}
+	tool, exists := tm.GetTool(c.Name)
 	if !exists {
 		ret.Error = call.ErrToolNotFound
 		return ret
 	}
 
-	paramNames := tool.ParamNames()
-	ret.ExpectedParamNames = paramNames
-	if len(paramNames) != len(paramValues) {
-		ret.Error = call.ErrParamsLenNotMet
+	schemas := Schemas(tool)
+	ret.ExpectedParamNames = tool.ParamNames()
+	ret.Signature = Signature(c.Name, schemas)
+	params, err := BindSchemas(schemas, c.Args)
+	if err != nil {
+		ret.Error = err
 		return ret
 	}
 
-	params := make(map[string]string)
-	for i, paramName := range paramNames {
-		val := strings.TrimSpace(paramValues[i])
-		params[paramName] = val
-		if strs.StartsWith(val, "\"") {
-			err := json.Unmarshal([]byte(val), &val)
-			if err != nil {
-				continue
-			}
-			params[paramName] = val
+	if ret.Approval = tm.approve(ctx, c.Name, params); ret.Approval != nil {
+		log.Infof("=== %s %s by %s, reason= %s", c.Name, ret.Approval.Decision, ret.Approval.Approver, ret.Approval.Reason)
+		if ret.Approval.Decision != call.ApprovalApproved {
+			ret.Error = call.ErrToolDenied
+			return ret
 		}
 	}
 
-	log.Debugf("=== call %s with params %v", name, params)
+	log.Debugf("=== call %s with params %v", c.Name, params)
 
-	ret.Response, ret.Error = tool.Execute(params)
+	ret.Response, ret.Error = tm.invoke(ctx, tool, params)
+	if ret.Error == nil {
+		ret.Response = tm.applyBudget(ctx, c.Name, ret.Response)
+	}
 	return ret
 }
+
+// timeoutOf 返回 tool 单次执行的超时时间，tool 没有声明时使用 Manager 的默认值
+func (tm *Manager) timeoutOf(t ITool) time.Duration {
+	if tt, ok := t.(ITimeoutTool); ok && tt.Timeout() > 0 {
+		return tt.Timeout()
+	}
+	return tm.base().defaultTimeout
+}
+
+// invoke 在单独的 goroutine 中执行 tool，超时或 ctx 被取消时立即返回，tool 的 panic 会被转换成 call.ErrToolPanic
+// 不支持 ctx 的 tool 在超时后仍会在后台执行到结束，但是不会阻塞这一轮对话
+func (tm *Manager) invoke(ctx context.Context, t ITool, params map[string]string) (any, error) {
+	timeout := tm.timeoutOf(t)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type output struct {
+		resp any
+		err  error
+	}
+	done := make(chan output, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				wlog.ByCtx(ctx, "Manager.invoke").Errorf("tool %s panicked: %v\n%s", t.Name(), r, debug.Stack())
+				done <- output{err: irr.Wrap(call.ErrToolPanic, "%s: %v", t.Name(), r)}
+			}
+		}()
+		resp, err := WithContext(t).ExecuteContext(ctx, params)
+		done <- output{resp: resp, err: err}
+	}()
+
+	var o output
+	select {
+	case o = <-done:
+		if o.err == nil || ctx.Err() == nil { // 支持 ctx 的 tool 因为超时返回错误时，按超时处理
+			return o.resp, o.err
+		}
+	case <-ctx.Done():
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, irr.Wrap(call.ErrToolTimeout, "%s did not finish in %v", t.Name(), timeout)
+	}
+	return nil, irr.Wrap(ctx.Err(), "%s is canceled", t.Name())
+}
+
+// WithDefaultTimeout 设置 tool 单次执行的默认超时时间，tool 实现了 ITimeoutTool 时以 tool 声明的为准，0 表示不限制
+// 在作用域上设置时修改的是来源 Manager 的配置
+func (tm *Manager) WithDefaultTimeout(d time.Duration) *Manager {
+	tm.base().defaultTimeout = d
+	return tm
+}
+
+// ExecuteCalls 执行一次回复中的多个调用，结果与 calls 的顺序一致
+// 实现了 IConcurrentTool 的 tool 并发执行，其余的在同一个 goroutine 中按顺序执行
+func (tm *Manager) ExecuteCalls(ctx context.Context, calls []*call.Call) []call.Result {
+	results := make([]call.Result, len(calls))
+	serial := make([]int, 0, len(calls))
+	wg := sync.WaitGroup{}
+	for i, c := range calls {
+		if t, ok := tm.GetTool(c.Name); !ok || !isConcurrent(t) {
+			serial = append(serial, i)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, c *call.Call) {
+			defer wg.Done()
+			results[i] = tm.ExecuteCall(ctx, c)
+		}(i, c)
+	}
+	for _, i := range serial {
+		results[i] = tm.ExecuteCall(ctx, calls[i])
+	}
+	wg.Wait()
+	return results
+}
+
+func isConcurrent(t ITool) bool {
+	ct, ok := t.(IConcurrentTool)
+	return ok && ct.Concurrent()
+}
@@ -0,0 +1,154 @@
+package tool_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bagaking/botheater/call"
+	"github.com/bagaking/botheater/call/tool"
+)
+
+// slowTool 不支持 ctx 的 tool，执行 delay 后返回
+type slowTool struct {
+	delay   time.Duration
+	timeout time.Duration
+}
+
+func (s *slowTool) Execute(map[string]string) (any, error) {
+	time.Sleep(s.delay)
+	return "done", nil
+}
+func (s *slowTool) Name() string           { return "slow" }
+func (s *slowTool) Usage() string          { return "慢" }
+func (s *slowTool) Examples() []string     { return nil }
+func (s *slowTool) ParamNames() []string   { return nil }
+func (s *slowTool) Timeout() time.Duration { return s.timeout }
+
+// waitTool 支持 ctx 的 tool，一直等到 ctx 结束，并记录收到的错误
+type waitTool struct {
+	canceled chan error
+}
+
+func (w *waitTool) Execute(map[string]string) (any, error) { panic("should not be called") }
+func (w *waitTool) ExecuteContext(ctx context.Context, _ map[string]string) (any, error) {
+	<-ctx.Done()
+	w.canceled <- ctx.Err()
+	return nil, ctx.Err()
+}
+func (w *waitTool) Name() string         { return "wait" }
+func (w *waitTool) Usage() string        { return "等待" }
+func (w *waitTool) Examples() []string   { return nil }
+func (w *waitTool) ParamNames() []string { return nil }
+
+// panicTool 执行时 panic
+type panicTool struct{}
+
+func (panicTool) Execute(map[string]string) (any, error) { panic("boom") }
+func (panicTool) Name() string                           { return "crash" }
+func (panicTool) Usage() string                          { return "崩溃" }
+func (panicTool) Examples() []string                     { return nil }
+func (panicTool) ParamNames() []string                   { return nil }
+
+func TestManager_ExecuteCall_Timeout(t *testing.T) {
+	tm := tool.NewToolManager()
+	tm.RegisterTool(&slowTool{delay: time.Second, timeout: 20 * time.Millisecond})
+
+	start := time.Now()
+	ret := tm.Execute(context.Background(), "slow", nil)
+	if !errors.Is(ret.Error, call.ErrToolTimeout) || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("slow tool should time out quickly, got %v after %v", ret.Error, time.Since(start))
+	}
+	if !strings.Contains(ret.ToPrompt(), "调用超时") {
+		t.Errorf("unexpected prompt %s", ret.ToPrompt())
+	}
+
+	// tool 没有声明时使用 Manager 的默认值
+	tm = tool.NewToolManager().WithDefaultTimeout(20 * time.Millisecond)
+	tm.RegisterTool(&slowTool{delay: time.Second})
+	if ret = tm.Execute(context.Background(), "slow", nil); !errors.Is(ret.Error, call.ErrToolTimeout) {
+		t.Errorf("default timeout should be used, got %v", ret.Error)
+	}
+	tm.RegisterTool(&slowTool{delay: 10 * time.Millisecond})
+	if ret = tm.Execute(context.Background(), "slow", nil); ret.Error != nil || ret.Response != "done" {
+		t.Errorf("fast enough tool should succeed, got %v %v", ret.Response, ret.Error)
+	}
+}
+
+func TestManager_ExecuteCall_ContextTool(t *testing.T) {
+	wt := &waitTool{canceled: make(chan error, 1)}
+	tm := tool.NewToolManager().WithDefaultTimeout(20 * time.Millisecond)
+	tm.RegisterTool(wt)
+
+	ret := tm.Execute(context.Background(), "wait", nil)
+	if !errors.Is(ret.Error, call.ErrToolTimeout) {
+		t.Errorf("expected timeout, got %v", ret.Error)
+	}
+	if err := <-wt.canceled; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("tool should see the deadline, got %v", err)
+	}
+
+	// 调用方取消时传递给 tool
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	tm.WithDefaultTimeout(0)
+	if ret = tm.Execute(ctx, "wait", nil); !errors.Is(ret.Error, context.Canceled) {
+		t.Errorf("expected canceled, got %v", ret.Error)
+	}
+	if err := <-wt.canceled; !errors.Is(err, context.Canceled) {
+		t.Errorf("tool should see the cancellation, got %v", err)
+	}
+}
+
+func TestManager_ExecuteCall_Panic(t *testing.T) {
+	tm := tool.NewToolManager()
+	tm.RegisterTool(panicTool{})
+
+	ret := tm.Execute(context.Background(), "crash", nil)
+	if !errors.Is(ret.Error, call.ErrToolPanic) || !strings.Contains(ret.Error.Error(), "boom") {
+		t.Fatalf("panic should be turned into an error, got %v", ret.Error)
+	}
+	if !strings.Contains(ret.ToPrompt(), "调用错误") {
+		t.Errorf("unexpected prompt %s", ret.ToPrompt())
+	}
+}
+
+func TestManager_Scope(t *testing.T) {
+	tm := tool.NewToolManager()
+	tm.RegisterTool(&slowTool{})
+	tm.RegisterTool(panicTool{})
+
+	scope := tm.Scope("slow", "missing")
+	if !scope.Scoped() || tm.Scoped() {
+		t.Errorf("only the scope should be scoped")
+	}
+	if got := strings.Join(scope.Allowed(), ","); got != "slow" || scope.Count() != 1 {
+		t.Errorf("scope should only see allowed and registered tools, got %s", got)
+	}
+	if _, ok := scope.GetTool("crash"); ok || scope.Allows("crash") {
+		t.Errorf("crash should not be visible in the scope")
+	}
+
+	ret := scope.Execute(context.Background(), "crash", nil)
+	if !errors.Is(ret.Error, call.ErrToolNotAllowed) || !strings.Contains(ret.ToPrompt(), "不在你可以使用的 functions 中") {
+		t.Errorf("tools outside the scope should not be executed, got %v", ret.Error)
+	}
+	if ret = scope.Execute(context.Background(), "missing", nil); !errors.Is(ret.Error, call.ErrToolNotFound) {
+		t.Errorf("allowed but unregistered tool should be not found, got %v", ret.Error)
+	}
+	if ret = scope.Execute(context.Background(), "slow", nil); ret.Error != nil {
+		t.Errorf("allowed tool should be executed, got %v", ret.Error)
+	}
+
+	// 作用域共享之后注册的 tool 和配置，再次限定时取交集
+	tm.RegisterTool(&waitTool{canceled: make(chan error, 1)})
+	tm.WithDefaultTimeout(10 * time.Millisecond)
+	if ret = tm.Scope("wait").Execute(context.Background(), "wait", nil); !errors.Is(ret.Error, call.ErrToolTimeout) {
+		t.Errorf("scope should share tools and timeout, got %v", ret.Error)
+	}
+	if got := scope.Scope("slow", "wait", "crash").Allowed(); len(got) != 1 || got[0] != "slow" {
+		t.Errorf("nested scope should be an intersection, got %v", got)
+	}
+}
@@ -0,0 +1,207 @@
+package tool
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/call"
+)
+
+type (
+	// ParamType 参数类型，与 JSON schema 中的类型一致
+	ParamType string
+
+	// ParamSchema 参数定义
+	ParamSchema struct {
+		Name        string    `json:"name"`
+		Type        ParamType `json:"type,omitempty"` // 为空时是 string
+		Description string    `json:"description,omitempty"`
+
+		// Required 必填参数，非必填参数没有传入时使用 Default，Default 为空时不传给 tool
+		Required bool   `json:"required,omitempty"`
+		Default  string `json:"default,omitempty"`
+
+		// Enum 可选的值，为空时不限制
+		Enum []string `json:"enum,omitempty"`
+	}
+
+	// ISchemaTool 声明了参数定义的 tool，执行前会按定义校验参数并转换成规范的格式
+	// 如 integer 的 "3" 和 3 都会转换成 3，boolean 的 "True" 会转换成 true
+	// 参数的顺序需要与 ParamNames 一致
+	ISchemaTool interface {
+		ITool
+		ParamSchemas() []ParamSchema
+	}
+)
+
+const (
+	ParamTypeString  ParamType = "string"
+	ParamTypeInteger ParamType = "integer"
+	ParamTypeNumber  ParamType = "number"
+	ParamTypeBoolean ParamType = "boolean"
+	ParamTypeObject  ParamType = "object"
+	ParamTypeArray   ParamType = "array"
+)
+
+// Schemas 返回 tool 的参数定义，没有实现 ISchemaTool 的 tool 所有参数都是必填的字符串
+func Schemas(t ITool) []ParamSchema {
+	if st, ok := t.(ISchemaTool); ok {
+		return st.ParamSchemas()
+	}
+	return stringSchemas(t.ParamNames())
+}
+
+func stringSchemas(names []string) []ParamSchema {
+	ret := make([]ParamSchema, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, ParamSchema{Name: name, Required: true})
+	}
+	return ret
+}
+
+// ParamType 返回参数类型，为空时是 string
+func (p ParamSchema) ParamType() ParamType {
+	if p.Type == "" {
+		return ParamTypeString
+	}
+	return p.Type
+}
+
+// String 渲染成 name: type 的形式，如 limit?: integer = 10、mode: string (fast|full)
+func (p ParamSchema) String() string {
+	sb := strings.Builder{}
+	sb.WriteString(p.Name)
+	if !p.Required {
+		sb.WriteString("?")
+	}
+	sb.WriteString(": " + string(p.ParamType()))
+	if len(p.Enum) > 0 {
+		sb.WriteString(" (" + strings.Join(p.Enum, "|") + ")")
+	}
+	if p.Default != "" {
+		sb.WriteString(" = " + p.Default)
+	}
+	return sb.String()
+}
+
+// Coerce 校验参数值并转换成规范的格式，失败时返回 *call.ParamError
+func (p ParamSchema) Coerce(value string) (string, error) {
+	invalid := func(format string, args ...any) error {
+		return &call.ParamError{Param: p.Name, Value: value, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	v := strings.TrimSpace(value)
+	switch p.ParamType() {
+	case ParamTypeString:
+		v = value
+	case ParamTypeInteger:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			// 3.0 这样的整数也可以接受
+			f, ferr := strconv.ParseFloat(v, 64)
+			if ferr != nil || f != float64(int64(f)) {
+				return "", invalid("应该是整数")
+			}
+			i = int64(f)
+		}
+		v = strconv.FormatInt(i, 10)
+	case ParamTypeNumber:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return "", invalid("应该是数字")
+		}
+		v = strconv.FormatFloat(f, 'f', -1, 64)
+	case ParamTypeBoolean:
+		b, err := strconv.ParseBool(strings.ToLower(v))
+		if err != nil {
+			return "", invalid("应该是 true 或 false")
+		}
+		v = strconv.FormatBool(b)
+	case ParamTypeObject, ParamTypeArray:
+		var target any = &map[string]any{}
+		if p.ParamType() == ParamTypeArray {
+			target = &[]any{}
+		}
+		if err := json.Unmarshal([]byte(v), target); err != nil {
+			return "", invalid("应该是 JSON %s", p.ParamType())
+		}
+	default:
+		return "", irr.Error("unknown param type %s of %s", p.Type, p.Name)
+	}
+
+	if len(p.Enum) > 0 && !slices.Contains(p.Enum, v) {
+		return "", invalid("只能是 %s 中的一个", strings.Join(p.Enum, ", "))
+	}
+	return v, nil
+}
+
+// Signature 渲染 tool 的签名，如 search(query: string, limit?: integer = 10)
+func Signature(name string, schemas []ParamSchema) string {
+	params := make([]string, 0, len(schemas))
+	for _, p := range schemas {
+		params = append(params, p.String())
+	}
+	return name + "(" + strings.Join(params, ", ") + ")"
+}
+
+// BindArgs 将参数绑定到参数名上，所有参数都是必填的字符串
+func BindArgs(paramNames []string, args []call.Arg) (map[string]string, error) {
+	return BindSchemas(stringSchemas(paramNames), args)
+}
+
+// BindSchemas 将参数绑定到参数定义上，位置参数依次填入还没有被具名参数占用的位置，然后按定义校验和转换
+// 数量不匹配或缺少必填参数时返回 call.ErrParamsLenNotMet，名字不存在或重复时返回 call.ErrExecFailedInvalidParams
+// 值不符合定义时返回 *call.ParamError
+func BindSchemas(schemas []ParamSchema, args []call.Arg) (map[string]string, error) {
+	names := make([]string, 0, len(schemas))
+	for _, p := range schemas {
+		names = append(names, p.Name)
+	}
+
+	raw := make(map[string]string, len(schemas))
+	positional := make([]string, 0, len(args))
+	for _, a := range args {
+		if a.Name == "" {
+			positional = append(positional, a.Value)
+			continue
+		}
+		if !slices.Contains(names, a.Name) {
+			return nil, irr.Wrap(call.ErrExecFailedInvalidParams, "unknown param %s, params should be %v", a.Name, names)
+		}
+		if _, dup := raw[a.Name]; dup {
+			return nil, irr.Wrap(call.ErrExecFailedInvalidParams, "param %s is set more than once", a.Name)
+		}
+		raw[a.Name] = a.Value
+	}
+
+	params := make(map[string]string, len(schemas))
+	for _, p := range schemas {
+		v, ok := raw[p.Name]
+		if !ok && len(positional) > 0 {
+			v, ok, positional = positional[0], true, positional[1:]
+		}
+		if !ok {
+			if p.Required {
+				return nil, irr.Wrap(call.ErrParamsLenNotMet, "param %s is missing", p.Name)
+			}
+			if p.Default == "" {
+				continue
+			}
+			v = p.Default
+		}
+		coerced, err := p.Coerce(v)
+		if err != nil {
+			return nil, err
+		}
+		params[p.Name] = coerced
+	}
+	if len(positional) > 0 {
+		return nil, irr.Wrap(call.ErrParamsLenNotMet, "got %d more params than %v", len(positional), names)
+	}
+	return params, nil
+}
@@ -0,0 +1,123 @@
+package tool_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bagaking/botheater/call"
+	"github.com/bagaking/botheater/call/tool"
+)
+
+// searchTool 声明了参数定义，记录收到的参数
+type searchTool struct {
+	got map[string]string
+}
+
+func (s *searchTool) Execute(params map[string]string) (any, error) {
+	s.got = params
+	return "ok", nil
+}
+func (s *searchTool) Name() string       { return "search" }
+func (s *searchTool) Usage() string      { return "搜索" }
+func (s *searchTool) Examples() []string { return []string{`search("golang", limit=3)`} }
+func (s *searchTool) ParamNames() []string {
+	return []string{"query", "limit", "mode", "exact", "filter"}
+}
+func (s *searchTool) ParamSchemas() []tool.ParamSchema {
+	return []tool.ParamSchema{
+		{Name: "query", Description: "搜索的内容", Required: true},
+		{Name: "limit", Type: tool.ParamTypeInteger, Default: "10"},
+		{Name: "mode", Enum: []string{"fast", "full"}, Default: "fast", Description: "搜索模式"},
+		{Name: "exact", Type: tool.ParamTypeBoolean},
+		{Name: "filter", Type: tool.ParamTypeObject},
+	}
+}
+
+func execute(t *testing.T, tm *tool.Manager, content string) call.Result {
+	t.Helper()
+	c, err := tool.Caller.Parse(context.Background(), content)
+	if err != nil {
+		t.Fatalf("parse %s failed: %v", content, err)
+	}
+	return tm.ExecuteCall(context.Background(), c)
+}
+
+func TestManager_ExecuteCall_Schema(t *testing.T) {
+	st := &searchTool{}
+	tm := tool.NewToolManager()
+	tm.RegisterTool(st)
+
+	cases := []struct {
+		content string
+		want    map[string]string
+	}{
+		{`func_call::search("go")`, map[string]string{"query": "go", "limit": "10", "mode": "fast"}},
+		{`func_call::search("go", "3.0", full, True)`, map[string]string{"query": "go", "limit": "3", "mode": "full", "exact": "true"}},
+		{`func_call::search(filter={"lang": "go"}, query="a, b", limit=5)`, map[string]string{"query": "a, b", "limit": "5", "mode": "fast", "filter": `{"lang": "go"}`}},
+	}
+	for _, c := range cases {
+		ret := execute(t, tm, c.content)
+		if ret.Error != nil {
+			t.Fatalf("%s failed: %v", c.content, ret.Error)
+		}
+		if len(st.got) != len(c.want) {
+			t.Errorf("%s: got %v, want %v", c.content, st.got, c.want)
+		}
+		for k, v := range c.want {
+			if st.got[k] != v {
+				t.Errorf("%s: param %s got %q, want %q", c.content, k, st.got[k], v)
+			}
+		}
+	}
+}
+
+func TestManager_ExecuteCall_SchemaErrors(t *testing.T) {
+	tm := tool.NewToolManager()
+	tm.RegisterTool(&searchTool{})
+
+	cases := []struct {
+		content string
+		target  error
+		prompt  []string
+	}{
+		{`func_call::search("go", limit=abc)`, call.ErrExecFailedInvalidParams, []string{`参数 limit 的值 "abc" 应该是整数`, "search(query: string, limit?: integer = 10, mode?: string (fast|full) = fast"}},
+		{`func_call::search("go", mode=slow)`, call.ErrExecFailedInvalidParams, []string{"只能是 fast, full 中的一个"}},
+		{`func_call::search("go", filter=[1])`, call.ErrExecFailedInvalidParams, []string{"应该是 JSON object"}},
+		{`func_call::search(limit=1)`, call.ErrParamsLenNotMet, []string{"参数应该是 search(query: string"}},
+		{`func_call::search("a", 1, fast, true, {}, 6)`, call.ErrParamsLenNotMet, nil},
+		{`func_call::search("a", size=1)`, call.ErrExecFailedInvalidParams, nil},
+	}
+	for _, c := range cases {
+		ret := execute(t, tm, c.content)
+		if !errors.Is(ret.Error, c.target) {
+			t.Errorf("%s: expected %v, got %v", c.content, c.target, ret.Error)
+			continue
+		}
+		prompt := ret.ToPrompt()
+		for _, p := range c.prompt {
+			if !strings.Contains(prompt, p) {
+				t.Errorf("%s: prompt should contain %q, got %s", c.content, p, prompt)
+			}
+		}
+	}
+}
+
+func TestManager_ToPrompt_Schema(t *testing.T) {
+	tm := tool.NewToolManager()
+	tm.RegisterTool(&searchTool{})
+
+	prompt, err := tm.ToPrompt([]string{"search"})
+	if err != nil {
+		t.Fatalf("to prompt failed: %v", err)
+	}
+	for _, want := range []string{
+		"1. search(query: string, limit?: integer = 10, mode?: string (fast|full) = fast, exact?: boolean, filter?: object) ; usage: 搜索 ;",
+		"  - query: 搜索的内容\n  - mode: 搜索模式\n",
+	} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("prompt should contain %q, got\n%s", want, prompt)
+		}
+	}
+}
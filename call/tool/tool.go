@@ -1,5 +1,10 @@
 package tool
 
+import (
+	"context"
+	"time"
+)
+
 type (
 	ITool interface {
 		Execute(params map[string]string) (any, error)
@@ -8,4 +13,39 @@ type (
 		Examples() []string
 		ParamNames() []string
 	}
+
+	// IContextTool 支持 ctx 的 tool，Manager 优先调用 ExecuteContext，超时或者请求被取消时 ctx 会被取消
+	// 没有实现该接口的 tool 通过 WithContext 适配
+	IContextTool interface {
+		ITool
+		ExecuteContext(ctx context.Context, params map[string]string) (any, error)
+	}
+
+	// ITimeoutTool 声明单次执行的默认超时时间，返回 0 时使用 Manager 的默认值
+	ITimeoutTool interface {
+		Timeout() time.Duration
+	}
+
+	// IConcurrentTool 一次回复中有多个调用时，Concurrent 返回 true 的 tool 会并发执行，其他 tool 按顺序依次执行
+	IConcurrentTool interface {
+		ITool
+		Concurrent() bool
+	}
+
+	// contextAdapter 把不支持 ctx 的 tool 适配成 IContextTool，ctx 只在 Manager 中用于停止等待
+	contextAdapter struct {
+		ITool
+	}
 )
+
+// WithContext 返回 tool 的 IContextTool 形式，没有实现时忽略 ctx 直接调用 Execute
+func WithContext(t ITool) IContextTool {
+	if ct, ok := t.(IContextTool); ok {
+		return ct
+	}
+	return contextAdapter{ITool: t}
+}
+
+func (a contextAdapter) ExecuteContext(_ context.Context, params map[string]string) (any, error) {
+	return a.Execute(params)
+}
@@ -0,0 +1,254 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bagaking/goulp/jsonex"
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
+)
+
+type (
+	// Driver 缓存 inner 的返回，key 由后端标识、生成参数和消息的哈希组成
+	// 存储出错时只打日志，不影响请求
+	Driver struct {
+		inner      driver.Driver
+		store      Store
+		backend    string
+		generation *driver.GenerationParams
+		ttl        time.Duration
+
+		hits   atomic.Int64
+		misses atomic.Int64
+		now    func() time.Time
+	}
+
+	// Options cache driver 的配置
+	//
+	//	driver: cache
+	//	driver_options:
+	//	  store: dir # memory | dir
+	//	  dir: ./.cache/driver
+	//	  ttl: 72h
+	//	  inner:
+	//	    driver: coze
+	//	    endpoint: ep-xxx
+	Options struct {
+		Store    string        `yaml:"store,omitempty" json:"store,omitempty"`
+		Dir      string        `yaml:"dir,omitempty" json:"dir,omitempty"`
+		Capacity int           `yaml:"capacity,omitempty" json:"capacity,omitempty"`
+		TTL      time.Duration `yaml:"ttl,omitempty" json:"ttl,omitempty"`
+		Inner    driver.Config `yaml:"inner" json:"inner"`
+	}
+
+	// Stats 命中统计
+	Stats struct {
+		Hits   int64 `json:"hits"`
+		Misses int64 `json:"misses"`
+	}
+
+	ctxKeyBypass struct{}
+)
+
+const (
+	DriverName = "cache"
+
+	StoreMemory = "memory"
+	StoreDir    = "dir"
+
+	DefaultDir = "./.cache/driver"
+)
+
+var (
+	_ driver.Driver        = new(Driver)
+	_ driver.ToolCaller    = new(Driver)
+	_ driver.ToolSupporter = new(Driver)
+)
+
+func init() {
+	driver.Register(DriverName, func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		opts := Options{}
+		if err := conf.DecodeOptions(&opts); err != nil {
+			return nil, err
+		}
+
+		var store Store
+		switch opts.Store {
+		case StoreMemory, "":
+			store = NewMemoryStore(opts.Capacity)
+		case StoreDir:
+			dir := opts.Dir
+			if dir == "" {
+				dir = DefaultDir
+			}
+			store = NewDirStore(dir)
+		default:
+			return nil, irr.Error("unknown cache store %q", opts.Store)
+		}
+
+		inner, err := driver.New(ctx, opts.Inner)
+		if err != nil {
+			return nil, irr.Wrap(err, "create inner driver failed")
+		}
+		return New(inner, store).
+			WithKey(BackendKey(opts.Inner), opts.Inner.Generation).
+			WithTTL(opts.TTL), nil
+	})
+}
+
+// New 创建缓存 driver，store 为 nil 时使用默认容量的 MemoryStore
+func New(inner driver.Driver, store Store) *Driver {
+	if store == nil {
+		store = NewMemoryStore(0)
+	}
+	return &Driver{
+		inner: inner,
+		store: store,
+		now:   time.Now,
+	}
+}
+
+// WithKey 设置参与计算 key 的后端标识和默认生成参数，应当与 inner 的配置一致
+// 通过配置创建时后端标识是 BackendKey(inner)
+func (d *Driver) WithKey(backend string, generation *driver.GenerationParams) *Driver {
+	d.backend = backend
+	d.generation = generation
+	return d
+}
+
+// BackendKey 返回区分后端的 key，包含 driver、base_url、endpoint 和 driver_options 的哈希
+// endpoint 相同但后端不同 (如 ollama 和 openai 兼容服务上的 qwen2:7b) 时不会共享缓存
+func BackendKey(conf driver.Config) string {
+	sum := sha256.Sum256([]byte(jsonex.MustMarshalToString(conf.Options)))
+	return strings.Join([]string{conf.Driver, conf.BaseURL, conf.Endpoint, hex.EncodeToString(sum[:])}, "\x00")
+}
+
+// WithTTL 设置缓存有效期，<= 0 表示不过期
+func (d *Driver) WithTTL(ttl time.Duration) *Driver {
+	d.ttl = ttl
+	return d
+}
+
+// WithBypass 本次调用不读取缓存，请求结果仍会写入缓存 (即刷新)
+func WithBypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyBypass{}, true)
+}
+
+func isBypass(ctx context.Context) bool {
+	v, _ := ctx.Value(ctxKeyBypass{}).(bool)
+	return v
+}
+
+// Stats 返回命中统计
+func (d *Driver) Stats() Stats {
+	return Stats{Hits: d.hits.Load(), Misses: d.misses.Load()}
+}
+
+// Key 计算请求的缓存 key，ctx 中注入的生成参数也会参与计算
+func (d *Driver) Key(ctx context.Context, messages []*history.Message) string {
+	params := driver.ResolveGenerationParams(ctx, d.generation)
+	return driver.HashMessages(d.backend+"\x00"+jsonex.MustMarshalToString(params), messages)
+}
+
+func (d *Driver) Chat(ctx context.Context, messages []*history.Message) (string, error) {
+	log, ctx := wlog.ByCtxAndCache(ctx, "cache.chat")
+	key := d.Key(ctx, messages)
+
+	if entry, ok := d.lookup(ctx, log, key); ok {
+		return entry.Response, nil
+	}
+
+	got, err := d.inner.Chat(ctx, messages)
+	if err != nil {
+		return "", err
+	}
+	d.save(log, key, &Entry{Response: got})
+	return got, nil
+}
+
+// StreamChat 命中时一次性输出缓存的内容
+func (d *Driver) StreamChat(ctx context.Context, messages []*history.Message, handle func(got string)) error {
+	log, ctx := wlog.ByCtxAndCache(ctx, "cache.stream")
+	key := d.Key(ctx, messages)
+
+	if entry, ok := d.lookup(ctx, log, key); ok {
+		handle(entry.Response)
+		return nil
+	}
+
+	sb := strings.Builder{}
+	if err := d.inner.StreamChat(ctx, messages, func(got string) {
+		sb.WriteString(got)
+		handle(got)
+	}); err != nil {
+		return err
+	}
+	d.save(log, key, &Entry{Response: sb.String()})
+	return nil
+}
+
+// SupportsTools inner 支持原生工具调用时返回 true
+func (d *Driver) SupportsTools() bool {
+	_, ok := driver.AsToolCaller(d.inner)
+	return ok
+}
+
+// ChatWithTools 缓存原生工具调用的返回，工具定义也参与计算 key
+func (d *Driver) ChatWithTools(ctx context.Context, messages []*history.Message, tools []driver.ToolDef) (string, []driver.ToolCall, error) {
+	log, ctx := wlog.ByCtxAndCache(ctx, "cache.tools")
+	key := d.ToolsKey(ctx, messages, tools)
+
+	if entry, ok := d.lookup(ctx, log, key); ok {
+		return entry.Response, entry.Calls, nil
+	}
+
+	content, calls, err := driver.ChatWithTools(ctx, d.inner, messages, tools)
+	if err != nil {
+		return "", nil, err
+	}
+	d.save(log, key, &Entry{Response: content, Calls: calls})
+	return content, calls, nil
+}
+
+// ToolsKey 计算原生工具调用的缓存 key，与 Key 的区别是工具定义也参与计算
+func (d *Driver) ToolsKey(ctx context.Context, messages []*history.Message, tools []driver.ToolDef) string {
+	params := driver.ResolveGenerationParams(ctx, d.generation)
+	return driver.HashMessages(d.backend+"\x00"+jsonex.MustMarshalToString(params)+"\x00tools:"+driver.HashTools(tools), messages)
+}
+
+func (d *Driver) lookup(ctx context.Context, log wlog.Log, key string) (*Entry, bool) {
+	if isBypass(ctx) {
+		d.misses.Add(1)
+		return nil, false
+	}
+	entry, ok, err := d.store.Get(key)
+	if err != nil {
+		log.WithError(err).Warnf("read cache failed, key= %s", key)
+	}
+	if !ok || err != nil {
+		d.misses.Add(1)
+		return nil, false
+	}
+	d.hits.Add(1)
+	log.Debugf("cache hit, key= %s, len= %d", key, len(entry.Response))
+	return entry, true
+}
+
+func (d *Driver) save(log wlog.Log, key string, entry *Entry) {
+	now := d.now()
+	entry.CreateAt = now
+	if d.ttl > 0 {
+		entry.ExpireAt = now.Add(d.ttl)
+	}
+	if err := d.store.Set(key, entry); err != nil {
+		log.WithError(err).Warnf("write cache failed, key= %s", key)
+	}
+}
@@ -0,0 +1,214 @@
+package cache_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/khicago/got/util/typer"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/driver/cache"
+	"github.com/bagaking/botheater/driver/mock"
+	"github.com/bagaking/botheater/history"
+)
+
+func newInner() *mock.Driver {
+	n := 0
+	return mock.New(mock.Func(func(messages history.Messages) (string, bool, error) {
+		n++
+		return messages[len(messages)-1].Content + typer.I2Str(n), true, nil
+	}))
+}
+
+func TestCache_HitMissAndKey(t *testing.T) {
+	for name, store := range map[string]cache.Store{
+		"memory": cache.NewMemoryStore(0),
+		"dir":    cache.NewDirStore(t.TempDir()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			inner := newInner()
+			d := cache.New(inner, store).WithKey("ep-1", &driver.GenerationParams{Temperature: typer.Ptr(0.7)})
+			q := []*history.Message{history.NewUserMsg("q", "")}
+
+			first, _ := d.Chat(ctx, q)
+			second, _ := d.Chat(ctx, []*history.Message{history.NewUserMsg(" q\n", "")}) // 归一化后相同
+			if first != "q1" || second != "q1" || inner.CallCount() != 1 {
+				t.Errorf("second call should hit, got %s %s, inner calls %d", first, second, inner.CallCount())
+			}
+
+			// 生成参数不同时不能命中
+			cold := driver.WithGenerationParams(ctx, &driver.GenerationParams{Temperature: typer.Ptr(0.0)})
+			if got, _ := d.Chat(cold, q); got != "q2" {
+				t.Errorf("different params should miss, got %s", got)
+			}
+
+			// bypass 不读缓存但会刷新缓存
+			if got, _ := d.Chat(cache.WithBypass(ctx), q); got != "q3" {
+				t.Errorf("bypass should miss, got %s", got)
+			}
+			if got, _ := d.Chat(ctx, q); got != "q3" {
+				t.Errorf("bypass should refresh the entry, got %s", got)
+			}
+
+			var streamed string
+			if err := d.StreamChat(ctx, q, func(got string) { streamed += got }); err != nil || streamed != "q3" {
+				t.Errorf("stream should hit the same entry, got %s, err %v", streamed, err)
+			}
+
+			if stats := d.Stats(); stats.Hits != 3 || stats.Misses != 3 {
+				t.Errorf("unexpected stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestCache_BackendKey(t *testing.T) {
+	ollama := driver.Config{Driver: "ollama", Endpoint: "qwen2:7b"}
+	confs := []driver.Config{
+		ollama,
+		{Driver: "openai", Endpoint: "qwen2:7b"},
+		{Driver: "ollama", Endpoint: "qwen2:7b", BaseURL: "http://gpu:11434"},
+		{Driver: "ollama", Endpoint: "qwen2:7b", Options: map[string]any{"api_key_env": "OTHER_KEY"}},
+	}
+	if cache.BackendKey(ollama) != cache.BackendKey(driver.Config{Driver: "ollama", Endpoint: "qwen2:7b"}) {
+		t.Errorf("same backend should have the same key")
+	}
+
+	store := cache.NewMemoryStore(0)
+	q := []*history.Message{history.NewUserMsg("q", "")}
+	for i, conf := range confs {
+		d := cache.New(newInner(), store).WithKey(cache.BackendKey(conf), nil)
+		if _, err := d.Chat(context.Background(), q); err != nil {
+			t.Fatalf("chat failed: %v", err)
+		}
+		if d.Stats().Hits != 0 {
+			t.Errorf("backend %d should not share cache with the others: %+v", i, conf)
+		}
+	}
+}
+
+func TestCache_TTL(t *testing.T) {
+	inner := newInner()
+	d := cache.New(inner, cache.NewDirStore(t.TempDir())).WithTTL(time.Nanosecond)
+	q := []*history.Message{history.NewUserMsg("q", "")}
+
+	_, _ = d.Chat(context.Background(), q)
+	time.Sleep(time.Millisecond)
+	if got, _ := d.Chat(context.Background(), q); got != "q2" {
+		t.Errorf("expired entry should not hit, got %s", got)
+	}
+}
+
+func TestMemoryStore_LRU(t *testing.T) {
+	s := cache.NewMemoryStore(2)
+	_ = s.Set("a", &cache.Entry{Response: "a"})
+	_ = s.Set("b", &cache.Entry{Response: "b"})
+	_, _, _ = s.Get("a") // a 变为最近使用
+	_ = s.Set("c", &cache.Entry{Response: "c"})
+
+	if _, ok, _ := s.Get("b"); ok {
+		t.Errorf("b should be evicted")
+	}
+	if _, ok, _ := s.Get("a"); !ok {
+		t.Errorf("a should be kept")
+	}
+	if s.Len() != 2 {
+		t.Errorf("unexpected len %d", s.Len())
+	}
+}
+
+func TestDirStore_ConcurrentSet(t *testing.T) {
+	dir := t.TempDir()
+	s := cache.NewDirStore(dir)
+	written := make(map[string]bool)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		// 长度不同的内容，写到同一个临时文件时会留下混在一起的 json
+		response := strings.Repeat(typer.I2Str(i), 1000*(i+1))
+		written[response] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Set("same-key", &cache.Entry{Response: response}); err != nil {
+				t.Errorf("set failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entry, ok, err := s.Get("same-key")
+	if err != nil || !ok {
+		t.Fatalf("entry should be readable, got %v %v", ok, err)
+	}
+	if !written[entry.Response] {
+		t.Errorf("entry should be one of the written values, got len %d", len(entry.Response))
+	}
+	tmps, _ := filepath.Glob(filepath.Join(dir, "*", "*.tmp"))
+	if len(tmps) != 0 {
+		t.Errorf("temp files should not be left behind, got %v", tmps)
+	}
+}
+
+func TestCache_Config(t *testing.T) {
+	driver.Register("cache_test_inner", func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		return newInner(), nil
+	})
+	d, err := driver.New(context.Background(), driver.Config{
+		Driver: cache.DriverName,
+		Options: map[string]any{
+			"store": "dir",
+			"dir":   t.TempDir(),
+			"ttl":   "1h",
+			"inner": map[string]any{"driver": "cache_test_inner", "endpoint": "ep-1"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("create cache driver failed: %v", err)
+	}
+	q := []*history.Message{history.NewUserMsg("q", "")}
+	a, _ := d.Chat(context.Background(), q)
+	b, _ := d.Chat(context.Background(), q)
+	if a != b || d.(*cache.Driver).Stats().Hits != 1 {
+		t.Errorf("expected hit, got %s %s", a, b)
+	}
+
+	if _, err = driver.New(context.Background(), driver.Config{Driver: cache.DriverName, Options: map[string]any{"store": "redis"}}); err == nil {
+		t.Errorf("expected error for unknown store")
+	}
+}
+
+func TestCache_ChatWithTools(t *testing.T) {
+	inner := mock.NewToolDriver(func(messages history.Messages, tools []driver.ToolDef) (string, []driver.ToolCall, error) {
+		return "我来查一下", []driver.ToolCall{{Name: tools[0].Name, Arguments: map[string]any{"text": messages[0].Content}}}, nil
+	})
+	d := cache.New(inner, nil)
+	tc, ok := driver.AsToolCaller(d)
+	if !ok {
+		t.Fatalf("cache should support tools when the inner driver does")
+	}
+
+	q := []*history.Message{history.NewUserMsg("hi", "")}
+	tools := []driver.ToolDef{{Name: "echo"}}
+	for i := 0; i < 2; i++ {
+		content, calls, err := tc.ChatWithTools(context.Background(), q, tools)
+		if err != nil || content != "我来查一下" || len(calls) != 1 || calls[0].Name != "echo" || calls[0].Arguments["text"] != "hi" {
+			t.Fatalf("call %d: got %q %+v %v", i, content, calls, err)
+		}
+	}
+	if inner.ToolCallCount() != 1 || d.Stats().Hits != 1 {
+		t.Errorf("tool calls should be cached, inner calls= %d, stats= %+v", inner.ToolCallCount(), d.Stats())
+	}
+	// 工具定义不同时不命中，也不与 Chat 的缓存混用
+	if _, _, err := tc.ChatWithTools(context.Background(), q, []driver.ToolDef{{Name: "search"}}); err != nil || inner.ToolCallCount() != 2 {
+		t.Errorf("different tools should miss, inner calls= %d, err= %v", inner.ToolCallCount(), err)
+	}
+
+	if _, ok = driver.AsToolCaller(cache.New(newInner(), nil)); ok {
+		t.Errorf("cache should not support tools when the inner driver does not")
+	}
+}
@@ -0,0 +1,182 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/driver"
+)
+
+type (
+	// Store 缓存的存储，Get 时过期的条目视为不存在
+	Store interface {
+		Get(key string) (*Entry, bool, error)
+		Set(key string, entry *Entry) error
+	}
+
+	// Entry 缓存的一次返回
+	Entry struct {
+		Response string            `json:"response"`
+		Calls    []driver.ToolCall `json:"calls,omitempty"` // 原生工具调用返回的结构化调用
+		CreateAt time.Time         `json:"create_at"`
+		ExpireAt time.Time         `json:"expire_at,omitempty"` // 为空表示不过期
+	}
+
+	// MemoryStore 进程内的 LRU 存储
+	MemoryStore struct {
+		mu       sync.Mutex
+		capacity int
+		ll       *list.List
+		items    map[string]*list.Element
+		now      func() time.Time
+	}
+
+	memoryItem struct {
+		key   string
+		entry *Entry
+	}
+
+	// DirStore 目录存储，每个条目一个 json 文件，适合跨进程复用
+	DirStore struct {
+		dir string
+		now func() time.Time
+	}
+)
+
+const DefaultMemoryCapacity = 1024
+
+var (
+	_ Store = new(MemoryStore)
+	_ Store = new(DirStore)
+)
+
+func (e *Entry) expired(now time.Time) bool {
+	return !e.ExpireAt.IsZero() && !now.Before(e.ExpireAt)
+}
+
+// NewMemoryStore 创建 LRU 存储，capacity <= 0 时使用 DefaultMemoryCapacity
+func NewMemoryStore(capacity int) *MemoryStore {
+	if capacity <= 0 {
+		capacity = DefaultMemoryCapacity
+	}
+	return &MemoryStore{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		now:      time.Now,
+	}
+}
+
+func (s *MemoryStore) Get(key string) (*Entry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	item := el.Value.(*memoryItem)
+	if item.entry.expired(s.now()) {
+		s.ll.Remove(el)
+		delete(s.items, key)
+		return nil, false, nil
+	}
+	s.ll.MoveToFront(el)
+	return item.entry, true, nil
+}
+
+func (s *MemoryStore) Set(key string, entry *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		el.Value.(*memoryItem).entry = entry
+		s.ll.MoveToFront(el)
+		return nil
+	}
+	s.items[key] = s.ll.PushFront(&memoryItem{key: key, entry: entry})
+	for s.ll.Len() > s.capacity {
+		oldest := s.ll.Back()
+		s.ll.Remove(oldest)
+		delete(s.items, oldest.Value.(*memoryItem).key)
+	}
+	return nil
+}
+
+// Len 当前的条目数
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ll.Len()
+}
+
+// NewDirStore 创建目录存储，目录不存在时会在写入时创建
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{
+		dir: dir,
+		now: time.Now,
+	}
+}
+
+// path 按 key 的前两位分桶，避免单个目录下文件过多
+func (s *DirStore) path(key string) string {
+	bucket := key
+	if len(bucket) > 2 {
+		bucket = bucket[:2]
+	}
+	return filepath.Join(s.dir, bucket, key+".json")
+}
+
+func (s *DirStore) Get(key string) (*Entry, bool, error) {
+	p := s.path(key)
+	raw, err := os.ReadFile(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, false, nil
+		}
+		return nil, false, irr.Wrap(err, "read cache entry failed")
+	}
+	entry := &Entry{}
+	if err = json.Unmarshal(raw, entry); err != nil {
+		return nil, false, irr.Wrap(err, "decode cache entry %s failed", p)
+	}
+	if entry.expired(s.now()) {
+		_ = os.Remove(p)
+		return nil, false, nil
+	}
+	return entry, true, nil
+}
+
+func (s *DirStore) Set(key string, entry *Entry) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return irr.Wrap(err, "create cache dir failed")
+	}
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return irr.Wrap(err, "encode cache entry failed")
+	}
+	// 每次写入使用不同的临时文件再 rename，并发写同一个 key 时不会发布写了一半或者混在一起的条目
+	tmp, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return irr.Wrap(err, "create temp cache entry failed")
+	}
+	defer os.Remove(tmp.Name()) // rename 成功后是空操作
+	if _, err = tmp.Write(raw); err != nil {
+		_ = tmp.Close()
+		return irr.Wrap(err, "write cache entry failed")
+	}
+	if err = tmp.Chmod(0o644); err != nil {
+		_ = tmp.Close()
+		return irr.Wrap(err, "write cache entry failed")
+	}
+	if err = tmp.Close(); err != nil {
+		return irr.Wrap(err, "write cache entry failed")
+	}
+	return os.Rename(tmp.Name(), p)
+}
@@ -0,0 +1,331 @@
+package composite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
+)
+
+type (
+	// Driver 由多个子 driver 组成，按 Strategy 选择子 driver，失败时切换到下一个
+	// 连续失败 FailureThreshold 次的子 driver 会被熔断 Cooldown 时间，熔断期间不参与调度
+	Driver struct {
+		strategy Strategy
+		children []*child
+		opts     Options
+		rr       atomic.Uint64
+
+		now func() time.Time
+	}
+
+	// Options composite driver 的配置
+	//
+	//	driver: composite
+	//	driver_options:
+	//	  strategy: priority # priority | round_robin | least_latency
+	//	  failure_threshold: 3
+	//	  cooldown: 30s
+	//	  children:
+	//	    - driver: coze
+	//	      endpoint: ep-aaa
+	//	    - driver: ollama
+	//	      endpoint: qwen2:7b
+	Options struct {
+		Strategy         Strategy        `yaml:"strategy,omitempty" json:"strategy,omitempty"`
+		FailureThreshold int             `yaml:"failure_threshold,omitempty" json:"failure_threshold,omitempty"`
+		Cooldown         time.Duration   `yaml:"cooldown,omitempty" json:"cooldown,omitempty"`
+		Children         []driver.Config `yaml:"children" json:"children"`
+	}
+
+	Strategy string
+
+	// Health 子 driver 的健康状态快照
+	Health struct {
+		Name                string        `json:"name"`
+		Successes           int           `json:"successes"`
+		Failures            int           `json:"failures"`
+		ConsecutiveFailures int           `json:"consecutive_failures"`
+		Latency             time.Duration `json:"latency"` // 成功请求的平滑延迟
+		OpenUntil           time.Time     `json:"open_until,omitempty"`
+		LastError           string        `json:"last_error,omitempty"`
+	}
+
+	child struct {
+		name   string
+		driver driver.Driver
+
+		mu     sync.Mutex
+		health Health
+	}
+)
+
+const (
+	DriverName = "composite"
+
+	StrategyPriority     Strategy = "priority"
+	StrategyRoundRobin   Strategy = "round_robin"
+	StrategyLeastLatency Strategy = "least_latency"
+
+	DefaultFailureThreshold = 3
+	DefaultCooldown         = 30 * time.Second
+
+	// latencyAlpha 延迟的指数平滑系数
+	latencyAlpha = 0.3
+)
+
+var (
+	ErrNoAvailableChild = irr.Error("no available child driver")
+
+	_ driver.Driver        = new(Driver)
+	_ driver.ToolCaller    = new(Driver)
+	_ driver.ToolSupporter = new(Driver)
+)
+
+func init() {
+	driver.Register(DriverName, func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		opts := Options{}
+		if err := conf.DecodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		if len(opts.Children) == 0 {
+			return nil, irr.Error("composite driver requires at least one child in driver_options.children")
+		}
+
+		children := make([]driver.Driver, 0, len(opts.Children))
+		names := make([]string, 0, len(opts.Children))
+		for i, childConf := range opts.Children {
+			d, err := driver.New(ctx, childConf)
+			if err != nil {
+				return nil, irr.Wrap(err, "create child %d failed", i)
+			}
+			children = append(children, d)
+			names = append(names, fmt.Sprintf("%d.%s:%s", i, childConf.Driver, childConf.Endpoint))
+		}
+		d, err := New(opts, children...)
+		if err != nil {
+			return nil, err
+		}
+		return d.WithNames(names...)
+	})
+}
+
+// New 创建 composite driver，opts.Children 会被忽略，子 driver 由 children 指定
+func New(opts Options, children ...driver.Driver) (*Driver, error) {
+	switch opts.Strategy {
+	case "":
+		opts.Strategy = StrategyPriority
+	case StrategyPriority, StrategyRoundRobin, StrategyLeastLatency:
+	default:
+		return nil, irr.Error("unknown composite strategy %q", opts.Strategy)
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = DefaultFailureThreshold
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = DefaultCooldown
+	}
+
+	d := &Driver{
+		strategy: opts.Strategy,
+		opts:     opts,
+		now:      time.Now,
+	}
+	for i, c := range children {
+		name := fmt.Sprintf("%d", i)
+		d.children = append(d.children, &child{name: name, driver: c, health: Health{Name: name}})
+	}
+	return d, nil
+}
+
+// WithNames 设置子 driver 的名字，用于日志和 Health
+func (d *Driver) WithNames(names ...string) (*Driver, error) {
+	if len(names) != len(d.children) {
+		return nil, irr.Error("names count %d not match children count %d", len(names), len(d.children))
+	}
+	for i, n := range names {
+		d.children[i].name = n
+		d.children[i].health.Name = n
+	}
+	return d, nil
+}
+
+// WithClock 替换时钟，用于测试熔断
+func (d *Driver) WithClock(now func() time.Time) *Driver {
+	d.now = now
+	return d
+}
+
+// Health 返回所有子 driver 的健康状态
+func (d *Driver) Health() []Health {
+	ret := make([]Health, 0, len(d.children))
+	for _, c := range d.children {
+		c.mu.Lock()
+		ret = append(ret, c.health)
+		c.mu.Unlock()
+	}
+	return ret
+}
+
+func (d *Driver) Chat(ctx context.Context, messages []*history.Message) (string, error) {
+	log, ctx := wlog.ByCtxAndCache(ctx, "composite.chat")
+
+	var got string
+	err := d.try(ctx, log, func(c *child) (err error) {
+		got, err = c.driver.Chat(ctx, messages)
+		return err
+	})
+	return got, err
+}
+
+// StreamChat 只有在还没有输出任何内容时才会切换子 driver，避免重复输出
+func (d *Driver) StreamChat(ctx context.Context, messages []*history.Message, handle func(got string)) error {
+	log, ctx := wlog.ByCtxAndCache(ctx, "composite.stream")
+
+	emitted := false
+	return d.try(ctx, log, func(c *child) error {
+		err := c.driver.StreamChat(ctx, messages, func(got string) {
+			emitted = true
+			handle(got)
+		})
+		if err != nil && emitted {
+			return &partialError{err: err}
+		}
+		return err
+	})
+}
+
+// SupportsTools 所有子 driver 都支持原生工具调用时返回 true，避免切换子 driver 时协议不一致
+func (d *Driver) SupportsTools() bool {
+	for _, c := range d.children {
+		if _, ok := driver.AsToolCaller(c.driver); !ok {
+			return false
+		}
+	}
+	return len(d.children) > 0
+}
+
+// ChatWithTools 与 Chat 相同的调度和熔断，转发给子 driver 的原生工具调用
+func (d *Driver) ChatWithTools(ctx context.Context, messages []*history.Message, tools []driver.ToolDef) (string, []driver.ToolCall, error) {
+	log, ctx := wlog.ByCtxAndCache(ctx, "composite.tools")
+
+	var (
+		content string
+		calls   []driver.ToolCall
+	)
+	err := d.try(ctx, log, func(c *child) (err error) {
+		content, calls, err = driver.ChatWithTools(ctx, c.driver, messages, tools)
+		return err
+	})
+	return content, calls, err
+}
+
+// partialError 已经输出了部分内容，不能再切换
+type partialError struct{ err error }
+
+func (p *partialError) Error() string { return "stream failed after partial output: " + p.err.Error() }
+func (p *partialError) Unwrap() error { return p.err }
+
+func (d *Driver) try(ctx context.Context, log wlog.Log, fn func(c *child) error) error {
+	candidates := d.candidates()
+	if len(candidates) == 0 {
+		return irr.Wrap(ErrNoAvailableChild, "all %d children are circuit open", len(d.children))
+	}
+
+	errs := make([]error, 0, len(candidates))
+	for _, c := range candidates {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		start := d.now()
+		err := fn(c)
+		if err == nil {
+			c.succeed(d.now().Sub(start))
+			return nil
+		}
+		if ctx.Err() != nil { // 调用方放弃了，不算子 driver 的问题
+			return err
+		}
+
+		c.fail(err, d.now(), d.opts.FailureThreshold, d.opts.Cooldown)
+		log.WithError(err).Warnf("child %s failed, try next", c.name)
+		errs = append(errs, irr.Wrap(err, "child %s", c.name))
+
+		var partial *partialError
+		if errors.As(err, &partial) {
+			break
+		}
+	}
+	return irr.Wrap(errors.Join(errs...), "all candidates failed")
+}
+
+// candidates 按策略排序后的可用子 driver，熔断中的会被跳过
+// 熔断时间过去以后进入半开状态，再失败一次会重新熔断
+func (d *Driver) candidates() []*child {
+	now := d.now()
+	available := make([]*child, 0, len(d.children))
+	for _, c := range d.children {
+		if c.available(now) {
+			available = append(available, c)
+		}
+	}
+	if len(available) == 0 {
+		return nil
+	}
+
+	switch d.strategy {
+	case StrategyRoundRobin:
+		start := int(d.rr.Add(1)-1) % len(available)
+		available = append(available[start:], available[:start]...)
+	case StrategyLeastLatency:
+		sort.SliceStable(available, func(i, j int) bool {
+			return available[i].latency() < available[j].latency() // 没有测过的延迟为 0，优先尝试
+		})
+	}
+	return available
+}
+
+func (c *child) available(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !now.Before(c.health.OpenUntil)
+}
+
+func (c *child) latency() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.health.Latency
+}
+
+func (c *child) succeed(cost time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.health.Successes++
+	c.health.ConsecutiveFailures = 0
+	c.health.OpenUntil = time.Time{}
+	if c.health.Latency == 0 {
+		c.health.Latency = cost
+	} else {
+		c.health.Latency = time.Duration(latencyAlpha*float64(cost) + (1-latencyAlpha)*float64(c.health.Latency))
+	}
+}
+
+func (c *child) fail(err error, now time.Time, threshold int, cooldown time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.health.Failures++
+	c.health.ConsecutiveFailures++
+	c.health.LastError = err.Error()
+	if c.health.ConsecutiveFailures >= threshold {
+		c.health.OpenUntil = now.Add(cooldown)
+	}
+}
@@ -0,0 +1,184 @@
+package composite_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/driver/composite"
+	"github.com/bagaking/botheater/driver/mock"
+	"github.com/bagaking/botheater/history"
+)
+
+var (
+	errThrottled = errors.New("throttled")
+	question     = []*history.Message{history.NewUserMsg("hi", "")}
+)
+
+type fakeClock struct{ t time.Time }
+
+func (f *fakeClock) now() time.Time          { return f.t }
+func (f *fakeClock) advance(d time.Duration) { f.t = f.t.Add(d) }
+
+// slow 每次调用让时钟前进 cost，模拟延迟
+func slow(clock *fakeClock, cost time.Duration, reply string) mock.Rule {
+	return mock.Func(func(messages history.Messages) (string, bool, error) {
+		clock.advance(cost)
+		return reply, true, nil
+	})
+}
+
+func TestComposite_PriorityFailoverAndBreaker(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	bad := mock.New(mock.Fail(errThrottled))
+	good := mock.New(mock.Func(func(messages history.Messages) (string, bool, error) { return "from good", true, nil }))
+
+	d, err := composite.New(composite.Options{FailureThreshold: 2, Cooldown: time.Minute}, bad, good)
+	if err != nil {
+		t.Fatalf("new composite failed: %v", err)
+	}
+	d.WithClock(clock.now)
+
+	for i := 0; i < 3; i++ {
+		got, err := d.Chat(context.Background(), question)
+		if err != nil || got != "from good" {
+			t.Fatalf("round %d: got %q, err %v", i, got, err)
+		}
+	}
+	// 连续失败两次后熔断，第三次不再请求 bad
+	if bad.CallCount() != 2 {
+		t.Errorf("bad should be skipped after breaker opens, calls= %d", bad.CallCount())
+	}
+	health := d.Health()
+	if health[0].ConsecutiveFailures != 2 || health[0].OpenUntil.IsZero() || health[0].LastError == "" {
+		t.Errorf("unexpected health %+v", health[0])
+	}
+	if health[1].Successes != 3 {
+		t.Errorf("unexpected health %+v", health[1])
+	}
+
+	// 冷却后半开，再次尝试 bad
+	clock.advance(time.Minute)
+	if _, err = d.Chat(context.Background(), question); err != nil {
+		t.Fatalf("chat failed: %v", err)
+	}
+	if bad.CallCount() != 3 {
+		t.Errorf("bad should be retried after cooldown, calls= %d", bad.CallCount())
+	}
+}
+
+func TestComposite_AllFailed(t *testing.T) {
+	d, _ := composite.New(composite.Options{FailureThreshold: 1}, mock.New(mock.Fail(errThrottled)), mock.New(mock.Fail(errThrottled)))
+
+	if _, err := d.Chat(context.Background(), question); !errors.Is(err, errThrottled) {
+		t.Errorf("expected joined child errors, got %v", err)
+	}
+	if _, err := d.Chat(context.Background(), question); !errors.Is(err, composite.ErrNoAvailableChild) {
+		t.Errorf("expected all children open, got %v", err)
+	}
+}
+
+func TestComposite_RoundRobin(t *testing.T) {
+	a := mock.New(mock.Func(func(messages history.Messages) (string, bool, error) { return "a", true, nil }))
+	b := mock.New(mock.Func(func(messages history.Messages) (string, bool, error) { return "b", true, nil }))
+	d, _ := composite.New(composite.Options{Strategy: composite.StrategyRoundRobin}, a, b)
+
+	got := ""
+	for i := 0; i < 4; i++ {
+		s, err := d.Chat(context.Background(), question)
+		if err != nil {
+			t.Fatalf("chat failed: %v", err)
+		}
+		got += s
+	}
+	if got != "abab" {
+		t.Errorf("expected alternating children, got %s", got)
+	}
+}
+
+func TestComposite_LeastLatency(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	slowOne := mock.New(slow(clock, 3*time.Second, "slow"))
+	fastOne := mock.New(slow(clock, 100*time.Millisecond, "fast"))
+	d, _ := composite.New(composite.Options{Strategy: composite.StrategyLeastLatency}, slowOne, fastOne)
+	d.WithClock(clock.now)
+
+	// 前两次分别测量两个子 driver 的延迟，之后总是选择快的
+	answers := ""
+	for i := 0; i < 4; i++ {
+		s, _ := d.Chat(context.Background(), question)
+		answers += s + ","
+	}
+	if answers != "slow,fast,fast,fast," {
+		t.Errorf("unexpected choices %s", answers)
+	}
+}
+
+func TestComposite_Config(t *testing.T) {
+	driver.Register("composite_test_echo", func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		return mock.New(mock.Func(func(messages history.Messages) (string, bool, error) { return conf.Endpoint, true, nil })), nil
+	})
+
+	d, err := driver.New(context.Background(), driver.Config{
+		Driver: composite.DriverName,
+		Options: map[string]any{
+			"strategy": "priority",
+			"cooldown": "10s",
+			"children": []map[string]any{
+				{"driver": "composite_test_echo", "endpoint": "ep-a"},
+				{"driver": "composite_test_echo", "endpoint": "ep-b"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("create composite failed: %v", err)
+	}
+	if got, _ := d.Chat(context.Background(), question); got != "ep-a" {
+		t.Errorf("expected first child, got %s", got)
+	}
+	if name := d.(*composite.Driver).Health()[1].Name; name != "1.composite_test_echo:ep-b" {
+		t.Errorf("unexpected child name %s", name)
+	}
+
+	if _, err = driver.New(context.Background(), driver.Config{Driver: composite.DriverName}); err == nil {
+		t.Errorf("expected error without children")
+	}
+	if _, err = driver.New(context.Background(), driver.Config{
+		Driver:  composite.DriverName,
+		Options: map[string]any{"strategy": "random", "children": []map[string]any{{"driver": "composite_test_echo"}}},
+	}); err == nil {
+		t.Errorf("expected error for unknown strategy")
+	}
+}
+
+func TestComposite_ChatWithTools(t *testing.T) {
+	failing := mock.NewToolDriver(func(history.Messages, []driver.ToolDef) (string, []driver.ToolCall, error) {
+		return "", nil, errThrottled
+	})
+	healthy := mock.NewToolDriver(func(_ history.Messages, tools []driver.ToolDef) (string, []driver.ToolCall, error) {
+		return "", []driver.ToolCall{{Name: tools[0].Name}}, nil
+	})
+	d, err := composite.New(composite.Options{}, failing, healthy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc, ok := driver.AsToolCaller(d)
+	if !ok {
+		t.Fatalf("composite should support tools when all children do")
+	}
+	_, calls, err := tc.ChatWithTools(context.Background(), question, []driver.ToolDef{{Name: "echo"}})
+	if err != nil || len(calls) != 1 || calls[0].Name != "echo" {
+		t.Fatalf("should fail over to the healthy child, got %+v %v", calls, err)
+	}
+	if h := d.Health(); h[0].Failures != 1 || h[1].Successes != 1 {
+		t.Errorf("health should be tracked for tool calls, got %+v", h)
+	}
+
+	// 有子 driver 不支持时回退到文本协议，避免切换时协议不一致
+	mixed, _ := composite.New(composite.Options{}, healthy, mock.New(mock.Match(".*", "ok")))
+	if _, ok = driver.AsToolCaller(mixed); ok {
+		t.Errorf("composite should not support tools when a child does not")
+	}
+}
@@ -4,11 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/bagaking/botheater/utils"
 	"github.com/bagaking/goulp/wlog"
-	"github.com/khicago/got/util/proretry"
 	"github.com/khicago/got/util/typer"
 	"github.com/khicago/irr"
 	"github.com/volcengine/volc-sdk-golang/service/maas/models/api/v2"
@@ -21,6 +21,8 @@ import (
 type Driver struct {
 	EndpointID string
 	maas       *client.MaaS
+	generation *driver.GenerationParams
+	retry      *utils.RetryPolicy
 }
 
 var _ driver.Driver = new(Driver)
@@ -32,9 +34,22 @@ func New(maas *client.MaaS, endpointID string) *Driver {
 	}
 }
 
+// WithGenerationParams 设置默认的生成参数
+func (d *Driver) WithGenerationParams(p *driver.GenerationParams) *Driver {
+	d.generation = p
+	return d
+}
+
+// WithRetry 设置重试策略，nil 时使用 utils.DefaultDriverRetry
+func (d *Driver) WithRetry(p *utils.RetryPolicy) *Driver {
+	d.retry = p
+	return d
+}
+
 func (d *Driver) Chat(ctx context.Context, messages []*history.Message) (got string, err error) {
 	log, ctx := wlog.ByCtxAndCache(ctx, "coze.chat")
-	req := d.buildRequest(messages)
+	start := time.Now()
+	req := d.buildRequest(ctx, messages)
 	d.debugStart(req, log, len(messages))
 
 	var (
@@ -42,18 +57,12 @@ func (d *Driver) Chat(ctx context.Context, messages []*history.Message) (got str
 		status int
 	)
 
-	err = proretry.Run(func() error {
-		resp, status, err = d.maas.Chat(d.EndpointID, req)
-		if err != nil {
-			return err
-		}
-		return nil
-	}, 3,
-		proretry.WithInitInterval(time.Second*2),
-		proretry.WithBackoff(proretry.LinearBackoff(time.Second*2)),
-	)
+	err = d.retry.Do(ctx, "coze.chat", func() error {
+		resp, status, err = d.maas.ChatWithCtx(ctx, d.EndpointID, req)
+		return driver.CtxErr(ctx, utils.WithHTTPStatus(err, status))
+	})
 	if err != nil {
-		if errors.Is(err, &proretry.RetryError{}) {
+		if retryErr := (*utils.RetryError)(nil); errors.As(err, &retryErr) {
 			errVal := &api.Error{}
 			if errors.As(err, &errVal) { // the returned error always type of *api.Error
 				log.WithError(err).Errorf("meet maas error, status= %d\n", status)
@@ -74,10 +83,21 @@ func (d *Driver) Chat(ctx context.Context, messages []*history.Message) (got str
 	}
 
 	d.debugFinish(log, got, len(messages))
+	d.recordUsage(ctx, resp.Usage, messages, got, start)
 
 	return got, nil
 }
 
+// recordUsage 上报消耗，服务端没有返回 usage 时按内容估算
+func (d *Driver) recordUsage(ctx context.Context, usage *api.Usage, messages []*history.Message, got string, start time.Time) {
+	u := driver.EstimateUsage(d.EndpointID, messages, got)
+	if usage != nil {
+		u.PromptTokens, u.CompletionTokens, u.TotalTokens = usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens
+	}
+	u.Latency = time.Since(start)
+	driver.RecordUsage(ctx, u)
+}
+
 func (d *Driver) debugFinish(log wlog.Log, got string, lenHistory int) {
 	log.Debugf("\n%s\n",
 		utils.SPrintWithFrameCard(
@@ -99,7 +119,8 @@ func (d *Driver) debugStart(req *api.ChatReq, log wlog.Log, lenHistory int) {
 
 func (d *Driver) StreamChat(ctx context.Context, messages []*history.Message, handle func(got string)) error {
 	log, ctx := wlog.ByCtxAndCache(ctx, "coze.stream")
-	req := d.buildRequest(messages)
+	start := time.Now()
+	req := d.buildRequest(ctx, messages)
 	d.debugStart(req, log, len(messages))
 
 	ch, err := d.maas.StreamChatWithCtx(ctx, d.EndpointID, req)
@@ -108,33 +129,103 @@ func (d *Driver) StreamChat(ctx context.Context, messages []*history.Message, ha
 		if errors.As(err, &errVal) { // the returned error always type of *api.Error
 			log.WithError(errVal).Errorf("meet maas error")
 		}
-		return irr.Wrap(err, "stream chat failed")
+		return irr.Wrap(driver.CtxErr(ctx, err), "stream chat failed")
 	}
 
+	var (
+		usage *api.Usage
+		sb    strings.Builder
+	)
 	round := 0
-	for resp := range ch {
-		round++
-		got := RespMsg2Str(resp)
-		d.debugFinish(log, fmt.Sprintf("\t -- stream(%d) --\n%s", round, got), len(messages))
-		handle(got)
+	for {
+		select {
+		case <-ctx.Done():
+			// sdk 在 ctx 结束后会关闭连接并 close ch，这里把剩余的返回读完，避免 sdk 的协程阻塞在写 ch 上
+			go func() {
+				for range ch {
+				}
+			}()
+			return irr.Wrap(ctx.Err(), "stream chat interrupted, round= %d", round)
+		case resp, ok := <-ch:
+			if !ok {
+				d.recordUsage(ctx, usage, messages, sb.String(), start)
+				return nil
+			}
+			if resp.Error != nil {
+				return irr.Wrap(driver.CtxErr(ctx, resp.Error), "stream response failed, round= %d", round)
+			}
 
+			round++
+			if resp.Usage != nil {
+				usage = resp.Usage // 最后一个返回中带有 usage
+			}
+			got := RespMsg2Str(resp)
+			d.debugFinish(log, fmt.Sprintf("\t -- stream(%d) --\n%s", round, got), len(messages))
+			sb.WriteString(got)
+			handle(got)
+		}
 	}
-	return nil
 }
 
-func (d *Driver) buildRequest(messages []*history.Message) *api.ChatReq {
+func (d *Driver) buildRequest(ctx context.Context, messages []*history.Message) *api.ChatReq {
 	req := &api.ChatReq{
 		Messages: typer.SliceMap(messages, func(m *history.Message) *api.Message {
 			return &api.Message{
 				Name:    m.Identity,
-				Content: m.Content,
+				Content: MappingContent(m),
 				Role:    MappingRole(m.Role),
 			}
 		}),
 	}
+	if p := driver.ResolveGenerationParams(ctx, d.generation); !p.IsEmpty() {
+		req.Parameters = MappingParameters(p)
+	}
 	return req
 }
 
+// MinTemperature maas 的参数都是 omitempty 的，temperature 为 0 时不会下发 (服务端会使用默认的采样策略)
+// 因此要求 0 时下发这个最小的正数，效果上接近贪心解码
+const MinTemperature = 0.01
+
+// MappingParameters 将通用生成参数转换成 maas 的参数，temperature 为 0 时使用 MinTemperature
+func MappingParameters(p *driver.GenerationParams) *api.Parameters {
+	params := &api.Parameters{
+		Stop: p.Stop,
+	}
+	if p.Temperature != nil {
+		params.Temperature = *p.Temperature
+		if params.Temperature <= 0 {
+			params.Temperature = MinTemperature
+		}
+	}
+	if p.TopP != nil {
+		params.TopP = *p.TopP
+	}
+	if p.MaxTokens != nil {
+		params.MaxTokens = *p.MaxTokens
+	}
+	return params
+}
+
+// MappingContent 没有附加片段时使用纯文本，否则转成 maas 的多段内容，图片通过 image_url 下发
+func MappingContent(m *history.Message) interface{} {
+	if len(m.Parts) == 0 {
+		return m.Content
+	}
+	contents := make([]*api.MessageContent, 0, len(m.Parts)+1)
+	if m.Content != "" {
+		contents = append(contents, &api.MessageContent{Type: "text", Text: m.Content})
+	}
+	for _, p := range m.Parts {
+		if p.Type == history.PartImage {
+			contents = append(contents, &api.MessageContent{Type: "image_url", ImageUrl: &api.MessageImageContent{Url: p.DataURL()}})
+			continue
+		}
+		contents = append(contents, &api.MessageContent{Type: "text", Text: p.Describe()})
+	}
+	return contents
+}
+
 func MappingRole(role history.Role) api.ChatRole {
 	switch role {
 	case history.RoleBot:
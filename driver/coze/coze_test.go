@@ -0,0 +1,33 @@
+package coze_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/khicago/got/util/typer"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/driver/coze"
+)
+
+func TestMappingParameters_ZeroTemperature(t *testing.T) {
+	params := coze.MappingParameters(&driver.GenerationParams{Temperature: typer.Ptr(0.0), MaxTokens: typer.Ptr(256)})
+	if params.Temperature != coze.MinTemperature {
+		t.Errorf("temperature 0 should be mapped to %v, got %v", coze.MinTemperature, params.Temperature)
+	}
+	raw, err := json.Marshal(params)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	if !strings.Contains(string(raw), `"temperature":0.01`) {
+		t.Errorf("temperature should be sent, got %s", raw)
+	}
+
+	if params = coze.MappingParameters(&driver.GenerationParams{Temperature: typer.Ptr(0.7)}); params.Temperature != 0.7 {
+		t.Errorf("positive temperature should be kept, got %v", params.Temperature)
+	}
+	if params = coze.MappingParameters(&driver.GenerationParams{MaxTokens: typer.Ptr(256)}); params.Temperature != 0 {
+		t.Errorf("unset temperature should not be sent, got %v", params.Temperature)
+	}
+}
@@ -2,35 +2,103 @@
 //
 // 1. go get -u github.com/volcengine/volc-sdk-golang
 // 2. VOLC_ACCESSKEY=XXXXX VOLC_SECRETKEY=YYYYY go run main.go
+//
+// 不同的 prefab 可以通过 driver_options 使用不同的区域和账号，详见 Options
 package coze
 
 import (
 	"context"
+	"sync"
 
-	"github.com/bagaking/botheater/utils"
 	"github.com/bagaking/goulp/wlog"
 
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/utils"
+
 	client "github.com/volcengine/volc-sdk-golang/service/maas/v2"
 )
 
 const (
+	DriverName = "coze"
+
 	EnvKeyVOLCAccessKey  utils.EnvKey = "VOLC_ACCESSKEY"
 	EnvKeyVOLCSecretKey  utils.EnvKey = "VOLC_SECRETKEY"
 	EnvKeyDoubaoEndpoint utils.EnvKey = "DOUBAO_ENDPOINT"
 )
 
+type clientKey struct {
+	host, region string
+	cred         Credentials
+}
+
 var (
-	VOLC_ACCESSKEY = EnvKeyVOLCAccessKey.Read()
-	VOLC_SECRETKEY = EnvKeyVOLCSecretKey.Read()
+	clients   = make(map[clientKey]*client.MaaS)
+	clientsMu sync.Mutex
 )
 
+func init() {
+	driver.Register(DriverName, func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		opts := &Options{}
+		if err := conf.DecodeOptions(opts); err != nil {
+			return nil, err
+		}
+		maas, err := clientOrFallback(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		return New(maas, conf.Endpoint).WithGenerationParams(conf.Generation).WithRetry(conf.Retry), nil
+	})
+}
+
+// NewClient 使用默认配置 (北京区域，VOLC_ACCESSKEY/VOLC_SECRETKEY) 创建 client
+// Deprecated: 请使用 ClientFor，凭证缺失时的处理与通过 driver 配置创建时相同 (见 clientOrFallback)
 func NewClient(ctx context.Context) *client.MaaS {
-	r := client.NewInstance("maas-api.ml-platform-cn-beijing.volces.com", "cn-beijing")
-	wlog.ByCtx(ctx, "coze.init").Debugf("init client with IAM Keys: VOLC_SECRETKEY= %s, VOLC_SECRETKEY= %s", VOLC_ACCESSKEY, VOLC_SECRETKEY)
+	maas, _ := clientOrFallback(ctx, &Options{})
+	return maas
+}
+
+// clientOrFallback 使用默认的环境变量并且凭证缺失时，只打日志并返回没有凭证的 client，请求时才会失败
+// 配置中显式指定了凭证来源 (credentials_file 或 access_key_env/secret_key_env) 但读取失败时返回错误
+func clientOrFallback(ctx context.Context, opts *Options) (*client.MaaS, error) {
+	maas, err := ClientFor(ctx, opts)
+	if err == nil || opts.explicitCredentials() {
+		return maas, err
+	}
+	wlog.ByCtx(ctx, "coze.init").WithError(err).Warnf("create client failed, fallback to client without credentials")
+	host, region := opts.Endpoint()
+	return client.NewInstance(host, region), nil
+}
 
-	// fetch ak&sk from environmental variables
-	r.SetAccessKey(VOLC_ACCESSKEY)
-	r.SetSecretKey(VOLC_SECRETKEY)
+// ClientFor 返回配置对应的 client，host、region 和凭证都相同的配置共享同一个 client
+func ClientFor(ctx context.Context, opts *Options) (*client.MaaS, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	cred, err := opts.Credentials()
+	if err != nil {
+		return nil, err
+	}
+	host, region := opts.Endpoint()
+	key := clientKey{host: host, region: region, cred: *cred}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if c, ok := clients[key]; ok {
+		return c, nil
+	}
+
+	wlog.ByCtx(ctx, "coze.init").Debugf("init client, host= %s, region= %s, access_key= %s", host, region, maskKey(cred.AccessKey))
+	c := client.NewInstance(host, region)
+	c.SetAccessKey(cred.AccessKey)
+	c.SetSecretKey(cred.SecretKey)
+	clients[key] = c
+	return c, nil
+}
 
-	return r
+// maskKey 日志中只保留密钥的前 4 位
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return key[:4] + "****"
 }
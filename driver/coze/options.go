@@ -0,0 +1,115 @@
+package coze
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/khicago/irr"
+	"gopkg.in/yaml.v3"
+
+	"github.com/bagaking/botheater/utils"
+)
+
+type (
+	// Options coze (volc maas) 的连接配置，在 bot 配置的 driver_options 中填写，不填时使用北京区域和默认的环境变量
+	// 凭证的来源依次是 credentials_file、access_key_env/secret_key_env 指定的环境变量
+	//
+	//	driver: coze
+	//	endpoint: ep-xxx
+	//	driver_options:
+	//	  region: cn-shanghai # host 不填时根据 region 推导
+	//	  access_key_env: TEAM_B_VOLC_ACCESSKEY
+	//	  secret_key_env: TEAM_B_VOLC_SECRETKEY
+	//	  # credentials_file: ~/.volc/team_b.yaml
+	Options struct {
+		Host   string `yaml:"host,omitempty" json:"host,omitempty"`
+		Region string `yaml:"region,omitempty" json:"region,omitempty"`
+
+		AccessKeyEnv    string `yaml:"access_key_env,omitempty" json:"access_key_env,omitempty"`
+		SecretKeyEnv    string `yaml:"secret_key_env,omitempty" json:"secret_key_env,omitempty"`
+		CredentialsFile string `yaml:"credentials_file,omitempty" json:"credentials_file,omitempty"`
+	}
+
+	// Credentials volc 的 IAM 密钥，credentials_file 的内容也是这个结构 (yaml 或 json)
+	Credentials struct {
+		AccessKey string `yaml:"access_key" json:"access_key"`
+		SecretKey string `yaml:"secret_key" json:"secret_key"`
+	}
+)
+
+const DefaultRegion = "cn-beijing"
+
+// HostOf 返回 region 对应的 maas 服务地址
+func HostOf(region string) string {
+	return "maas-api.ml-platform-" + region + ".volces.com"
+}
+
+// Validate 检查配置是否合法
+func (o *Options) Validate() error {
+	if o.CredentialsFile != "" && (o.AccessKeyEnv != "" || o.SecretKeyEnv != "") {
+		return irr.Error("credentials_file and access_key_env/secret_key_env cannot be set at the same time")
+	}
+	return nil
+}
+
+// explicitCredentials 是否显式指定了凭证来源
+func (o *Options) explicitCredentials() bool {
+	return o.CredentialsFile != "" || o.AccessKeyEnv != "" || o.SecretKeyEnv != ""
+}
+
+// Endpoint 返回 host 和 region，未配置的部分使用默认值
+func (o *Options) Endpoint() (host, region string) {
+	region = o.Region
+	if region == "" {
+		region = DefaultRegion
+	}
+	host = o.Host
+	if host == "" {
+		host = HostOf(region)
+	}
+	return host, region
+}
+
+// Credentials 每次调用时读取凭证，配置的环境变量或文件在进程启动后才准备好也能生效
+func (o *Options) Credentials() (*Credentials, error) {
+	if o.CredentialsFile != "" {
+		return ReadCredentialsFile(o.CredentialsFile)
+	}
+
+	akEnv, skEnv := utils.EnvKey(o.AccessKeyEnv), utils.EnvKey(o.SecretKeyEnv)
+	if akEnv == "" {
+		akEnv = EnvKeyVOLCAccessKey
+	}
+	if skEnv == "" {
+		skEnv = EnvKeyVOLCSecretKey
+	}
+	cred := &Credentials{AccessKey: akEnv.Read(), SecretKey: skEnv.Read()}
+	if cred.AccessKey == "" || cred.SecretKey == "" {
+		return nil, irr.Error("volc credentials not found in env %s / %s", akEnv, skEnv)
+	}
+	return cred, nil
+}
+
+// ReadCredentialsFile 读取凭证文件，路径支持 ~ 开头
+func ReadCredentialsFile(path string) (*Credentials, error) {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, irr.Wrap(err, "resolve home dir failed")
+		}
+		path = filepath.Join(home, rest)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, irr.Wrap(err, "read credentials file %s failed", path)
+	}
+	cred := &Credentials{}
+	if err = yaml.Unmarshal(raw, cred); err != nil {
+		return nil, irr.Wrap(err, "decode credentials file %s failed", path)
+	}
+	if cred.AccessKey == "" || cred.SecretKey == "" {
+		return nil, irr.Error("access_key or secret_key is empty in credentials file %s", path)
+	}
+	return cred, nil
+}
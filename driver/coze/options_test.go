@@ -0,0 +1,101 @@
+package coze_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/driver/coze"
+)
+
+func TestClientFor(t *testing.T) {
+	t.Setenv("TEAM_A_AK", "ak-a")
+	t.Setenv("TEAM_A_SK", "sk-a")
+	credFile := filepath.Join(t.TempDir(), "team_b.yaml")
+	if err := os.WriteFile(credFile, []byte("access_key: ak-b\nsecret_key: sk-b\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	teamA := &coze.Options{AccessKeyEnv: "TEAM_A_AK", SecretKeyEnv: "TEAM_A_SK"}
+	a1, err := coze.ClientFor(ctx, teamA)
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+	a2, _ := coze.ClientFor(ctx, &coze.Options{AccessKeyEnv: "TEAM_A_AK", SecretKeyEnv: "TEAM_A_SK", Region: coze.DefaultRegion})
+	if a1 != a2 {
+		t.Errorf("same configuration should share the client")
+	}
+
+	shanghai, _ := coze.ClientFor(ctx, &coze.Options{AccessKeyEnv: "TEAM_A_AK", SecretKeyEnv: "TEAM_A_SK", Region: "cn-shanghai"})
+	teamB, err := coze.ClientFor(ctx, &coze.Options{CredentialsFile: credFile})
+	if err != nil {
+		t.Fatalf("create client from credentials file failed: %v", err)
+	}
+	if shanghai == a1 || teamB == a1 || teamB == shanghai {
+		t.Errorf("different region or account should use different clients")
+	}
+
+	if _, err = coze.ClientFor(ctx, &coze.Options{AccessKeyEnv: "NOT_SET_AK", SecretKeyEnv: "NOT_SET_SK"}); err == nil {
+		t.Errorf("missing credentials should fail")
+	}
+	if _, err = coze.ClientFor(ctx, &coze.Options{CredentialsFile: credFile, AccessKeyEnv: "TEAM_A_AK"}); err == nil {
+		t.Errorf("credentials_file and env should not be set together")
+	}
+}
+
+func TestOptions_Endpoint(t *testing.T) {
+	host, region := (&coze.Options{}).Endpoint()
+	if host != "maas-api.ml-platform-cn-beijing.volces.com" || region != "cn-beijing" {
+		t.Errorf("unexpected default %s %s", host, region)
+	}
+	host, _ = (&coze.Options{Region: "cn-shanghai"}).Endpoint()
+	if host != "maas-api.ml-platform-cn-shanghai.volces.com" {
+		t.Errorf("host should follow region, got %s", host)
+	}
+	host, _ = (&coze.Options{Host: "proxy.local", Region: "cn-shanghai"}).Endpoint()
+	if host != "proxy.local" {
+		t.Errorf("explicit host should win, got %s", host)
+	}
+}
+
+func TestRegistry_DriverOptions(t *testing.T) {
+	t.Setenv("TEAM_C_AK", "ak-c")
+	t.Setenv("TEAM_C_SK", "sk-c")
+	d, err := driver.New(context.Background(), driver.Config{
+		Driver:   coze.DriverName,
+		Endpoint: "ep-1",
+		Options:  map[string]any{"region": "cn-shanghai", "access_key_env": "TEAM_C_AK", "secret_key_env": "TEAM_C_SK"},
+	})
+	if err != nil {
+		t.Fatalf("new driver failed: %v", err)
+	}
+	if d.(*coze.Driver).EndpointID != "ep-1" {
+		t.Errorf("unexpected driver %+v", d)
+	}
+}
+
+func TestRegistry_MissingCredentials(t *testing.T) {
+	t.Setenv("VOLC_ACCESSKEY", "")
+	t.Setenv("VOLC_SECRETKEY", "")
+
+	// 使用默认环境变量时凭证缺失只打日志，与 NewClient 一致
+	if _, err := driver.New(context.Background(), driver.Config{Driver: coze.DriverName, Endpoint: "ep-1"}); err != nil {
+		t.Errorf("missing default credentials should not fail on load, got %v", err)
+	}
+	if coze.NewClient(context.Background()) == nil {
+		t.Errorf("NewClient should fall back to client without credentials")
+	}
+
+	// 显式指定的凭证来源读取失败时加载就报错
+	_, err := driver.New(context.Background(), driver.Config{
+		Driver:   coze.DriverName,
+		Endpoint: "ep-1",
+		Options:  map[string]any{"access_key_env": "NOT_SET_AK", "secret_key_env": "NOT_SET_SK"},
+	})
+	if err == nil {
+		t.Errorf("missing explicit credentials should fail on load")
+	}
+}
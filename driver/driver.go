@@ -3,17 +3,67 @@ package driver
 import (
 	"context"
 
+	"github.com/khicago/irr"
+	"gopkg.in/yaml.v3"
+
 	"github.com/bagaking/botheater/history"
+	"github.com/bagaking/botheater/utils"
 )
 
 type (
 	Config struct {
 		Driver   string `yaml:"driver,omitempty" json:"driver,omitempty"`
 		Endpoint string `yaml:"endpoint,omitempty" json:"endpoint,omitempty"`
+
+		// BaseURL 服务地址，目前只有 openai 兼容的 driver 使用，不填时从环境变量读取
+		BaseURL string `yaml:"base_url,omitempty" json:"base_url,omitempty"`
+
+		// Generation 通用的生成参数，各 driver 会翻译成自己的请求参数
+		Generation *GenerationParams `yaml:"generation,omitempty" json:"generation,omitempty"`
+
+		// Retry 请求失败时的重试策略，不填时使用 utils.DefaultDriverRetry
+		Retry *utils.RetryPolicy `yaml:"retry,omitempty" json:"retry,omitempty"`
+
+		// EmbedBatchSize 作为 embedder 使用时单次请求的最大文本条数，不填时不拆分
+		EmbedBatchSize int `yaml:"embed_batch_size,omitempty" json:"embed_batch_size,omitempty"`
+
+		// Options 各 driver 自己定义的配置，由 driver 通过 DecodeOptions 解析成具体的结构
+		Options map[string]any `yaml:"driver_options,omitempty" json:"driver_options,omitempty"`
 	}
 
+	// Driver 模型服务的抽象
+	// 实现方在每次请求完成后需要调用 RecordUsage 上报 token 消耗和耗时 (包括流式请求)，
+	// 服务端没有返回消耗时可以用 utils.CountTokens 估算
 	Driver interface {
 		Chat(ctx context.Context, messages []*history.Message) (resp string, err error)
 		StreamChat(ctx context.Context, messages []*history.Message, handle func(got string)) error
 	}
 )
+
+// CtxErr 请求失败时，如果 ctx 已经被取消或超时，返回 ctx.Err() 代替底层 client 的错误
+// 底层 client 往往会把 ctx 的错误包装成自己的错误类型，调用方就无法用 errors.Is 判断了
+func CtxErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// DecodeOptions 将 Options 解析到 driver 自定义的结构中, target 需要是指针
+// Options 为空时 target 保持不变
+func (c Config) DecodeOptions(target any) error {
+	if len(c.Options) == 0 {
+		return nil
+	}
+	raw, err := yaml.Marshal(c.Options)
+	if err != nil {
+		return irr.Wrap(err, "marshal driver options failed")
+	}
+	if err = yaml.Unmarshal(raw, target); err != nil {
+		return irr.Wrap(err, "decode driver options to %T failed", target)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package driver
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/khicago/irr"
+)
+
+type (
+	// Embedder 把文本转换成向量，返回的向量与 texts 一一对应
+	// 实现方需要支持一次传入多条文本，单次请求的上限由调用方通过 Batched 控制
+	Embedder interface {
+		Embed(ctx context.Context, texts []string) ([][]float32, error)
+	}
+
+	// EmbedderFactory 根据配置构建一个 Embedder
+	EmbedderFactory func(ctx context.Context, conf Config) (Embedder, error)
+
+	batchedEmbedder struct {
+		Embedder
+		size int
+	}
+)
+
+var ErrEmbedderNotFound = irr.Error("embedder not found")
+
+var (
+	embedderFactories   = make(map[string]EmbedderFactory)
+	embedderFactoriesMu sync.RWMutex
+)
+
+// RegisterEmbedder 注册一个 embedder，名字可以与 driver 相同，规则和 Register 一致
+func RegisterEmbedder(name string, factory EmbedderFactory) {
+	embedderFactoriesMu.Lock()
+	defer embedderFactoriesMu.Unlock()
+	if factory == nil {
+		panic("driver: register embedder factory is nil, name= " + name)
+	}
+	if _, dup := embedderFactories[name]; dup {
+		panic("driver: register embedder called twice, name= " + name)
+	}
+	embedderFactories[name] = factory
+}
+
+// Embedders 返回所有已注册的 embedder 名字 (有序)
+func Embedders() []string {
+	embedderFactoriesMu.RLock()
+	defer embedderFactoriesMu.RUnlock()
+	names := make([]string, 0, len(embedderFactories))
+	for name := range embedderFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewEmbedder 根据 conf.Driver 找到注册的 factory 并构建 Embedder，conf.EmbedBatchSize 大于 0 时按批请求
+// conf.Driver 为空时使用 DefaultDriverName，找不到时返回 ErrEmbedderNotFound
+func NewEmbedder(ctx context.Context, conf Config) (Embedder, error) {
+	name := conf.Driver
+	if name == "" {
+		name = DefaultDriverName
+	}
+
+	embedderFactoriesMu.RLock()
+	factory, ok := embedderFactories[name]
+	embedderFactoriesMu.RUnlock()
+	if !ok {
+		return nil, irr.Wrap(ErrEmbedderNotFound, "unknown embedder %q, registered embedders: %v", name, Embedders())
+	}
+
+	e, err := factory(ctx, conf)
+	if err != nil {
+		return nil, irr.Wrap(err, "create embedder %s failed", name)
+	}
+	return Batched(e, conf.EmbedBatchSize), nil
+}
+
+// Batched 将请求按 size 条一批拆分后依次发出，size <= 0 时原样返回
+func Batched(e Embedder, size int) Embedder {
+	if size <= 0 {
+		return e
+	}
+	return &batchedEmbedder{Embedder: e, size: size}
+}
+
+func (b *batchedEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	ret := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += b.size {
+		end := min(start+b.size, len(texts))
+		vectors, err := b.Embedder.Embed(ctx, texts[start:end])
+		if err != nil {
+			return nil, irr.Wrap(err, "embed batch [%d, %d) failed", start, end)
+		}
+		if len(vectors) != end-start {
+			return nil, irr.Error("embed batch [%d, %d) got %d vectors", start, end, len(vectors))
+		}
+		ret = append(ret, vectors...)
+	}
+	return ret, nil
+}
+
+// Cosine 计算两个向量的余弦相似度，长度不同或者有零向量时返回 0
+func Cosine(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
@@ -0,0 +1,62 @@
+package driver_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/bagaking/botheater/driver"
+)
+
+// lenEmbedder 把文本长度作为一维向量，并记录每次请求的条数
+type lenEmbedder struct {
+	batches []int
+}
+
+func (e *lenEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	e.batches = append(e.batches, len(texts))
+	ret := make([][]float32, len(texts))
+	for i, text := range texts {
+		ret[i] = []float32{float32(len(text))}
+	}
+	return ret, nil
+}
+
+func TestEmbedderRegistry(t *testing.T) {
+	inner := &lenEmbedder{}
+	driver.RegisterEmbedder("test_len", func(ctx context.Context, conf driver.Config) (driver.Embedder, error) {
+		return inner, nil
+	})
+
+	e, err := driver.NewEmbedder(context.Background(), driver.Config{Driver: "test_len", EmbedBatchSize: 2})
+	if err != nil {
+		t.Fatalf("new embedder failed: %v", err)
+	}
+	vectors, err := e.Embed(context.Background(), []string{"a", "bb", "ccc", "dddd", "eeeee"})
+	if err != nil {
+		t.Fatalf("embed failed: %v", err)
+	}
+	if len(vectors) != 5 || vectors[4][0] != 5 {
+		t.Errorf("vectors should keep the input order, got %v", vectors)
+	}
+	if len(inner.batches) != 3 || inner.batches[0] != 2 || inner.batches[2] != 1 {
+		t.Errorf("texts should be sent in batches of 2, got %v", inner.batches)
+	}
+
+	if _, err = driver.NewEmbedder(context.Background(), driver.Config{Driver: "test_nope"}); !errors.Is(err, driver.ErrEmbedderNotFound) {
+		t.Errorf("want ErrEmbedderNotFound, got %v", err)
+	}
+}
+
+func TestCosine(t *testing.T) {
+	if got := driver.Cosine([]float32{1, 0}, []float32{2, 0}); math.Abs(got-1) > 1e-9 {
+		t.Errorf("parallel vectors should be 1, got %v", got)
+	}
+	if got := driver.Cosine([]float32{1, 0}, []float32{0, 3}); got != 0 {
+		t.Errorf("orthogonal vectors should be 0, got %v", got)
+	}
+	if got := driver.Cosine([]float32{1}, []float32{1, 2}); got != 0 {
+		t.Errorf("mismatched length should be 0, got %v", got)
+	}
+}
@@ -0,0 +1,77 @@
+package driver
+
+import (
+	"context"
+)
+
+type (
+	// GenerationParams 通用的生成参数，由各 driver 翻译成自己的请求参数
+	// 字段为空 (nil) 时表示不设置，使用服务端 (模型) 的默认值
+	//
+	//	generation:
+	//	  temperature: 0.3
+	//	  max_tokens: 2048
+	//	  stop: ["</answer>"]
+	GenerationParams struct {
+		Temperature *float64 `yaml:"temperature,omitempty" json:"temperature,omitempty"`
+		TopP        *float64 `yaml:"top_p,omitempty" json:"top_p,omitempty"`
+		MaxTokens   *int     `yaml:"max_tokens,omitempty" json:"max_tokens,omitempty"`
+		Stop        []string `yaml:"stop,omitempty" json:"stop,omitempty"`
+	}
+
+	ctxKeyGenerationParams struct{}
+)
+
+// Merge 返回一个新的 GenerationParams，override 中设置了的字段覆盖 p 中的字段
+// p 和 override 都可以为 nil
+func (p *GenerationParams) Merge(override *GenerationParams) *GenerationParams {
+	ret := &GenerationParams{}
+	if p != nil {
+		*ret = *p
+	}
+	if override == nil {
+		return ret
+	}
+	if override.Temperature != nil {
+		ret.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		ret.TopP = override.TopP
+	}
+	if override.MaxTokens != nil {
+		ret.MaxTokens = override.MaxTokens
+	}
+	if override.Stop != nil {
+		ret.Stop = override.Stop
+	}
+	return ret
+}
+
+// IsEmpty 没有设置任何参数
+func (p *GenerationParams) IsEmpty() bool {
+	return p == nil || (p.Temperature == nil && p.TopP == nil && p.MaxTokens == nil && p.Stop == nil)
+}
+
+// WithGenerationParams 在 ctx 中注入单次调用的生成参数，优先级高于 prefab 中的配置
+// 多次注入时，后注入的字段覆盖先注入的
+func WithGenerationParams(ctx context.Context, override *GenerationParams) context.Context {
+	if prev, ok := GenerationParamsFromCtx(ctx); ok {
+		override = prev.Merge(override)
+	}
+	return context.WithValue(ctx, ctxKeyGenerationParams{}, override)
+}
+
+// GenerationParamsFromCtx 获取 ctx 中注入的生成参数
+func GenerationParamsFromCtx(ctx context.Context) (*GenerationParams, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	p, ok := ctx.Value(ctxKeyGenerationParams{}).(*GenerationParams)
+	return p, ok && p != nil
+}
+
+// ResolveGenerationParams 合并配置中的参数和 ctx 中注入的参数，driver 构建请求时使用
+func ResolveGenerationParams(ctx context.Context, base *GenerationParams) *GenerationParams {
+	override, _ := GenerationParamsFromCtx(ctx)
+	return base.Merge(override)
+}
@@ -0,0 +1,42 @@
+package driver_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/khicago/got/util/typer"
+
+	"github.com/bagaking/botheater/driver"
+)
+
+func TestResolveGenerationParams(t *testing.T) {
+	base := &driver.GenerationParams{
+		Temperature: typer.Ptr(0.8),
+		MaxTokens:   typer.Ptr(1024),
+		Stop:        []string{"END"},
+	}
+
+	if got := driver.ResolveGenerationParams(context.Background(), base); *got.Temperature != 0.8 || *got.MaxTokens != 1024 {
+		t.Errorf("without override should keep base, got %+v", got)
+	}
+
+	ctx := driver.WithGenerationParams(context.Background(), &driver.GenerationParams{Temperature: typer.Ptr(0.0)})
+	ctx = driver.WithGenerationParams(ctx, &driver.GenerationParams{TopP: typer.Ptr(0.5)})
+	got := driver.ResolveGenerationParams(ctx, base)
+	if *got.Temperature != 0 {
+		t.Errorf("ctx override should win, got temperature %v", *got.Temperature)
+	}
+	if got.TopP == nil || *got.TopP != 0.5 {
+		t.Errorf("nested override should be merged, got top_p %v", got.TopP)
+	}
+	if *got.MaxTokens != 1024 || len(got.Stop) != 1 {
+		t.Errorf("unset fields should fall back to base, got %+v", got)
+	}
+	if *base.Temperature != 0.8 {
+		t.Errorf("base should not be modified")
+	}
+
+	if !(*driver.GenerationParams)(nil).IsEmpty() || driver.ResolveGenerationParams(context.Background(), nil) == nil {
+		t.Errorf("nil params should be handled")
+	}
+}
@@ -0,0 +1,55 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	"github.com/bagaking/goulp/jsonex"
+
+	"github.com/bagaking/botheater/history"
+)
+
+// HashMessages 对消息做归一化 (去掉首尾空白) 后计算 sha256，salt 会被写在最前面
+// 用于 replay、cache 等需要识别相同请求的场景
+// 每个字段都带有长度前缀，避免字段内容拼接后相同的不同消息得到相同的哈希
+func HashMessages(salt string, messages []*history.Message) string {
+	h := sha256.New()
+	writeField(h, []byte(salt))
+	writeLen(h, len(messages))
+	for _, m := range messages {
+		writeField(h, []byte(m.Role))
+		writeField(h, []byte(strings.TrimSpace(m.Identity)))
+		writeField(h, []byte(strings.TrimSpace(m.Content)))
+		writeLen(h, len(m.Parts))
+		for _, p := range m.Parts {
+			writeField(h, []byte(p.Type))
+			writeField(h, []byte(p.Text))
+			writeField(h, []byte(p.URL))
+			writeField(h, []byte(p.Path))
+			writeField(h, []byte(p.MIME))
+			writeField(h, p.Data)
+		}
+		writeLen(h, len(m.ToolCalls))
+		for _, c := range m.ToolCalls {
+			writeField(h, []byte(c.ID))
+			writeField(h, []byte(c.Name))
+			writeField(h, []byte(jsonex.MustMarshalToString(c.Arguments)))
+		}
+		writeField(h, []byte(m.ToolCallID))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeField(h hash.Hash, b []byte) {
+	writeLen(h, len(b))
+	h.Write(b)
+}
+
+func writeLen(h hash.Hash, n int) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(n))
+	h.Write(buf[:])
+}
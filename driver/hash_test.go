@@ -0,0 +1,23 @@
+package driver_test
+
+import (
+	"testing"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
+)
+
+func TestHashMessages_FieldBoundary(t *testing.T) {
+	msg := func(text, url string) []*history.Message {
+		return []*history.Message{{Role: history.RoleUser, Parts: []history.Part{{Type: history.PartImage, Text: text, URL: url}}}}
+	}
+	if driver.HashMessages("", msg("ab", "c")) == driver.HashMessages("", msg("a", "bc")) {
+		t.Errorf("messages with different fields should not have the same hash")
+	}
+	if driver.HashMessages("a", nil) == driver.HashMessages("", []*history.Message{{Role: "a"}}) {
+		t.Errorf("salt and messages should not be mixed up")
+	}
+	if driver.HashMessages("", msg("a", "b")) != driver.HashMessages("", msg("a", "b")) {
+		t.Errorf("same messages should have the same hash")
+	}
+}
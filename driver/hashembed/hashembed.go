@@ -0,0 +1,123 @@
+package hashembed
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/driver"
+)
+
+type (
+	// Embedder 基于特征哈希的 embedder，不依赖模型服务，相同的输入总是得到相同的向量
+	// 词 (中文按字) 被哈希到 Dim 维中的一维并累加，结果做 L2 归一化，共享词越多的文本余弦相似度越高
+	// 适合测试以及本地调试检索流程，不具备语义能力
+	//
+	//	driver: hash
+	//	driver_options:
+	//	  dim: 256
+	Embedder struct {
+		Dim int
+	}
+
+	Options struct {
+		Dim int `yaml:"dim,omitempty" json:"dim,omitempty"`
+	}
+)
+
+const (
+	DriverName = "hash"
+	DefaultDim = 256
+)
+
+var _ driver.Embedder = new(Embedder)
+
+func init() {
+	driver.RegisterEmbedder(DriverName, func(ctx context.Context, conf driver.Config) (driver.Embedder, error) {
+		opts := Options{}
+		if err := conf.DecodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		if opts.Dim < 0 {
+			return nil, irr.Error("dim must not be negative, got %d", opts.Dim)
+		}
+		return New(opts.Dim), nil
+	})
+}
+
+// New dim 为 0 时使用 DefaultDim
+func New(dim int) *Embedder {
+	if dim <= 0 {
+		dim = DefaultDim
+	}
+	return &Embedder{Dim: dim}
+}
+
+func (e *Embedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ret := make([][]float32, len(texts))
+	for i, text := range texts {
+		ret[i] = e.vector(text)
+	}
+	return ret, nil
+}
+
+func (e *Embedder) vector(text string) []float32 {
+	v := make([]float32, e.Dim)
+	for _, token := range Tokenize(text) {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(token))
+		sum := h.Sum64()
+		sign := float32(1)
+		if sum>>63 == 1 { // 用最高位决定符号，减少哈希冲突带来的偏差
+			sign = -1
+		}
+		v[sum%uint64(e.Dim)] += sign
+	}
+
+	var norm float64
+	for _, x := range v {
+		norm += float64(x) * float64(x)
+	}
+	if norm == 0 {
+		return v
+	}
+	scale := float32(1 / math.Sqrt(norm))
+	for i := range v {
+		v[i] *= scale
+	}
+	return v
+}
+
+// Tokenize 按字母数字切词并转小写，中日韩文字每个字作为一个词
+func Tokenize(text string) []string {
+	var (
+		tokens []string
+		sb     strings.Builder
+	)
+	flush := func() {
+		if sb.Len() > 0 {
+			tokens = append(tokens, sb.String())
+			sb.Reset()
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r):
+			flush()
+			tokens = append(tokens, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			sb.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
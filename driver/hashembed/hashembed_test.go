@@ -0,0 +1,51 @@
+package hashembed_test
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/driver/hashembed"
+)
+
+func TestEmbedder(t *testing.T) {
+	e, err := driver.NewEmbedder(context.Background(), driver.Config{Driver: hashembed.DriverName, Options: map[string]any{"dim": 64}})
+	if err != nil {
+		t.Fatalf("new embedder failed: %v", err)
+	}
+
+	texts := []string{"今天天气很好 sunny day", "今天天气不错 Sunny", "数据库连接池配置"}
+	first, err := e.Embed(context.Background(), texts)
+	if err != nil {
+		t.Fatalf("embed failed: %v", err)
+	}
+	second, _ := e.Embed(context.Background(), texts)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("embedding should be deterministic")
+	}
+	if len(first[0]) != 64 {
+		t.Errorf("want dim 64, got %d", len(first[0]))
+	}
+
+	var norm float64
+	for _, x := range first[0] {
+		norm += float64(x) * float64(x)
+	}
+	if math.Abs(norm-1) > 1e-5 {
+		t.Errorf("vector should be normalized, got %v", norm)
+	}
+
+	if near, far := driver.Cosine(first[0], first[1]), driver.Cosine(first[0], first[2]); near <= far {
+		t.Errorf("texts sharing words should be closer, got %v <= %v", near, far)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	got := hashembed.Tokenize("Hello, 世界! go1.22")
+	want := []string{"hello", "世", "界", "go1", "22"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
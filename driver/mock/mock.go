@@ -0,0 +1,202 @@
+// Package mock 提供一个可编排返回的 driver，用于在 go test 中替代真实的模型
+//
+//	d := mock.New(
+//		mock.Match(`天气`, `func_call::weather("北京")`),
+//		mock.Sequence("第一次回答", "第二次回答"),
+//	)
+//	b := bot.New(conf, d, tm)
+//	...
+//	d.Call(0) // 第一次请求收到的 messages
+package mock
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
+)
+
+type (
+	// Rule 根据请求决定返回，ok 为 false 表示这条规则不处理，交给下一条
+	Rule func(messages history.Messages) (reply string, ok bool, err error)
+
+	// Driver 按顺序尝试所有规则，第一条命中的规则决定返回
+	Driver struct {
+		mu        sync.Mutex
+		rules     []Rule
+		calls     []history.Messages
+		chunkSize int
+	}
+)
+
+// DefaultStreamChunkSize StreamChat 时每个分片的字符 (rune) 数
+const DefaultStreamChunkSize = 8
+
+var (
+	ErrNoRuleMatched = irr.Error("no mock rule matched")
+
+	_ driver.Driver = new(Driver)
+)
+
+func New(rules ...Rule) *Driver {
+	return &Driver{
+		rules:     rules,
+		chunkSize: DefaultStreamChunkSize,
+	}
+}
+
+// WithStreamChunkSize 设置 StreamChat 的分片大小
+func (d *Driver) WithStreamChunkSize(size int) *Driver {
+	if size > 0 {
+		d.chunkSize = size
+	}
+	return d
+}
+
+// Append 追加规则，追加的规则优先级最低
+func (d *Driver) Append(rules ...Rule) *Driver {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rules = append(d.rules, rules...)
+	return d
+}
+
+// ModelName mock driver 上报消耗时使用的模型名
+const ModelName = "mock"
+
+func (d *Driver) Chat(ctx context.Context, messages []*history.Message) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	got, err := d.respond(messages)
+	if err == nil {
+		driver.RecordUsage(ctx, driver.EstimateUsage(ModelName, messages, got))
+	}
+	return got, err
+}
+
+func (d *Driver) StreamChat(ctx context.Context, messages []*history.Message, handle func(got string)) error {
+	got, err := d.respond(messages)
+	if err != nil {
+		return err
+	}
+	runes := []rune(got)
+	for i := 0; i < len(runes); i += d.chunkSize {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		handle(string(runes[i:min(i+d.chunkSize, len(runes))]))
+	}
+	driver.RecordUsage(ctx, driver.EstimateUsage(ModelName, messages, got))
+	return nil
+}
+
+func (d *Driver) respond(messages []*history.Message) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	received := snapshot(messages)
+	d.calls = append(d.calls, received)
+	for _, rule := range d.rules {
+		reply, ok, err := rule(received)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return reply, nil
+		}
+	}
+
+	last := ""
+	if len(received) > 0 {
+		last = received[len(received)-1].Content
+	}
+	return "", irr.Wrap(ErrNoRuleMatched, "call %d, last message= %s", len(d.calls)-1, last)
+}
+
+// Calls 返回每次请求收到的 messages
+func (d *Driver) Calls() []history.Messages {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append(make([]history.Messages, 0, len(d.calls)), d.calls...)
+}
+
+// Call 返回第 i 次请求收到的 messages，不存在时返回 nil
+func (d *Driver) Call(i int) history.Messages {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if i < 0 || i >= len(d.calls) {
+		return nil
+	}
+	return d.calls[i]
+}
+
+// CallCount 返回请求次数
+func (d *Driver) CallCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.calls)
+}
+
+// Sequence 依次返回 replies，用完以后不再命中
+func Sequence(replies ...string) Rule {
+	i := 0
+	return func(messages history.Messages) (string, bool, error) {
+		if i >= len(replies) {
+			return "", false, nil
+		}
+		i++
+		return replies[i-1], true, nil
+	}
+}
+
+// Match 最后一条消息的内容匹配 pattern 时返回 reply
+func Match(pattern string, reply string) Rule {
+	re := regexp.MustCompile(pattern)
+	return func(messages history.Messages) (string, bool, error) {
+		if len(messages) == 0 || !re.MatchString(messages[len(messages)-1].Content) {
+			return "", false, nil
+		}
+		return reply, true, nil
+	}
+}
+
+// Func 使用回调决定返回
+func Func(fn func(messages history.Messages) (reply string, ok bool, err error)) Rule {
+	return Rule(fn)
+}
+
+// Fail 总是返回 err，一般放在最后模拟请求失败
+func Fail(err error) Rule {
+	return func(messages history.Messages) (string, bool, error) {
+		return "", false, err
+	}
+}
+
+// snapshot 复制一份消息，避免调用方后续修改影响断言
+func snapshot(messages []*history.Message) history.Messages {
+	ret := make(history.Messages, 0, len(messages))
+	for _, m := range messages {
+		cp := *m
+		ret = append(ret, &cp)
+	}
+	return ret
+}
+
+// Transcript 把消息拼成便于断言的文本，每行为 role[identity]: content
+func Transcript(messages history.Messages) string {
+	sb := strings.Builder{}
+	for _, m := range messages {
+		sb.WriteString(string(m.Role))
+		if m.Identity != "" {
+			sb.WriteString("[" + m.Identity + "]")
+		}
+		sb.WriteString(": " + m.Content + "\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,44 @@
+package mock
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
+)
+
+type (
+	// ToolRule 原生工具调用的返回
+	ToolRule func(messages history.Messages, tools []driver.ToolDef) (content string, calls []driver.ToolCall, err error)
+
+	// ToolDriver 支持原生工具调用 (driver.ToolCaller) 的 mock driver，Chat 和 StreamChat 仍按 Driver 的规则返回
+	ToolDriver struct {
+		*Driver
+		rule ToolRule
+
+		toolMu    sync.Mutex
+		toolCalls int
+	}
+)
+
+var _ driver.ToolCaller = new(ToolDriver)
+
+// NewToolDriver 创建支持原生工具调用的 mock driver，ChatWithTools 由 rule 决定返回
+func NewToolDriver(rule ToolRule, rules ...Rule) *ToolDriver {
+	return &ToolDriver{Driver: New(rules...), rule: rule}
+}
+
+func (d *ToolDriver) ChatWithTools(ctx context.Context, messages []*history.Message, tools []driver.ToolDef) (string, []driver.ToolCall, error) {
+	d.toolMu.Lock()
+	d.toolCalls++
+	d.toolMu.Unlock()
+	return d.rule(snapshot(messages), tools)
+}
+
+// ToolCallCount 返回 ChatWithTools 的请求次数
+func (d *ToolDriver) ToolCallCount() int {
+	d.toolMu.Lock()
+	defer d.toolMu.Unlock()
+	return d.toolCalls
+}
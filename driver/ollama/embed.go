@@ -0,0 +1,55 @@
+package ollama
+
+import (
+	"context"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/irr"
+	"github.com/ollama/ollama/api"
+
+	"github.com/bagaking/botheater/driver"
+)
+
+// DefaultEmbedModel 作为 embedder 使用且 endpoint 没有配置时使用的模型
+const DefaultEmbedModel = "nomic-embed-text"
+
+var _ driver.Embedder = new(Driver)
+
+// Embed implements driver.Embedder，使用 /api/embed 一次请求多条文本
+func (d *Driver) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	log, ctx := wlog.ByCtxAndCache(ctx, "ollama.embed")
+	if len(texts) == 0 {
+		return nil, nil
+	}
+	model := d.model
+	if model == "" {
+		model = DefaultEmbedModel
+	}
+	req := &api.EmbedRequest{Model: model, Input: texts}
+	if d.options != nil {
+		req.KeepAlive, _ = d.options.keepAlive() // 已经在 Validate 中检查过
+	}
+
+	start := time.Now()
+	var resp *api.EmbedResponse
+	err := d.retry.Do(ctx, "ollama.embed", func() (err error) {
+		resp, err = d.client.Embed(ctx, req)
+		return mappingErr(ctx, err)
+	})
+	if err != nil {
+		log.WithError(err).Errorf("embed %d texts failed", len(texts))
+		return nil, irr.Wrap(err, "embed failed")
+	}
+	if len(resp.Embeddings) != len(texts) {
+		return nil, irr.Error("embed %d texts but got %d vectors", len(texts), len(resp.Embeddings))
+	}
+
+	driver.RecordUsage(ctx, driver.Usage{
+		Model:        model,
+		PromptTokens: resp.PromptEvalCount,
+		TotalTokens:  resp.PromptEvalCount,
+		Latency:      time.Since(start),
+	})
+	return resp.Embeddings, nil
+}
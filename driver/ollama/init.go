@@ -6,8 +6,32 @@ import (
 	"log"
 
 	"github.com/ollama/ollama/api"
+
+	"github.com/bagaking/botheater/driver"
 )
 
+const DriverName = "ollama"
+
+func init() {
+	driver.Register(DriverName, func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		return newFromConfig(ctx, conf)
+	})
+	driver.RegisterEmbedder(DriverName, func(ctx context.Context, conf driver.Config) (driver.Embedder, error) {
+		return newFromConfig(ctx, conf)
+	})
+}
+
+func newFromConfig(ctx context.Context, conf driver.Config) (*Driver, error) {
+	opts := &Options{}
+	if err := conf.DecodeOptions(opts); err != nil {
+		return nil, err
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return New(NewClient(ctx), conf.Endpoint).WithGenerationParams(conf.Generation).WithOptions(opts).WithRetry(conf.Retry), nil
+}
+
 func NewClient(ctx context.Context) *api.Client {
 	client, err := api.ClientFromEnvironment()
 	if err != nil {
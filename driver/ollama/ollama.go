@@ -8,7 +8,6 @@ import (
 	"time"
 
 	"github.com/bagaking/goulp/wlog"
-	"github.com/khicago/got/util/proretry"
 	"github.com/khicago/irr"
 	"github.com/ollama/ollama/api"
 
@@ -18,10 +17,16 @@ import (
 )
 
 type Driver struct {
-	client *api.Client
-	model  string
+	client     *api.Client
+	model      string
+	options    *Options
+	generation *driver.GenerationParams
+	retry      *utils.RetryPolicy
 }
 
+// DefaultModel endpoint 没有配置时使用的模型
+const DefaultModel = "llama3.1"
+
 var _ driver.Driver = new(Driver)
 
 func New(client *api.Client, model string) *Driver {
@@ -31,75 +36,140 @@ func New(client *api.Client, model string) *Driver {
 	}
 }
 
+// WithOptions 设置 ollama 特有的生成参数，优先级高于 WithGenerationParams
+func (d *Driver) WithOptions(opts *Options) *Driver {
+	d.options = opts
+	return d
+}
+
+// WithGenerationParams 设置默认的通用生成参数
+func (d *Driver) WithGenerationParams(p *driver.GenerationParams) *Driver {
+	d.generation = p
+	return d
+}
+
+// WithRetry 设置重试策略，nil 时使用 utils.DefaultDriverRetry
+func (d *Driver) WithRetry(p *utils.RetryPolicy) *Driver {
+	d.retry = p
+	return d
+}
+
 // Chat implements driver.Driver, provide a chat interface to ollama
 // @see https://pkg.go.dev/github.com/ollama/ollama/api#hdr-Examples
 func (d *Driver) Chat(ctx context.Context, messages []*history.Message) (string, error) {
 	log, ctx := wlog.ByCtxAndCache(ctx, "ollama.chat")
-	req := d.buildRequest(messages)
-	d.debugStart(req, log, len(messages))
+	got, _, err := d.chat(ctx, log, d.buildRequest(ctx, messages), len(messages))
+	return got, err
+}
+
+// chat 发起一次非流式请求，返回内容和工具调用，两者都为空时视为失败
+func (d *Driver) chat(ctx context.Context, log wlog.Log, req *api.ChatRequest, lenHistory int) (string, []api.ToolCall, error) {
+	start := time.Now()
+	d.debugStart(req, log, lenHistory)
 
-	var got string
+	var (
+		got     string
+		calls   []api.ToolCall
+		metrics api.Metrics
+	)
 
-	err := proretry.Run(func() error {
+	err := d.retry.Do(ctx, "ollama.chat", func() error {
+		got, calls = "", nil
 		err := d.client.Chat(ctx, req, func(resp api.ChatResponse) error {
 			got += resp.Message.Content
+			calls = append(calls, resp.Message.ToolCalls...)
+			if resp.Done {
+				metrics = resp.Metrics
+			}
 			return nil
 		})
-		if err != nil {
-			return err
-		}
-		return nil
-	}, 3,
-		proretry.WithInitInterval(time.Second*2),
-		proretry.WithBackoff(proretry.LinearBackoff(time.Second*2)),
-	)
+		return mappingErr(ctx, err)
+	})
 	if err != nil {
-		if errors.Is(err, &proretry.RetryError{}) {
+		if retryErr := (*utils.RetryError)(nil); errors.As(err, &retryErr) {
 			log.WithError(err).Errorf("meet ollama error")
 		}
-		return "", irr.Wrap(err, "chat failed")
+		return "", nil, irr.Wrap(err, "chat failed")
 	}
 
-	if got == "" {
-		return "", irr.Error("got empty content")
+	if got == "" && len(calls) == 0 {
+		return "", nil, irr.Error("got empty content")
 	}
 
-	d.debugFinish(log, got, len(messages))
+	d.debugFinish(log, got, lenHistory)
+	recordUsage(ctx, req.Model, metrics, start)
 
-	return got, nil
+	return got, calls, nil
 }
 
 func (d *Driver) StreamChat(ctx context.Context, messages []*history.Message, handle func(got string)) error {
 	log, ctx := wlog.ByCtxAndCache(ctx, "ollama.stream")
-	req := d.buildRequest(messages)
+	start := time.Now()
+	req := d.buildRequest(ctx, messages)
 	d.debugStart(req, log, len(messages))
 
+	var metrics api.Metrics
 	err := d.client.Chat(ctx, req, func(resp api.ChatResponse) error {
+		if resp.Done {
+			metrics = resp.Metrics
+		}
 		got := resp.Message.Content
 		d.debugFinish(log, got, len(messages))
 		handle(got)
 		return nil
 	})
 	if err != nil {
-		return irr.Wrap(err, "stream chat failed")
+		return irr.Wrap(driver.CtxErr(ctx, err), "stream chat failed")
 	}
+	recordUsage(ctx, req.Model, metrics, start)
 
 	return nil
 }
 
-func (d *Driver) buildRequest(messages []*history.Message) *api.ChatRequest {
+// mappingErr 附加 http 状态码用于重试分类，ctx 结束时返回 ctx.Err()
+func mappingErr(ctx context.Context, err error) error {
+	if se := (api.StatusError{}); errors.As(err, &se) {
+		err = utils.WithHTTPStatus(err, se.StatusCode)
+	}
+	return driver.CtxErr(ctx, err)
+}
+
+// recordUsage ollama 在最后一个 (Done) 返回中给出 prompt_eval_count 和 eval_count
+func recordUsage(ctx context.Context, model string, metrics api.Metrics, start time.Time) {
+	driver.RecordUsage(ctx, driver.Usage{
+		Model:            model,
+		PromptTokens:     metrics.PromptEvalCount,
+		CompletionTokens: metrics.EvalCount,
+		Latency:          time.Since(start),
+	})
+}
+
+// buildRequest 参数的优先级依次是: ctx 中注入的通用参数 > ollama 特有参数 > 配置中的通用参数
+func (d *Driver) buildRequest(ctx context.Context, messages []*history.Message) *api.ChatRequest {
 	apiMessages := make([]api.Message, len(messages))
 	for i, m := range messages {
 		apiMessages[i] = api.Message{
-			Role:    string(m.Role),
-			Content: m.Content,
+			Role:      MappingRole(m.Role),
+			Content:   m.Text(),
+			Images:    MappingImages(m),
+			ToolCalls: MappingToolCalls(m.ToolCalls),
 		}
 	}
 
+	model := d.model
+	if model == "" {
+		model = DefaultModel
+	}
+
 	req := &api.ChatRequest{
-		Model:    "llama3.1", // 假设使用 llama3.1 模型
+		Model:    model,
 		Messages: apiMessages,
 	}
+	applyGeneration(req, d.generation)
+	d.options.apply(req)
+	if override, ok := driver.GenerationParamsFromCtx(ctx); ok {
+		applyGeneration(req, override)
+	}
 	return req
 }
 
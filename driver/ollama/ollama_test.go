@@ -0,0 +1,256 @@
+package ollama_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/khicago/got/util/typer"
+	"github.com/ollama/ollama/api"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/driver/ollama"
+	"github.com/bagaking/botheater/history"
+)
+
+func newStandIn(t *testing.T, got *api.ChatRequest) *api.Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(got); err != nil {
+			t.Errorf("decode request failed: %v", err)
+		}
+		for _, part := range []string{"你", "好"} {
+			_ = json.NewEncoder(w).Encode(api.ChatResponse{Message: api.Message{Role: "assistant", Content: part}})
+		}
+		_ = json.NewEncoder(w).Encode(api.ChatResponse{Done: true, Metrics: api.Metrics{PromptEvalCount: 12, EvalCount: 2}})
+	}))
+	t.Cleanup(srv.Close)
+	base, _ := url.Parse(srv.URL)
+	return api.NewClient(base, http.DefaultClient)
+}
+
+func TestDriver_Chat_ModelAndOptions(t *testing.T) {
+	conf := driver.Config{
+		Driver:   ollama.DriverName,
+		Endpoint: "qwen2:7b",
+		Options: map[string]any{
+			"temperature": 0.2,
+			"top_p":       0.9,
+			"num_ctx":     8192,
+			"seed":        42,
+			"stop":        []string{"<|im_end|>"},
+			"keep_alive":  "30m",
+			"format":      "json",
+		},
+	}
+	opts := &ollama.Options{}
+	if err := conf.DecodeOptions(opts); err != nil {
+		t.Fatalf("decode options failed: %v", err)
+	}
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("validate options failed: %v", err)
+	}
+
+	req := &api.ChatRequest{}
+	d := ollama.New(newStandIn(t, req), conf.Endpoint).WithOptions(opts)
+	got, err := d.Chat(context.Background(), []*history.Message{history.NewUserMsg("hi", "")})
+	if err != nil {
+		t.Fatalf("chat failed: %v", err)
+	}
+	if got != "你好" {
+		t.Errorf("got %q", got)
+	}
+
+	if req.Model != "qwen2:7b" {
+		t.Errorf("expected configured model, got %s", req.Model)
+	}
+	if req.Format != "json" {
+		t.Errorf("expected json format, got %q", req.Format)
+	}
+	if req.KeepAlive == nil || req.KeepAlive.Duration != 30*time.Minute {
+		t.Errorf("unexpected keep_alive %v", req.KeepAlive)
+	}
+	// 经过 json 传输后数字都是 float64
+	want := map[string]any{"temperature": 0.2, "top_p": 0.9, "num_ctx": 8192.0, "seed": 42.0}
+	for k, v := range want {
+		if f, ok := req.Options[k].(float64); !ok || float32(f) != float32(v.(float64)) {
+			t.Errorf("option %s = %v, want %v", k, req.Options[k], v)
+		}
+	}
+	if stop, _ := req.Options["stop"].([]any); len(stop) != 1 || stop[0] != "<|im_end|>" {
+		t.Errorf("unexpected stop %v", req.Options["stop"])
+	}
+}
+
+func TestDriver_Chat_Defaults(t *testing.T) {
+	req := &api.ChatRequest{}
+	d := ollama.New(newStandIn(t, req), "")
+	if _, err := d.Chat(context.Background(), []*history.Message{history.NewUserMsg("hi", "")}); err != nil {
+		t.Fatalf("chat failed: %v", err)
+	}
+	if req.Model != ollama.DefaultModel {
+		t.Errorf("expected default model, got %s", req.Model)
+	}
+	if len(req.Options) != 0 || req.KeepAlive != nil || req.Format != "" {
+		t.Errorf("expected no options, got %v %v %q", req.Options, req.KeepAlive, req.Format)
+	}
+}
+
+func TestOptions_Validate(t *testing.T) {
+	for _, o := range []ollama.Options{{Format: "xml"}, {KeepAlive: "forever"}} {
+		if err := o.Validate(); err == nil {
+			t.Errorf("expected error for %+v", o)
+		}
+	}
+	for _, o := range []ollama.Options{{KeepAlive: "-1"}, {KeepAlive: "300"}, {Format: "json"}} {
+		if err := o.Validate(); err != nil {
+			t.Errorf("unexpected error for %+v: %v", o, err)
+		}
+	}
+}
+
+func TestDriver_Chat_GenerationPriority(t *testing.T) {
+	req := &api.ChatRequest{}
+	d := ollama.New(newStandIn(t, req), "qwen2:7b").
+		WithGenerationParams(&driver.GenerationParams{Temperature: typer.Ptr(0.9), TopP: typer.Ptr(0.8), MaxTokens: typer.Ptr(128)}).
+		WithOptions(&ollama.Options{TopP: typer.Ptr[float32](0.5)})
+
+	ctx := driver.WithGenerationParams(context.Background(), &driver.GenerationParams{Temperature: typer.Ptr(0.0)})
+	if _, err := d.Chat(ctx, []*history.Message{history.NewUserMsg("hi", "")}); err != nil {
+		t.Fatalf("chat failed: %v", err)
+	}
+
+	want := map[string]float64{"temperature": 0, "top_p": 0.5, "num_predict": 128}
+	for k, v := range want {
+		if f, ok := req.Options[k].(float64); !ok || float32(f) != float32(v) {
+			t.Errorf("option %s = %v, want %v", k, req.Options[k], v)
+		}
+	}
+}
+
+func TestDriver_Chat_Usage(t *testing.T) {
+	ctx, report := driver.EnsureUsageReport(context.Background())
+	d := ollama.New(newStandIn(t, &api.ChatRequest{}), "qwen2:7b")
+	if _, err := d.Chat(ctx, []*history.Message{history.NewUserMsg("hi", "")}); err != nil {
+		t.Fatalf("chat failed: %v", err)
+	}
+	if err := d.StreamChat(ctx, []*history.Message{history.NewUserMsg("hi", "")}, func(string) {}); err != nil {
+		t.Fatalf("stream chat failed: %v", err)
+	}
+
+	// eval count 来自 Done 的返回
+	stat := report.ByModel()["qwen2:7b"]
+	if stat.Calls != 2 || stat.PromptTokens != 24 || stat.CompletionTokens != 4 || stat.TotalTokens != 28 {
+		t.Errorf("unexpected usage %+v", stat)
+	}
+}
+
+func TestDriver_ChatWithTools(t *testing.T) {
+	req := &api.ChatRequest{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			t.Errorf("decode request failed: %v", err)
+		}
+		msg := api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{
+			Name:      "google_searcher",
+			Arguments: api.ToolCallFunctionArguments{"query": "ollama tools"},
+		}}}}
+		_ = json.NewEncoder(w).Encode(api.ChatResponse{Message: msg, Done: true})
+	}))
+	t.Cleanup(srv.Close)
+	base, _ := url.Parse(srv.URL)
+
+	d := ollama.New(api.NewClient(base, http.DefaultClient), "qwen2:7b")
+	got, calls, err := d.ChatWithTools(context.Background(), []*history.Message{history.NewUserMsg("搜一下", "")}, []driver.ToolDef{{
+		Name:        "google_searcher",
+		Description: "搜索",
+		Params:      []driver.ToolParam{{Name: "query", Required: true}},
+	}})
+	if err != nil {
+		t.Fatalf("chat with tools failed: %v", err)
+	}
+	if got != "" || len(calls) != 1 || calls[0].Name != "google_searcher" || calls[0].Arguments["query"] != "ollama tools" {
+		t.Errorf("unexpected result %q %+v", got, calls)
+	}
+
+	if req.Stream == nil || *req.Stream || len(req.Tools) != 1 {
+		t.Fatalf("expected non-stream request with tools, got %+v", req)
+	}
+	fn := req.Tools[0].Function
+	if fn.Name != "google_searcher" || fn.Parameters.Properties["query"].Type != "string" || fn.Parameters.Required[0] != "query" {
+		t.Errorf("unexpected tool %s", fn.String())
+	}
+}
+
+func TestDriver_Chat_ToolResults(t *testing.T) {
+	req := &api.ChatRequest{}
+	d := ollama.New(newStandIn(t, req), "qwen2:7b")
+	messages := []*history.Message{
+		history.NewUserMsg("搜一下", ""),
+		history.NewBotMsg("", "tester").WithToolCalls(history.ToolCall{ID: "call_1", Name: "google_searcher", Arguments: map[string]any{"query": "ollama"}}),
+		history.NewToolResultMsg("call_1", "google_searcher", "找到 3 条结果"),
+	}
+	if _, err := d.Chat(context.Background(), messages); err != nil {
+		t.Fatalf("chat failed: %v", err)
+	}
+	call, result := req.Messages[1], req.Messages[2]
+	if call.Role != "assistant" || len(call.ToolCalls) != 1 || call.ToolCalls[0].Function.Name != "google_searcher" || call.ToolCalls[0].Function.Arguments["query"] != "ollama" {
+		t.Errorf("unexpected call message %+v", call)
+	}
+	if result.Role != "tool" || result.Content != "找到 3 条结果" {
+		t.Errorf("unexpected tool result %+v", result)
+	}
+}
+
+func TestDriver_Chat_Images(t *testing.T) {
+	req := &api.ChatRequest{}
+	d := ollama.New(newStandIn(t, req), "llava")
+	msg := history.NewUserMsg("图里是什么", "").WithParts(
+		history.ImagePart([]byte("png"), "image/png"),
+		history.ImageURLPart("https://example.com/a.jpg"),
+		history.FilePart("./a.txt", ""),
+	)
+	if _, err := d.Chat(context.Background(), []*history.Message{msg}); err != nil {
+		t.Fatalf("chat failed: %v", err)
+	}
+	got := req.Messages[0]
+	if len(got.Images) != 1 || string(got.Images[0]) != "png" {
+		t.Errorf("image data should be mapped to images, got %v", got.Images)
+	}
+	if got.Content != "图里是什么\n[file: ./a.txt]" {
+		t.Errorf("file references should be kept in content, got %q", got.Content)
+	}
+}
+
+func TestDriver_Embed(t *testing.T) {
+	req := &api.EmbedRequest{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/embed" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		_ = json.NewDecoder(r.Body).Decode(req)
+		_ = json.NewEncoder(w).Encode(api.EmbedResponse{Embeddings: [][]float32{{1, 0}, {0, 1}}, PromptEvalCount: 6})
+	}))
+	t.Cleanup(srv.Close)
+	base, _ := url.Parse(srv.URL)
+
+	ctx, report := driver.EnsureUsageReport(context.Background())
+	d := ollama.New(api.NewClient(base, http.DefaultClient), "")
+	vectors, err := d.Embed(ctx, []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("embed failed: %v", err)
+	}
+	if len(vectors) != 2 || vectors[1][1] != 1 {
+		t.Errorf("unexpected vectors %v", vectors)
+	}
+	if req.Model != ollama.DefaultEmbedModel || len(req.Input.([]any)) != 2 {
+		t.Errorf("unexpected request %+v", req)
+	}
+	if total := report.Total(); total.Calls != 1 || total.PromptTokens != 6 {
+		t.Errorf("embed usage should be recorded, got %+v", total)
+	}
+}
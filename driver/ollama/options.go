@@ -0,0 +1,124 @@
+package ollama
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/khicago/irr"
+	"github.com/ollama/ollama/api"
+
+	"github.com/bagaking/botheater/driver"
+)
+
+// Options ollama 的生成参数，在 bot 配置的 driver_options 中填写
+// 指针类型的字段不填时使用模型 (Modelfile) 中的默认值
+//
+//	driver: ollama
+//	endpoint: qwen2:7b
+//	driver_options:
+//	  temperature: 0.2
+//	  num_ctx: 8192
+//	  stop: ["<|im_end|>"]
+//	  keep_alive: 30m
+//	  format: json
+type Options struct {
+	Temperature *float32 `yaml:"temperature,omitempty" json:"temperature,omitempty"`
+	TopP        *float32 `yaml:"top_p,omitempty" json:"top_p,omitempty"`
+	NumCtx      *int     `yaml:"num_ctx,omitempty" json:"num_ctx,omitempty"`
+	Seed        *int     `yaml:"seed,omitempty" json:"seed,omitempty"`
+	Stop        []string `yaml:"stop,omitempty" json:"stop,omitempty"`
+
+	// KeepAlive 模型在内存中的保留时间，如 5m, 1h；纯数字表示秒数，负数表示常驻
+	KeepAlive string `yaml:"keep_alive,omitempty" json:"keep_alive,omitempty"`
+
+	// Format 目前 ollama 只支持 json
+	Format string `yaml:"format,omitempty" json:"format,omitempty"`
+}
+
+const FormatJSON = "json"
+
+// Validate 检查配置是否合法
+func (o *Options) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.Format != "" && o.Format != FormatJSON {
+		return irr.Error("unsupported format %q, only %q is supported", o.Format, FormatJSON)
+	}
+	if _, err := o.keepAlive(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// apply 将配置写入请求
+func (o *Options) apply(req *api.ChatRequest) {
+	if o == nil {
+		return
+	}
+	opts := req.Options
+	if opts == nil {
+		opts = make(map[string]any)
+	}
+	if o.Temperature != nil {
+		opts["temperature"] = *o.Temperature
+	}
+	if o.TopP != nil {
+		opts["top_p"] = *o.TopP
+	}
+	if o.NumCtx != nil {
+		opts["num_ctx"] = *o.NumCtx
+	}
+	if o.Seed != nil {
+		opts["seed"] = *o.Seed
+	}
+	if len(o.Stop) > 0 {
+		opts["stop"] = o.Stop
+	}
+	if len(opts) > 0 {
+		req.Options = opts
+	}
+
+	req.Format = o.Format
+	req.KeepAlive, _ = o.keepAlive() // 已经在 Validate 中检查过
+}
+
+// applyGeneration 将通用生成参数写入请求，max_tokens 对应 ollama 的 num_predict
+func applyGeneration(req *api.ChatRequest, p *driver.GenerationParams) {
+	if p.IsEmpty() {
+		return
+	}
+	if req.Options == nil {
+		req.Options = make(map[string]any)
+	}
+	if p.Temperature != nil {
+		req.Options["temperature"] = *p.Temperature
+	}
+	if p.TopP != nil {
+		req.Options["top_p"] = *p.TopP
+	}
+	if p.MaxTokens != nil {
+		req.Options["num_predict"] = *p.MaxTokens
+	}
+	if p.Stop != nil {
+		req.Options["stop"] = p.Stop
+	}
+}
+
+// keepAlive 复用 api.Duration 的解析规则
+func (o *Options) keepAlive() (*api.Duration, error) {
+	v := strings.TrimSpace(o.KeepAlive)
+	if v == "" {
+		return nil, nil
+	}
+	raw := strconv.Quote(v)
+	if _, err := strconv.Atoi(v); err == nil {
+		raw = v
+	}
+	d := &api.Duration{}
+	if err := json.Unmarshal([]byte(raw), d); err != nil {
+		return nil, irr.Wrap(err, "invalid keep_alive %q", o.KeepAlive)
+	}
+	return d, nil
+}
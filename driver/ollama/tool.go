@@ -0,0 +1,72 @@
+package ollama
+
+import (
+	"context"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/got/util/typer"
+	"github.com/ollama/ollama/api"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
+)
+
+var _ driver.ToolCaller = new(Driver)
+
+// ChatWithTools implements driver.ToolCaller，ollama 只在非流式请求中返回 tool_calls
+// 模型不支持 tools 时 ollama 会直接返回错误，此时可以在 prefab 中关闭原生工具调用
+func (d *Driver) ChatWithTools(ctx context.Context, messages []*history.Message, tools []driver.ToolDef) (string, []driver.ToolCall, error) {
+	log, ctx := wlog.ByCtxAndCache(ctx, "ollama.chat_with_tools")
+	req := d.buildRequest(ctx, messages)
+	req.Stream = typer.Ptr(false)
+	req.Tools = typer.SliceMap(tools, MappingTool)
+
+	got, calls, err := d.chat(ctx, log, req, len(messages))
+	if err != nil {
+		return "", nil, err
+	}
+	return got, typer.SliceMap(calls, func(c api.ToolCall) driver.ToolCall {
+		return driver.ToolCall{
+			Name:      c.Function.Name,
+			Arguments: c.Function.Arguments,
+		}
+	}), nil
+}
+
+// MappingToolCalls 将 history 中记录的调用转换成 assistant 消息的 tool_calls，ollama 不使用调用的 id
+func MappingToolCalls(calls []history.ToolCall) []api.ToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	return typer.SliceMap(calls, func(c history.ToolCall) api.ToolCall {
+		tc := api.ToolCall{}
+		tc.Function.Name = c.Name
+		tc.Function.Arguments = c.Arguments
+		return tc
+	})
+}
+
+// MappingTool 将通用的工具定义转换成 ollama 的 tools
+func MappingTool(def driver.ToolDef) api.Tool {
+	t := api.Tool{Type: "function"}
+	t.Function.Name = def.Name
+	t.Function.Description = def.Description
+	t.Function.Parameters.Type = "object"
+	t.Function.Parameters.Required = make([]string, 0, len(def.Params))
+	t.Function.Parameters.Properties = make(map[string]struct {
+		Type        string   `json:"type"`
+		Description string   `json:"description"`
+		Enum        []string `json:"enum,omitempty"`
+	}, len(def.Params))
+	for _, p := range def.Params {
+		prop := t.Function.Parameters.Properties[p.Name]
+		prop.Type = p.ParamType()
+		prop.Description = p.Description
+		prop.Enum = p.Enum
+		t.Function.Parameters.Properties[p.Name] = prop
+		if p.Required {
+			t.Function.Parameters.Required = append(t.Function.Parameters.Required, p.Name)
+		}
+	}
+	return t
+}
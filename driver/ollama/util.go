@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/bagaking/botheater/history"
 	"github.com/bagaking/botheater/utils"
 	"github.com/ollama/ollama/api"
 )
@@ -29,3 +30,27 @@ func Msg2Str(ind int, msg api.Message) string {
 		content, utils.PrintWidthL2, utils.StyMsgCard,
 	)
 }
+
+// MappingRole 将 history 中的角色转换成 ollama 的角色，调用结果使用 tool
+func MappingRole(role history.Role) string {
+	switch role {
+	case history.RoleBot:
+		return "assistant"
+	case history.RoleSystem:
+		return "system"
+	case history.RoleTool:
+		return "tool"
+	}
+	return "user"
+}
+
+// MappingImages 取出消息中带有数据的图片，ollama 不支持通过 URL 传图，这类图片只保留 Message.Text 中的描述
+func MappingImages(m *history.Message) []api.ImageData {
+	var images []api.ImageData
+	for _, p := range m.Images() {
+		if len(p.Data) > 0 {
+			images = append(images, p.Data)
+		}
+	}
+	return images
+}
@@ -0,0 +1,77 @@
+package openai
+
+import (
+	"encoding/json"
+
+	"github.com/bagaking/botheater/history"
+)
+
+type (
+	// ContentPart content 为数组时的元素，对应 text 和 image_url 两种类型
+	ContentPart struct {
+		Type     string    `json:"type"`
+		Text     string    `json:"text,omitempty"`
+		ImageURL *ImageURL `json:"image_url,omitempty"`
+	}
+
+	ImageURL struct {
+		URL string `json:"url"`
+	}
+)
+
+// MarshalJSON 有附加片段时 content 以数组的形式下发，否则保持字符串
+func (m Message) MarshalJSON() ([]byte, error) {
+	type plain Message
+	if len(m.Parts) == 0 {
+		return json.Marshal(plain(m))
+	}
+	parts := make([]*ContentPart, 0, len(m.Parts)+1)
+	if m.Content != "" {
+		parts = append(parts, &ContentPart{Type: "text", Text: m.Content})
+	}
+	return json.Marshal(struct {
+		plain
+		Content []*ContentPart `json:"content"`
+	}{plain: plain(m), Content: append(parts, m.Parts...)})
+}
+
+// UnmarshalJSON 兼容数组形式的 content，开头的文本作为 Content，其余的放入 Parts
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type plain Message
+	raw := struct {
+		*plain
+		Content json.RawMessage `json:"content"`
+	}{plain: (*plain)(m)}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw.Content) == 0 || string(raw.Content) == "null" {
+		return nil
+	}
+	if raw.Content[0] != '[' {
+		return json.Unmarshal(raw.Content, &m.Content)
+	}
+	if err := json.Unmarshal(raw.Content, &m.Parts); err != nil {
+		return err
+	}
+	if len(m.Parts) > 0 && m.Parts[0].Type == "text" {
+		m.Content, m.Parts = m.Parts[0].Text, m.Parts[1:]
+	}
+	return nil
+}
+
+// MappingParts 图片转成 image_url (原始数据使用 data url)，其他片段转成文本
+func MappingParts(parts []history.Part) []*ContentPart {
+	if len(parts) == 0 {
+		return nil
+	}
+	ret := make([]*ContentPart, 0, len(parts))
+	for _, p := range parts {
+		if p.Type == history.PartImage {
+			ret = append(ret, &ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: p.DataURL()}})
+			continue
+		}
+		ret = append(ret, &ContentPart{Type: "text", Text: p.Describe()})
+	}
+	return ret
+}
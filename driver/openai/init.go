@@ -0,0 +1,69 @@
+// Usage:
+//
+// 1. 启动任意 openai 兼容的服务, 比如 vLLM, llama.cpp server
+// 2. OPENAI_BASE_URL=http://127.0.0.1:8000 OPENAI_API_KEY=XXXXX go run main.go
+package openai
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/bagaking/goulp/wlog"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/utils"
+)
+
+const (
+	DriverName = "openai"
+
+	EnvKeyOpenAIBaseURL utils.EnvKey = "OPENAI_BASE_URL"
+	EnvKeyOpenAIAPIKey  utils.EnvKey = "OPENAI_API_KEY"
+
+	DefaultBaseURL = "https://api.openai.com"
+
+	pathChatCompletions = "/v1/chat/completions"
+)
+
+func init() {
+	driver.Register(DriverName, func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		opts := &Options{}
+		if err := conf.DecodeOptions(opts); err != nil {
+			return nil, err
+		}
+		if err := opts.Validate(); err != nil {
+			return nil, err
+		}
+		cli := NewClient(ctx, conf.BaseURL)
+		cli.APIKey = opts.ResolveAPIKey()
+		return New(cli, conf.Endpoint).WithGenerationParams(conf.Generation).WithRetry(conf.Retry).WithStreamUsage(opts.StreamUsage), nil
+	})
+}
+
+// Client 是对 openai 兼容接口的最小封装
+type Client struct {
+	BaseURL string
+	APIKey  string
+	HTTP    *http.Client
+}
+
+// NewClient 创建 client, baseURL 为空时从环境变量 OPENAI_BASE_URL 读取，密钥从 OPENAI_API_KEY 读取
+// baseURL 可以带或者不带 /v1 后缀，通过 driver 配置创建时密钥可以在 driver_options 中指定 (见 Options)
+func NewClient(ctx context.Context, baseURL string) *Client {
+	if baseURL == "" {
+		baseURL = EnvKeyOpenAIBaseURL.Read(DefaultBaseURL)
+	}
+	baseURL = strings.TrimSuffix(strings.TrimRight(baseURL, "/"), "/v1")
+	wlog.ByCtx(ctx, "openai.init").Debugf("init client with base_url= %s", baseURL)
+
+	return &Client{
+		BaseURL: baseURL,
+		APIKey:  EnvKeyOpenAIAPIKey.Read(),
+		HTTP:    http.DefaultClient,
+	}
+}
+
+func (c *Client) chatCompletionsURL() string {
+	return c.BaseURL + pathChatCompletions
+}
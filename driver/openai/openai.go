@@ -0,0 +1,347 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/got/util/typer"
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
+	"github.com/bagaking/botheater/utils"
+)
+
+type (
+	Driver struct {
+		client     *Client
+		model      string
+		generation *driver.GenerationParams
+		retry      *utils.RetryPolicy
+
+		streamUsage bool
+	}
+
+	// ChatReq /v1/chat/completions 的请求体
+	ChatReq struct {
+		Model    string     `json:"model"`
+		Messages []*Message `json:"messages"`
+		Stream   bool       `json:"stream,omitempty"`
+
+		StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+		Tools         []*Tool        `json:"tools,omitempty"`
+
+		Temperature *float64 `json:"temperature,omitempty"`
+		TopP        *float64 `json:"top_p,omitempty"`
+		MaxTokens   *int     `json:"max_tokens,omitempty"`
+		Stop        []string `json:"stop,omitempty"`
+	}
+
+	// StreamOptions 流式请求时要求服务端在最后一个 chunk 中返回 usage
+	StreamOptions struct {
+		IncludeUsage bool `json:"include_usage"`
+	}
+
+	Message struct {
+		Role      string      `json:"role"`
+		Content   string      `json:"content"`
+		Name      string      `json:"name,omitempty"`
+		ToolCalls []*ToolCall `json:"tool_calls,omitempty"`
+
+		// ToolCallID role 为 tool 时对应的调用
+		ToolCallID string `json:"tool_call_id,omitempty"`
+
+		// Parts 附加的图片等片段，不为空时 content 以数组的形式下发
+		Parts []*ContentPart `json:"-"`
+	}
+
+	// ChatResp /v1/chat/completions 的返回体, 流式返回时每个 chunk 也是这个结构
+	ChatResp struct {
+		ID      string    `json:"id,omitempty"`
+		Model   string    `json:"model,omitempty"`
+		Choices []*Choice `json:"choices"`
+		Usage   *Usage    `json:"usage,omitempty"`
+		Error   *APIError `json:"error,omitempty"`
+	}
+
+	Choice struct {
+		Index        int      `json:"index"`
+		Message      *Message `json:"message,omitempty"`
+		Delta        *Message `json:"delta,omitempty"`
+		FinishReason string   `json:"finish_reason,omitempty"`
+	}
+
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	}
+
+	APIError struct {
+		Message string `json:"message"`
+		Type    string `json:"type,omitempty"`
+		Code    any    `json:"code,omitempty"`
+
+		StatusCode int `json:"-"`
+	}
+)
+
+const streamDone = "[DONE]"
+
+var _ driver.Driver = new(Driver)
+
+// HTTPStatus 用于重试时的错误分类
+func (e *APIError) HTTPStatus() int {
+	return e.StatusCode
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("openai api error (status %d, type %s, code %v): %s", e.StatusCode, e.Type, e.Code, e.Message)
+}
+
+func New(client *Client, model string) *Driver {
+	return &Driver{
+		client: client,
+		model:  model,
+	}
+}
+
+// WithGenerationParams 设置默认的生成参数
+func (d *Driver) WithGenerationParams(p *driver.GenerationParams) *Driver {
+	d.generation = p
+	return d
+}
+
+// WithRetry 设置重试策略，nil 时使用 utils.DefaultDriverRetry
+func (d *Driver) WithRetry(p *utils.RetryPolicy) *Driver {
+	d.retry = p
+	return d
+}
+
+// WithStreamUsage 流式请求时是否要求服务端返回 usage (stream_options.include_usage)，服务端不支持时不要开启
+func (d *Driver) WithStreamUsage(enable bool) *Driver {
+	d.streamUsage = enable
+	return d
+}
+
+func (d *Driver) Chat(ctx context.Context, messages []*history.Message) (string, error) {
+	log, ctx := wlog.ByCtxAndCache(ctx, "openai.chat")
+	got, _, err := d.chat(ctx, log, d.buildRequest(ctx, messages, false), messages)
+	return got, err
+}
+
+// chat 发起一次非流式请求，返回内容和工具调用，两者都为空时视为失败
+func (d *Driver) chat(ctx context.Context, log wlog.Log, req *ChatReq, messages []*history.Message) (string, []*ToolCall, error) {
+	start := time.Now()
+	d.debugStart(req, log, len(messages))
+
+	var resp *ChatResp
+	err := d.retry.Do(ctx, "openai.chat", func() (err error) {
+		resp, err = d.do(ctx, req)
+		return driver.CtxErr(ctx, err)
+	})
+	if err != nil {
+		if retryErr := (*utils.RetryError)(nil); errors.As(err, &retryErr) {
+			log.WithError(err).Errorf("meet openai error")
+		}
+		return "", nil, irr.Wrap(err, "chat failed")
+	}
+
+	got, calls := RespMsg2Str(resp), RespToolCalls(resp)
+	if got == "" && len(calls) == 0 {
+		return "", nil, irr.Error("got empty content")
+	}
+
+	d.debugFinish(log, got, len(messages))
+	d.recordUsage(ctx, resp.Usage, messages, got, start)
+
+	return got, calls, nil
+}
+
+func (d *Driver) StreamChat(ctx context.Context, messages []*history.Message, handle func(got string)) error {
+	log, ctx := wlog.ByCtxAndCache(ctx, "openai.stream")
+	start := time.Now()
+	req := d.buildRequest(ctx, messages, true)
+	d.debugStart(req, log, len(messages))
+
+	body, err := d.post(ctx, req)
+	if err != nil {
+		return irr.Wrap(driver.CtxErr(ctx, err), "stream chat failed")
+	}
+	defer body.Close()
+
+	var (
+		usage *Usage
+		sb    strings.Builder
+	)
+	round := 0
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue // 空行以及 event/id 等字段都忽略
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == streamDone {
+			break
+		}
+
+		chunk := &ChatResp{}
+		if err = json.Unmarshal([]byte(data), chunk); err != nil {
+			return irr.Wrap(err, "decode stream chunk failed, data= %s", data)
+		}
+		if chunk.Error != nil {
+			return irr.Wrap(chunk.Error, "stream response failed")
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		if len(chunk.Choices) == 0 {
+			continue // include_usage 时最后一个 chunk 只有 usage
+		}
+
+		round++
+		got := RespDelta2Str(chunk)
+		d.debugFinish(log, fmt.Sprintf("\t -- stream(%d) --\n%s", round, got), len(messages))
+		sb.WriteString(got)
+		handle(got)
+	}
+	if err = scanner.Err(); err != nil {
+		return irr.Wrap(driver.CtxErr(ctx, err), "read stream failed")
+	}
+	d.recordUsage(ctx, usage, messages, sb.String(), start)
+	return nil
+}
+
+// recordUsage 上报消耗，服务端没有返回 usage 时按内容估算
+func (d *Driver) recordUsage(ctx context.Context, usage *Usage, messages []*history.Message, got string, start time.Time) {
+	u := driver.EstimateUsage(d.model, messages, got)
+	if usage != nil {
+		u.PromptTokens, u.CompletionTokens, u.TotalTokens = usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens
+	}
+	u.Latency = time.Since(start)
+	driver.RecordUsage(ctx, u)
+}
+
+// do 发起一次非流式请求
+func (d *Driver) do(ctx context.Context, req *ChatReq) (*ChatResp, error) {
+	body, err := d.post(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	resp := &ChatResp{}
+	if err = json.NewDecoder(body).Decode(resp); err != nil {
+		return nil, irr.Wrap(err, "decode response failed")
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp, nil
+}
+
+// post 发送请求，状态码非 2xx 时把返回体转成 *APIError
+func (d *Driver) post(ctx context.Context, req *ChatReq) (io.ReadCloser, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, irr.Wrap(err, "marshal request failed")
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, d.client.chatCompletionsURL(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, irr.Wrap(err, "create request failed")
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if req.Stream {
+		httpReq.Header.Set("Accept", "text/event-stream")
+	}
+	if d.client.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+d.client.APIKey)
+	}
+
+	httpResp, err := d.client.HTTP.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if httpResp.StatusCode/100 != 2 {
+		defer httpResp.Body.Close()
+		raw, _ := io.ReadAll(httpResp.Body)
+		wrapper := struct {
+			Error *APIError `json:"error"`
+		}{}
+		if json.Unmarshal(raw, &wrapper) != nil || wrapper.Error == nil {
+			wrapper.Error = &APIError{Message: strings.TrimSpace(string(raw))}
+		}
+		wrapper.Error.StatusCode = httpResp.StatusCode
+		return nil, wrapper.Error
+	}
+	return httpResp.Body, nil
+}
+
+func (d *Driver) buildRequest(ctx context.Context, messages []*history.Message, stream bool) *ChatReq {
+	p := driver.ResolveGenerationParams(ctx, d.generation)
+	req := &ChatReq{
+		Temperature: p.Temperature,
+		TopP:        p.TopP,
+		MaxTokens:   p.MaxTokens,
+		Stop:        p.Stop,
+
+		Model:  d.model,
+		Stream: stream,
+		Messages: typer.SliceMap(messages, func(m *history.Message) *Message {
+			return &Message{
+				Role:       MappingRole(m.Role),
+				Content:    m.Content,
+				Parts:      MappingParts(m.Parts),
+				ToolCalls:  MappingToolCalls(m.ToolCalls),
+				ToolCallID: m.ToolCallID,
+			}
+		}),
+	}
+	if stream && d.streamUsage {
+		req.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+	return req
+}
+
+func (d *Driver) debugFinish(log wlog.Log, got string, lenHistory int) {
+	log.Debugf("\n%s\n",
+		utils.SPrintWithFrameCard(
+			fmt.Sprintf("openai driver <<< RESP (len:%d, history:%d)", len(got), lenHistory),
+			got, utils.PrintWidthL1, utils.StyTalk,
+		),
+	)
+}
+
+func (d *Driver) debugStart(req *ChatReq, log wlog.Log, lenHistory int) {
+	reqStr := Req2Str(req)
+	log.Debugf("\n%s\n",
+		utils.SPrintWithFrameCard(
+			fmt.Sprintf("openai driver >>> REQ (len:%d, history:%d)", len(reqStr), lenHistory),
+			reqStr, utils.PrintWidthL1, utils.StyTalk,
+		),
+	)
+}
+
+func MappingRole(role history.Role) string {
+	switch role {
+	case history.RoleBot:
+		return "assistant"
+	case history.RoleSystem:
+		return "system"
+	case history.RoleTool:
+		return "tool"
+	}
+	return "user"
+}
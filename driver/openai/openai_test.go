@@ -0,0 +1,362 @@
+package openai_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/khicago/got/util/typer"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/driver/openai"
+	"github.com/bagaking/botheater/history"
+	"github.com/bagaking/botheater/utils"
+)
+
+// newStandIn 启动一个最小的 /v1/chat/completions 替身, 收到的请求会写入 got
+func newStandIn(t *testing.T, got *openai.ChatReq, handle func(w http.ResponseWriter, req *openai.ChatReq)) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer test-key" {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+		if err := json.NewDecoder(r.Body).Decode(got); err != nil {
+			t.Errorf("decode request failed: %v", err)
+		}
+		handle(w, got)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newDriver(srv *httptest.Server, baseSuffix string) *openai.Driver {
+	cli := openai.NewClient(context.Background(), srv.URL+baseSuffix)
+	cli.APIKey = "test-key"
+	return openai.New(cli, "qwen2-7b")
+}
+
+var testMessages = []*history.Message{
+	history.NewSystemMsg("你是一个助手", ""),
+	history.NewUserMsg("你好", ""),
+	history.NewBotMsg("你好，有什么可以帮你", "botheater_basic"),
+	history.NewUserMsg("讲个笑话", ""),
+}
+
+func TestDriver_Chat(t *testing.T) {
+	req := &openai.ChatReq{}
+	srv := newStandIn(t, req, func(w http.ResponseWriter, req *openai.ChatReq) {
+		_ = json.NewEncoder(w).Encode(openai.ChatResp{
+			Choices: []*openai.Choice{{Message: &openai.Message{Role: "assistant", Content: "  从前有座山  "}}},
+			Usage:   &openai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+		})
+	})
+
+	ctx, report := driver.EnsureUsageReport(context.Background())
+	got, err := newDriver(srv, "/v1/").Chat(ctx, testMessages)
+	if err != nil {
+		t.Fatalf("chat failed: %v", err)
+	}
+	if got != "从前有座山" {
+		t.Errorf("got %q", got)
+	}
+	if total := report.Total(); total.Calls != 1 || total.PromptTokens != 10 || total.TotalTokens != 15 {
+		t.Errorf("unexpected usage %+v", total)
+	}
+
+	if req.Model != "qwen2-7b" || req.Stream {
+		t.Errorf("unexpected request model= %s stream= %v", req.Model, req.Stream)
+	}
+	wantRoles := []string{"system", "user", "assistant", "user"}
+	if len(req.Messages) != len(wantRoles) {
+		t.Fatalf("expected %d messages, got %d", len(wantRoles), len(req.Messages))
+	}
+	for i, role := range wantRoles {
+		if req.Messages[i].Role != role || req.Messages[i].Content != testMessages[i].Content {
+			t.Errorf("message %d = %+v, want role %s", i, req.Messages[i], role)
+		}
+	}
+}
+
+func TestDriver_StreamChat(t *testing.T) {
+	req := &openai.ChatReq{}
+	srv := newStandIn(t, req, func(w http.ResponseWriter, req *openai.ChatReq) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, delta := range []string{"从前", "有座", "山"} {
+			chunk, _ := json.Marshal(openai.ChatResp{Choices: []*openai.Choice{{Delta: &openai.Message{Content: delta}}}})
+			_, _ = fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		usage, _ := json.Marshal(openai.ChatResp{Choices: []*openai.Choice{}, Usage: &openai.Usage{PromptTokens: 20, CompletionTokens: 3}})
+		_, _ = fmt.Fprintf(w, "data: %s\n\n", usage)
+		_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	var deltas []string
+	ctx, report := driver.EnsureUsageReport(context.Background())
+	err := newDriver(srv, "").WithStreamUsage(true).StreamChat(ctx, testMessages, func(got string) {
+		deltas = append(deltas, got)
+	})
+	if err != nil {
+		t.Fatalf("stream chat failed: %v", err)
+	}
+	if !req.Stream || req.StreamOptions == nil || !req.StreamOptions.IncludeUsage {
+		t.Errorf("expected stream request with usage, got %+v", req.StreamOptions)
+	}
+	if total := report.Total(); total.PromptTokens != 20 || total.CompletionTokens != 3 {
+		t.Errorf("unexpected usage %+v", total)
+	}
+	if strings.Join(deltas, "|") != "从前|有座|山" {
+		t.Errorf("unexpected deltas %v", deltas)
+	}
+}
+
+func TestDriver_StreamChat_WithoutUsage(t *testing.T) {
+	req := &openai.ChatReq{}
+	srv := newStandIn(t, req, func(w http.ResponseWriter, req *openai.ChatReq) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		chunk, _ := json.Marshal(openai.ChatResp{Choices: []*openai.Choice{{Delta: &openai.Message{Content: "山"}}}})
+		_, _ = fmt.Fprintf(w, "data: %s\n\n", chunk)
+		_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	// 默认不发送 stream_options，避免不支持的服务拒绝请求，消耗按内容估算
+	ctx, report := driver.EnsureUsageReport(context.Background())
+	if err := newDriver(srv, "").StreamChat(ctx, testMessages, func(got string) {}); err != nil {
+		t.Fatalf("stream chat failed: %v", err)
+	}
+	if !req.Stream || req.StreamOptions != nil {
+		t.Errorf("stream_options should not be sent by default, got %+v", req.StreamOptions)
+	}
+	if total := report.Total(); total.CompletionTokens == 0 {
+		t.Errorf("usage should be estimated, got %+v", total)
+	}
+}
+
+func TestDriver_StreamChat_APIError(t *testing.T) {
+	srv := newStandIn(t, &openai.ChatReq{}, func(w http.ResponseWriter, req *openai.ChatReq) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprint(w, `{"error":{"message":"model not found","type":"invalid_request_error"}}`)
+	})
+
+	err := newDriver(srv, "").StreamChat(context.Background(), testMessages, func(got string) {
+		t.Errorf("handle should not be called, got %q", got)
+	})
+	if err == nil || !strings.Contains(err.Error(), "model not found") || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("expected api error, got %v", err)
+	}
+}
+
+func TestDriver_Chat_GenerationParams(t *testing.T) {
+	req := &openai.ChatReq{}
+	srv := newStandIn(t, req, func(w http.ResponseWriter, req *openai.ChatReq) {
+		_ = json.NewEncoder(w).Encode(openai.ChatResp{Choices: []*openai.Choice{{Message: &openai.Message{Content: "ok"}}}})
+	})
+
+	d := newDriver(srv, "").WithGenerationParams(&driver.GenerationParams{
+		Temperature: typer.Ptr(0.7),
+		MaxTokens:   typer.Ptr(256),
+		Stop:        []string{"###"},
+	})
+	ctx := driver.WithGenerationParams(context.Background(), &driver.GenerationParams{Temperature: typer.Ptr(0.0)})
+	if _, err := d.Chat(ctx, testMessages); err != nil {
+		t.Fatalf("chat failed: %v", err)
+	}
+
+	if req.Temperature == nil || *req.Temperature != 0 {
+		t.Errorf("expected temperature 0 from ctx, got %v", req.Temperature)
+	}
+	if req.MaxTokens == nil || *req.MaxTokens != 256 || len(req.Stop) != 1 || req.TopP != nil {
+		t.Errorf("unexpected params max_tokens= %v stop= %v top_p= %v", req.MaxTokens, req.Stop, req.TopP)
+	}
+}
+
+func TestDriver_Chat_CancelDuringRetry(t *testing.T) {
+	calls := 0
+	srv := newStandIn(t, &openai.ChatReq{}, func(w http.ResponseWriter, req *openai.ChatReq) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	// 第一次失败后进入 2s 的退避，ctx 超时应该立即中断等待
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := newDriver(srv, "").Chat(ctx, testMessages)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > time.Second || calls != 1 {
+		t.Errorf("retry should stop once ctx is done, cost %v, calls %d", time.Since(start), calls)
+	}
+}
+
+func TestDriver_ChatWithTools(t *testing.T) {
+	req := &openai.ChatReq{}
+	srv := newStandIn(t, req, func(w http.ResponseWriter, req *openai.ChatReq) {
+		_ = json.NewEncoder(w).Encode(openai.ChatResp{Choices: []*openai.Choice{{Message: &openai.Message{
+			Role: "assistant",
+			ToolCalls: []*openai.ToolCall{{ID: "call_1", Type: "function", Function: &openai.ToolCallFunction{
+				Name: "local_file_reader", Arguments: `{"path":"./README.md"}`,
+			}}},
+		}}}})
+	})
+
+	got, calls, err := newDriver(srv, "").ChatWithTools(context.Background(), testMessages, []driver.ToolDef{{
+		Name:   "local_file_reader",
+		Params: []driver.ToolParam{{Name: "path", Required: true}},
+	}})
+	if err != nil {
+		t.Fatalf("chat with tools failed: %v", err)
+	}
+	if got != "" || len(calls) != 1 || calls[0].ID != "call_1" || calls[0].Arguments["path"] != "./README.md" {
+		t.Errorf("unexpected result %q %+v", got, calls)
+	}
+	if len(req.Tools) != 1 || req.Tools[0].Function.Name != "local_file_reader" || req.Tools[0].Function.Parameters["type"] != "object" {
+		t.Errorf("unexpected tools %+v", req.Tools)
+	}
+}
+
+func TestDriver_Chat_ToolResults(t *testing.T) {
+	req := &openai.ChatReq{}
+	srv := newStandIn(t, req, func(w http.ResponseWriter, req *openai.ChatReq) {
+		_ = json.NewEncoder(w).Encode(openai.ChatResp{Choices: []*openai.Choice{{Message: &openai.Message{Role: "assistant", Content: "写好了"}}}})
+	})
+
+	messages := []*history.Message{
+		history.NewUserMsg("读一下 README", ""),
+		history.NewBotMsg("", "tester").WithToolCalls(history.ToolCall{ID: "call_1", Name: "local_file_reader", Arguments: map[string]any{"path": "./README.md"}}),
+		history.NewToolResultMsg("call_1", "local_file_reader", "# botheater"),
+	}
+	if _, err := newDriver(srv, "").Chat(context.Background(), messages); err != nil {
+		t.Fatalf("chat failed: %v", err)
+	}
+	if len(req.Messages) != 3 {
+		t.Fatalf("unexpected messages %+v", req.Messages)
+	}
+	call, result := req.Messages[1], req.Messages[2]
+	if call.Role != "assistant" || len(call.ToolCalls) != 1 || call.ToolCalls[0].ID != "call_1" || call.ToolCalls[0].Function.Arguments != `{"path":"./README.md"}` {
+		t.Errorf("unexpected call message %+v", call)
+	}
+	if result.Role != "tool" || result.ToolCallID != "call_1" || result.Content != "# botheater" {
+		t.Errorf("unexpected tool result %+v", result)
+	}
+}
+
+func TestDriver_Chat_ImageParts(t *testing.T) {
+	var raw map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&raw)
+		_ = json.NewEncoder(w).Encode(openai.ChatResp{
+			Choices: []*openai.Choice{{Message: &openai.Message{Role: "assistant", Content: "一只猫"}}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	msg := history.NewUserMsg("图里是什么", "").WithParts(history.ImagePart([]byte("png"), "image/png"), history.ImageURLPart("https://example.com/a.jpg"))
+	if _, err := newDriver(srv, "/v1").Chat(context.Background(), []*history.Message{history.NewUserMsg("你好", ""), msg}); err != nil {
+		t.Fatalf("chat failed: %v", err)
+	}
+
+	messages := raw["messages"].([]any)
+	if content := messages[0].(map[string]any)["content"]; content != "你好" {
+		t.Errorf("plain message should keep string content, got %v", content)
+	}
+	content, ok := messages[1].(map[string]any)["content"].([]any)
+	if !ok || len(content) != 3 {
+		t.Fatalf("content should be an array, got %v", messages[1])
+	}
+	data, _ := json.Marshal(content)
+	if s := string(data); !strings.Contains(s, `"text":"图里是什么"`) || !strings.Contains(s, "data:image/png;base64,cG5n") || !strings.Contains(s, "https://example.com/a.jpg") {
+		t.Errorf("unexpected content %s", s)
+	}
+
+	// 数组形式的 content 可以解回 Message
+	payload, _ := json.Marshal(messages[1])
+	got := &openai.Message{}
+	if err := json.Unmarshal(payload, got); err != nil || got.Content != "图里是什么" || len(got.Parts) != 2 {
+		t.Errorf("unmarshal failed: %v %+v", err, got)
+	}
+}
+
+func TestDriver_Chat_RetryPolicy(t *testing.T) {
+	status := []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusOK}
+	calls := 0
+	srv := newStandIn(t, &openai.ChatReq{}, func(w http.ResponseWriter, req *openai.ChatReq) {
+		code := status[calls]
+		calls++
+		if code != http.StatusOK {
+			w.WriteHeader(code)
+			_, _ = fmt.Fprint(w, `{"error":{"message":"busy"}}`)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(openai.ChatResp{Choices: []*openai.Choice{{Message: &openai.Message{Content: "ok"}}}})
+	})
+
+	var events []utils.RetryEvent
+	ctx := utils.WithRetryListener(context.Background(), func(e utils.RetryEvent) { events = append(events, e) })
+	d := newDriver(srv, "").WithRetry(&utils.RetryPolicy{MaxAttempts: 3, Backoff: utils.BackoffConstant, Interval: time.Millisecond})
+	got, err := d.Chat(ctx, testMessages)
+	if err != nil || got != "ok" {
+		t.Fatalf("chat should succeed after retries, got %q %v", got, err)
+	}
+	if len(events) != 2 || events[0].Class != utils.ErrClassRateLimit || events[1].Class != utils.ErrClassServer || events[0].Name != "openai.chat" {
+		t.Errorf("unexpected retry events %+v", events)
+	}
+
+	// 鉴权失败不会重试
+	calls, status = 0, []int{http.StatusUnauthorized, http.StatusOK}
+	_, err = d.Chat(context.Background(), testMessages)
+	retryErr := &utils.RetryError{}
+	if !errors.As(err, &retryErr) || retryErr.Class != utils.ErrClassFatal || retryErr.Attempts != 1 || calls != 1 {
+		t.Errorf("fatal error should not be retried, got %v with %d calls", err, calls)
+	}
+	apiErr := &openai.APIError{}
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("api error should be kept, got %v", err)
+	}
+}
+
+func TestRegistry_APIKey(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "env-key")
+	t.Setenv("TEAM_B_OPENAI_API_KEY", "team-b-key")
+	keys := make(chan string, 3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys <- strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		_, _ = w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "ok"}}]}`))
+	}))
+	defer srv.Close()
+
+	// 多个 prefab 使用不同的密钥
+	for _, c := range []struct {
+		options map[string]any
+		want    string
+	}{
+		{map[string]any{"api_key": "team-a-key"}, "team-a-key"},
+		{map[string]any{"api_key_env": "TEAM_B_OPENAI_API_KEY"}, "team-b-key"},
+		{nil, "env-key"},
+	} {
+		d, err := driver.New(context.Background(), driver.Config{Driver: openai.DriverName, Endpoint: "qwen2-7b", BaseURL: srv.URL, Options: c.options})
+		if err != nil {
+			t.Fatalf("create driver failed: %v", err)
+		}
+		if _, err = d.Chat(context.Background(), testMessages); err != nil {
+			t.Fatalf("chat failed: %v", err)
+		}
+		if got := <-keys; got != c.want {
+			t.Errorf("options %v: expected key %s, got %s", c.options, c.want, got)
+		}
+	}
+
+	_, err := driver.New(context.Background(), driver.Config{Driver: openai.DriverName, Options: map[string]any{"api_key": "a", "api_key_env": "B"}})
+	if err == nil {
+		t.Errorf("api_key and api_key_env should not be set together")
+	}
+}
@@ -0,0 +1,45 @@
+package openai
+
+import (
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/utils"
+)
+
+// Options openai 兼容服务的连接配置，在 bot 配置的 driver_options 中填写
+// 密钥的来源依次是 api_key、api_key_env 指定的环境变量和 OPENAI_API_KEY，同一个进程中的多个 prefab 可以使用不同的密钥
+//
+//	driver: openai
+//	endpoint: qwen2-7b
+//	base_url: http://127.0.0.1:8000
+//	driver_options:
+//	  api_key_env: TEAM_B_OPENAI_API_KEY
+//	  # api_key: sk-xxx
+//	  stream_usage: true
+type Options struct {
+	APIKey    string `yaml:"api_key,omitempty" json:"api_key,omitempty"`
+	APIKeyEnv string `yaml:"api_key_env,omitempty" json:"api_key_env,omitempty"`
+
+	// StreamUsage 流式请求时带上 stream_options.include_usage，让服务端在最后返回 usage
+	// 部分兼容服务 (如较老的 vLLM 和一些代理) 不认识这个字段会直接拒绝请求，所以默认关闭，此时按内容估算消耗
+	StreamUsage bool `yaml:"stream_usage,omitempty" json:"stream_usage,omitempty"`
+}
+
+// Validate 检查配置是否合法
+func (o *Options) Validate() error {
+	if o.APIKey != "" && o.APIKeyEnv != "" {
+		return irr.Error("api_key and api_key_env cannot be set at the same time")
+	}
+	return nil
+}
+
+// ResolveAPIKey 返回使用的密钥，都没有配置时读取 OPENAI_API_KEY
+func (o *Options) ResolveAPIKey() string {
+	if o.APIKey != "" {
+		return o.APIKey
+	}
+	if o.APIKeyEnv != "" {
+		return utils.EnvKey(o.APIKeyEnv).Read()
+	}
+	return EnvKeyOpenAIAPIKey.Read()
+}
@@ -0,0 +1,94 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/got/util/typer"
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
+)
+
+type (
+	// Tool /v1/chat/completions 请求中的工具定义
+	Tool struct {
+		Type     string        `json:"type"`
+		Function *ToolFunction `json:"function"`
+	}
+
+	ToolFunction struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Parameters  map[string]any `json:"parameters"`
+	}
+
+	// ToolCall 返回中的工具调用，arguments 是 JSON 字符串
+	ToolCall struct {
+		ID       string            `json:"id,omitempty"`
+		Type     string            `json:"type"`
+		Function *ToolCallFunction `json:"function"`
+	}
+
+	ToolCallFunction struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	}
+)
+
+var _ driver.ToolCaller = new(Driver)
+
+// ChatWithTools implements driver.ToolCaller
+func (d *Driver) ChatWithTools(ctx context.Context, messages []*history.Message, tools []driver.ToolDef) (string, []driver.ToolCall, error) {
+	log, ctx := wlog.ByCtxAndCache(ctx, "openai.chat_with_tools")
+	req := d.buildRequest(ctx, messages, false)
+	req.Tools = typer.SliceMap(tools, MappingTool)
+
+	got, calls, err := d.chat(ctx, log, req, messages)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ret := make([]driver.ToolCall, 0, len(calls))
+	for _, c := range calls {
+		if c.Function == nil {
+			continue
+		}
+		args := make(map[string]any)
+		if c.Function.Arguments != "" {
+			if err = json.Unmarshal([]byte(c.Function.Arguments), &args); err != nil {
+				return "", nil, irr.Wrap(err, "decode arguments of tool call %s failed, arguments= %s", c.Function.Name, c.Function.Arguments)
+			}
+		}
+		ret = append(ret, driver.ToolCall{ID: c.ID, Name: c.Function.Name, Arguments: args})
+	}
+	return got, ret, nil
+}
+
+// MappingToolCalls 将 history 中记录的调用转换成 assistant 消息的 tool_calls，arguments 编码成 JSON 字符串
+func MappingToolCalls(calls []history.ToolCall) []*ToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	return typer.SliceMap(calls, func(c history.ToolCall) *ToolCall {
+		args, err := json.Marshal(c.Arguments)
+		if err != nil || c.Arguments == nil {
+			args = []byte("{}")
+		}
+		return &ToolCall{ID: c.ID, Type: "function", Function: &ToolCallFunction{Name: c.Name, Arguments: string(args)}}
+	})
+}
+
+// MappingTool 将通用的工具定义转换成 openai 的 tools
+func MappingTool(def driver.ToolDef) *Tool {
+	return &Tool{
+		Type: "function",
+		Function: &ToolFunction{
+			Name:        def.Name,
+			Description: def.Description,
+			Parameters:  def.JSONSchema(),
+		},
+	}
+}
@@ -0,0 +1,64 @@
+package openai
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bagaking/botheater/utils"
+)
+
+func Req2Str(req *ChatReq) string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("REQUEST model[%s] (%d)\n", req.Model, len(req.Messages)))
+	for i, msg := range req.Messages {
+		sb.WriteString(Msg2Str(i, msg))
+	}
+	return sb.String()
+}
+
+func Msg2Str(ind int, msg *Message) string {
+	content := strings.TrimSpace(msg.Content)
+	if content == "" {
+		content = "!!got-empty-content!! all msg is:\n" + msg.Content
+	}
+
+	return utils.SPrintWithFrameCard(
+		fmt.Sprintf(" %d. role[%s] (len:%d) (token:%d)", ind, msg.Role, len(content), utils.CountTokens(content)),
+		content, utils.PrintWidthL2, utils.StyMsgCard,
+	)
+}
+
+func RespMsg2Str(resp *ChatResp) string {
+	sb := strings.Builder{}
+	for _, c := range resp.Choices {
+		if c.Message == nil {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("%s\n", c.Message.Content))
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// RespToolCalls 取出返回中的工具调用
+func RespToolCalls(resp *ChatResp) []*ToolCall {
+	var calls []*ToolCall
+	for _, c := range resp.Choices {
+		if c.Message == nil {
+			continue
+		}
+		calls = append(calls, c.Message.ToolCalls...)
+	}
+	return calls
+}
+
+// RespDelta2Str 取出流式 chunk 中的增量内容, 增量不能 trim
+func RespDelta2Str(resp *ChatResp) string {
+	sb := strings.Builder{}
+	for _, c := range resp.Choices {
+		if c.Delta == nil {
+			continue
+		}
+		sb.WriteString(c.Delta.Content)
+	}
+	return sb.String()
+}
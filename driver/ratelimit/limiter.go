@@ -0,0 +1,172 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+type (
+	// Limits 限流配置，字段 <= 0 表示不限制
+	Limits struct {
+		// RPS 每秒请求数 (令牌桶)
+		RPS float64 `yaml:"rps,omitempty" json:"rps,omitempty"`
+		// Burst 令牌桶容量，不填时为 max(1, RPS)
+		Burst int `yaml:"burst,omitempty" json:"burst,omitempty"`
+		// MaxInFlight 同时进行中的请求数
+		MaxInFlight int `yaml:"max_in_flight,omitempty" json:"max_in_flight,omitempty"`
+		// TPM 每分钟 token 预算，请求前按 prompt 预估扣除，返回后扣除 completion
+		TPM int `yaml:"tpm,omitempty" json:"tpm,omitempty"`
+	}
+
+	// Limiter 一个 endpoint 的限流器，可以被多个 driver 共享
+	Limiter struct {
+		limits   Limits
+		requests *bucket
+		tokens   *bucket
+		inFlight chan struct{}
+	}
+
+	// bucket 令牌桶，tokens 可以为负数 (欠账)，欠账需要等待补充后才能继续
+	bucket struct {
+		mu       sync.Mutex
+		rate     float64 // 每秒补充的数量
+		capacity float64
+		tokens   float64
+		last     time.Time
+	}
+)
+
+var (
+	shared   = make(map[string]*Limiter)
+	sharedMu sync.Mutex
+)
+
+// NewLimiter 创建独立的限流器
+func NewLimiter(limits Limits) *Limiter {
+	l := &Limiter{limits: limits}
+	if limits.RPS > 0 {
+		burst := float64(limits.Burst)
+		if burst <= 0 {
+			burst = math.Max(1, limits.RPS)
+		}
+		l.requests = newBucket(limits.RPS, burst)
+	}
+	if limits.TPM > 0 {
+		l.tokens = newBucket(float64(limits.TPM)/60, float64(limits.TPM))
+	}
+	if limits.MaxInFlight > 0 {
+		l.inFlight = make(chan struct{}, limits.MaxInFlight)
+	}
+	return l
+}
+
+// Shared 返回 key 对应的共享限流器，不存在时用 limits 创建
+// 同一个 key 以第一次创建时的 limits 为准
+func Shared(key string, limits Limits) *Limiter {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if l, ok := shared[key]; ok {
+		return l
+	}
+	l := NewLimiter(limits)
+	shared[key] = l
+	return l
+}
+
+// Limits 返回限流配置
+func (l *Limiter) Limits() Limits {
+	return l.limits
+}
+
+// Acquire 等待直到可以发起一次预估消耗 estimateTokens 的请求
+// 等待期间 ctx 取消时返回 ctx.Err()；成功时必须调用 release
+func (l *Limiter) Acquire(ctx context.Context, estimateTokens int) (release func(), err error) {
+	if l.inFlight != nil {
+		select {
+		case l.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release = func() {
+		if l.inFlight != nil {
+			<-l.inFlight
+		}
+	}
+
+	if err = l.Wait(ctx, estimateTokens); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// Wait 等待一次请求的令牌和预估的 token，不占用 in-flight 的名额
+// 用于已经 Acquire 的请求在内部重试时再次扣除，重试也是一次真实的请求
+func (l *Limiter) Wait(ctx context.Context, estimateTokens int) error {
+	if l.requests != nil {
+		if err := l.requests.wait(ctx, 1); err != nil {
+			return err
+		}
+	}
+	if l.tokens != nil {
+		if err := l.tokens.wait(ctx, float64(estimateTokens)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Charge 请求结束后扣除实际消耗的 token (一般是 completion 部分)，允许欠账
+func (l *Limiter) Charge(tokens int) {
+	if l.tokens != nil && tokens > 0 {
+		l.tokens.take(float64(tokens))
+	}
+}
+
+func newBucket(rate, capacity float64) *bucket {
+	return &bucket{
+		rate:     rate,
+		capacity: capacity,
+		tokens:   capacity,
+		last:     time.Now(),
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait 等待 n 个令牌，n 超过容量时按容量计算，避免永远等不到
+func (b *bucket) wait(ctx context.Context, n float64) error {
+	n = math.Min(n, b.capacity)
+	for {
+		b.mu.Lock()
+		b.refill(time.Now())
+		if b.tokens >= n {
+			b.tokens -= n
+			b.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (b *bucket) take(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= n
+}
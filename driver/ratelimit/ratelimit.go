@@ -0,0 +1,147 @@
+package ratelimit
+
+import (
+	"context"
+	"strings"
+
+	"github.com/bagaking/goulp/jsonex"
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
+	"github.com/bagaking/botheater/utils"
+)
+
+type (
+	// Driver 在请求 inner 之前等待限流器放行，inner 内部 (utils.RetryPolicy.Do) 的每次重试也会再次等待
+	Driver struct {
+		inner   driver.Driver
+		limiter *Limiter
+	}
+
+	// Options ratelimit driver 的配置，相同 key (默认为 inner.endpoint) 的 bot 共享同一个限流器
+	//
+	//	driver: ratelimit
+	//	driver_options:
+	//	  rps: 2
+	//	  max_in_flight: 4
+	//	  tpm: 60000
+	//	  inner:
+	//	    driver: coze
+	//	    endpoint: ep-xxx
+	Options struct {
+		Key    string `yaml:"key,omitempty" json:"key,omitempty"`
+		Limits `yaml:",inline" json:",inline"`
+		Inner  driver.Config `yaml:"inner" json:"inner"`
+	}
+)
+
+const DriverName = "ratelimit"
+
+var (
+	_ driver.Driver        = new(Driver)
+	_ driver.ToolCaller    = new(Driver)
+	_ driver.ToolSupporter = new(Driver)
+)
+
+func init() {
+	driver.Register(DriverName, func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		opts := Options{}
+		if err := conf.DecodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		key := opts.Key
+		if key == "" {
+			key = opts.Inner.Driver + ":" + opts.Inner.Endpoint
+		}
+
+		inner, err := driver.New(ctx, opts.Inner)
+		if err != nil {
+			return nil, irr.Wrap(err, "create inner driver failed")
+		}
+		limiter := Shared(key, opts.Limits)
+		if limiter.Limits() != opts.Limits {
+			wlog.ByCtx(ctx, "ratelimit.init").Warnf("limiter %s already exists with %+v, ignore %+v", key, limiter.Limits(), opts.Limits)
+		}
+		return New(inner, limiter), nil
+	})
+}
+
+func New(inner driver.Driver, limiter *Limiter) *Driver {
+	return &Driver{
+		inner:   inner,
+		limiter: limiter,
+	}
+}
+
+// acquire 等待限流器放行，返回的 ctx 中注册了重试前的检查，inner 内部的每次重试也会扣除令牌
+func (d *Driver) acquire(ctx context.Context, messages []*history.Message) (context.Context, func(), error) {
+	estimate := estimateTokens(messages)
+	release, err := d.limiter.Acquire(ctx, estimate)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return utils.WithRetryGate(ctx, func(ctx context.Context, attempt int) error {
+		if err := d.limiter.Wait(ctx, estimate); err != nil {
+			return irr.Wrap(err, "wait for rate limit before attempt %d failed", attempt)
+		}
+		return nil
+	}), release, nil
+}
+
+func (d *Driver) Chat(ctx context.Context, messages []*history.Message) (string, error) {
+	ctx, release, err := d.acquire(ctx, messages)
+	if err != nil {
+		return "", irr.Wrap(err, "wait for rate limit failed")
+	}
+	defer release()
+
+	got, err := d.inner.Chat(ctx, messages)
+	d.limiter.Charge(utils.CountTokens(got))
+	return got, err
+}
+
+func (d *Driver) StreamChat(ctx context.Context, messages []*history.Message, handle func(got string)) error {
+	ctx, release, err := d.acquire(ctx, messages)
+	if err != nil {
+		return irr.Wrap(err, "wait for rate limit failed")
+	}
+	defer release()
+
+	sb := strings.Builder{}
+	err = d.inner.StreamChat(ctx, messages, func(got string) {
+		sb.WriteString(got)
+		handle(got)
+	})
+	d.limiter.Charge(utils.CountTokens(sb.String()))
+	return err
+}
+
+// SupportsTools inner 支持原生工具调用时返回 true
+func (d *Driver) SupportsTools() bool {
+	_, ok := driver.AsToolCaller(d.inner)
+	return ok
+}
+
+// ChatWithTools 与 Chat 相同的限流，转发给 inner 的原生工具调用
+func (d *Driver) ChatWithTools(ctx context.Context, messages []*history.Message, tools []driver.ToolDef) (string, []driver.ToolCall, error) {
+	ctx, release, err := d.acquire(ctx, messages)
+	if err != nil {
+		return "", nil, irr.Wrap(err, "wait for rate limit failed")
+	}
+	defer release()
+
+	content, calls, err := driver.ChatWithTools(ctx, d.inner, messages, tools)
+	d.limiter.Charge(utils.CountTokens(content) + utils.CountTokens(jsonex.MustMarshalToString(calls)))
+	return content, calls, err
+}
+
+// estimateTokens 预估 prompt 的 token 数
+func estimateTokens(messages []*history.Message) int {
+	n := 0
+	for _, m := range messages {
+		n += utils.CountTokens(m.Content)
+	}
+	return n
+}
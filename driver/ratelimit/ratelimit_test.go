@@ -0,0 +1,180 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/driver/mock"
+	"github.com/bagaking/botheater/driver/ratelimit"
+	"github.com/bagaking/botheater/history"
+	"github.com/bagaking/botheater/utils"
+)
+
+var q = []*history.Message{history.NewUserMsg("hello", "")}
+
+func TestLimiter_RPS(t *testing.T) {
+	d := ratelimit.New(mock.New(mock.Match(".*", "ok")), ratelimit.NewLimiter(ratelimit.Limits{RPS: 20, Burst: 1}))
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if _, err := d.Chat(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 第一次消耗 burst，后面三次各等待 50ms
+	if cost := time.Since(start); cost < 140*time.Millisecond {
+		t.Errorf("requests should be throttled, cost %v", cost)
+	}
+}
+
+func TestLimiter_MaxInFlight(t *testing.T) {
+	var cur, peak int32
+	inner := mock.New(mock.Func(func(history.Messages) (string, bool, error) {
+		n := atomic.AddInt32(&cur, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&cur, -1)
+		return "ok", true, nil
+	}))
+	d := ratelimit.New(inner, ratelimit.NewLimiter(ratelimit.Limits{MaxInFlight: 2}))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = d.Chat(context.Background(), q)
+		}()
+	}
+	wg.Wait()
+	if peak > 2 {
+		t.Errorf("in flight should not exceed 2, got %d", peak)
+	}
+}
+
+func TestLimiter_CancelWhileWaiting(t *testing.T) {
+	limiter := ratelimit.NewLimiter(ratelimit.Limits{RPS: 0.01, Burst: 1})
+	d := ratelimit.New(mock.New(mock.Match(".*", "ok")), limiter)
+	if _, err := d.Chat(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := d.Chat(ctx, q)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("waiting should stop once ctx is done")
+	}
+}
+
+func TestLimiter_TPM(t *testing.T) {
+	// 预算 600 tokens/min 即每秒补充 10，completion 的消耗会让下次请求欠账等待
+	limiter := ratelimit.NewLimiter(ratelimit.Limits{TPM: 600})
+	limiter.Charge(600)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.Acquire(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("budget is exhausted, want deadline exceeded, got %v", err)
+	}
+}
+
+func TestShared_ByEndpoint(t *testing.T) {
+	driver.Register("ratelimit_test_inner", func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		return mock.New(mock.Match(".*", conf.Endpoint)), nil
+	})
+	conf := func() driver.Config {
+		return driver.Config{
+			Driver: ratelimit.DriverName,
+			Options: map[string]any{
+				"max_in_flight": 1,
+				"inner":         map[string]any{"driver": "ratelimit_test_inner", "endpoint": "shared-model"},
+			},
+		}
+	}
+	if _, err := driver.New(context.Background(), conf()); err != nil {
+		t.Fatal(err)
+	}
+	a := ratelimit.Shared("ratelimit_test_inner:shared-model", ratelimit.Limits{MaxInFlight: 9})
+	if a.Limits().MaxInFlight != 1 {
+		t.Errorf("limiter should be shared by endpoint, got %+v", a.Limits())
+	}
+}
+
+func TestRateLimit_ChatWithTools(t *testing.T) {
+	inner := mock.NewToolDriver(func(_ history.Messages, tools []driver.ToolDef) (string, []driver.ToolCall, error) {
+		return "", []driver.ToolCall{{Name: tools[0].Name}}, nil
+	})
+	limiter := ratelimit.NewLimiter(ratelimit.Limits{MaxInFlight: 1})
+	tc, ok := driver.AsToolCaller(ratelimit.New(inner, limiter))
+	if !ok {
+		t.Fatalf("ratelimit should support tools when the inner driver does")
+	}
+	if _, calls, err := tc.ChatWithTools(context.Background(), q, []driver.ToolDef{{Name: "echo"}}); err != nil || len(calls) != 1 || inner.ToolCallCount() != 1 {
+		t.Errorf("tool calls should be forwarded, got %+v %v", calls, err)
+	}
+
+	plain := ratelimit.New(mock.New(mock.Match(".*", "ok")), limiter)
+	if _, ok = driver.AsToolCaller(plain); ok {
+		t.Errorf("ratelimit should not support tools when the inner driver does not")
+	}
+	if _, _, err := plain.ChatWithTools(context.Background(), q, nil); !errors.Is(err, driver.ErrToolsNotSupported) {
+		t.Errorf("expected not supported, got %v", err)
+	}
+}
+
+// retryingDriver 像 coze、openai 一样在内部通过 RetryPolicy 重试，前 failures 次返回 503
+type retryingDriver struct {
+	*mock.Driver
+	failures int32
+	attempts atomic.Int32
+}
+
+func (r *retryingDriver) Chat(ctx context.Context, messages []*history.Message) (got string, err error) {
+	policy := &utils.RetryPolicy{MaxAttempts: 5, Interval: time.Millisecond}
+	err = policy.Do(ctx, "retrying.chat", func() error {
+		if r.attempts.Add(1) <= r.failures {
+			return utils.WithHTTPStatus(errors.New("server busy"), 503)
+		}
+		got = "ok"
+		return nil
+	})
+	return got, err
+}
+
+func TestRateLimit_InnerRetry(t *testing.T) {
+	inner := &retryingDriver{Driver: mock.New(), failures: 2}
+	d := ratelimit.New(inner, ratelimit.NewLimiter(ratelimit.Limits{RPS: 20, Burst: 1}))
+
+	// 三次执行都需要令牌，第一次消耗 burst，后面两次各等待 50ms
+	start := time.Now()
+	if got, err := d.Chat(context.Background(), q); err != nil || got != "ok" {
+		t.Fatalf("chat failed: %q, %v", got, err)
+	}
+	if cost := time.Since(start); cost < 90*time.Millisecond || inner.attempts.Load() != 3 {
+		t.Errorf("every attempt should be throttled, cost %v, attempts %d", cost, inner.attempts.Load())
+	}
+
+	// 等待令牌时 ctx 结束，不再重试
+	inner = &retryingDriver{Driver: mock.New(), failures: 2}
+	d = ratelimit.New(inner, ratelimit.NewLimiter(ratelimit.Limits{RPS: 1, Burst: 1}))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := d.Chat(ctx, q); !errors.Is(err, context.DeadlineExceeded) || inner.attempts.Load() != 1 {
+		t.Errorf("retry should wait for the limiter, got %v, attempts %d", err, inner.attempts.Load())
+	}
+}
@@ -0,0 +1,74 @@
+package driver
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/khicago/irr"
+)
+
+// Factory 根据配置构建一个 Driver
+type Factory func(ctx context.Context, conf Config) (Driver, error)
+
+// DefaultDriverName 配置中没有写 driver 时使用的 driver
+const DefaultDriverName = "coze"
+
+var ErrDriverNotFound = irr.Error("driver not found")
+
+var (
+	factories   = make(map[string]Factory)
+	factoriesMu sync.RWMutex
+)
+
+// Register 注册一个 driver，通常在 driver 包的 init 中调用
+// 重复注册同一个名字或者 factory 为 nil 会 panic，和 database/sql 的行为保持一致
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("driver: register factory is nil, name= " + name)
+	}
+	if _, dup := factories[name]; dup {
+		panic("driver: register called twice, name= " + name)
+	}
+	factories[name] = factory
+}
+
+// Drivers 返回所有已注册的 driver 名字 (有序)
+func Drivers() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New 根据 conf.Driver 找到注册的 factory 并构建 Driver
+// conf.Driver 为空时使用 DefaultDriverName，找不到时返回 ErrDriverNotFound
+func New(ctx context.Context, conf Config) (Driver, error) {
+	name := conf.Driver
+	if name == "" {
+		name = DefaultDriverName
+	}
+
+	if err := conf.Retry.Validate(); err != nil {
+		return nil, irr.Wrap(err, "invalid retry policy for driver %s", name)
+	}
+
+	factoriesMu.RLock()
+	factory, ok := factories[name]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, irr.Wrap(ErrDriverNotFound, "unknown driver %q, registered drivers: %v", name, Drivers())
+	}
+
+	d, err := factory(ctx, conf)
+	if err != nil {
+		return nil, irr.Wrap(err, "create driver %s failed", name)
+	}
+	return d, nil
+}
@@ -0,0 +1,80 @@
+package driver_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
+	"github.com/bagaking/botheater/utils"
+)
+
+type echoDriver struct {
+	endpoint string
+}
+
+func (e *echoDriver) Chat(ctx context.Context, messages []*history.Message) (string, error) {
+	return e.endpoint, nil
+}
+
+func (e *echoDriver) StreamChat(ctx context.Context, messages []*history.Message, handle func(got string)) error {
+	handle(e.endpoint)
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	driver.Register("test_echo", func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		return &echoDriver{endpoint: conf.Endpoint}, nil
+	})
+	driver.Register("test_broken", func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		return nil, errors.New("broken")
+	})
+
+	d, err := driver.New(context.Background(), driver.Config{Driver: "test_echo", Endpoint: "ep-1"})
+	if err != nil {
+		t.Fatalf("new driver failed: %v", err)
+	}
+	if got, _ := d.Chat(context.Background(), nil); got != "ep-1" {
+		t.Errorf("factory did not receive config, got %q", got)
+	}
+
+	if _, err = driver.New(context.Background(), driver.Config{Driver: "test_broken"}); err == nil {
+		t.Errorf("expected factory error")
+	}
+
+	_, err = driver.New(context.Background(), driver.Config{Driver: "test_ech0"})
+	if !errors.Is(err, driver.ErrDriverNotFound) {
+		t.Fatalf("expected ErrDriverNotFound, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "test_ech0") || !strings.Contains(err.Error(), "test_echo") {
+		t.Errorf("error should name the unknown and the registered drivers, got %v", err)
+	}
+
+	names := strings.Join(driver.Drivers(), ",")
+	if !strings.Contains(names, "test_broken,test_echo") {
+		t.Errorf("unexpected drivers list %s", names)
+	}
+}
+
+func TestRegister_Duplicate(t *testing.T) {
+	factory := func(ctx context.Context, conf driver.Config) (driver.Driver, error) { return &echoDriver{}, nil }
+	driver.Register("test_dup", factory)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic on duplicate register")
+		}
+	}()
+	driver.Register("test_dup", factory)
+}
+
+func TestRegistry_InvalidRetryPolicy(t *testing.T) {
+	driver.Register("test_retry_echo", func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		return &echoDriver{endpoint: conf.Endpoint}, nil
+	})
+	_, err := driver.New(context.Background(), driver.Config{Driver: "test_retry_echo", Retry: &utils.RetryPolicy{Backoff: "random"}})
+	if err == nil || !strings.Contains(err.Error(), "unknown backoff") {
+		t.Errorf("invalid retry policy should fail at load, got %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package replay
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
+)
+
+type (
+	// Cassette 保存一次会话中所有的请求和返回，以 json 格式落盘
+	Cassette struct {
+		Version      int            `json:"version"`
+		Interactions []*Interaction `json:"interactions"`
+
+		path    string
+		mu      sync.Mutex
+		cursors map[string]int // key -> 已经回放的次数
+	}
+
+	// Interaction 一次请求和返回
+	Interaction struct {
+		Key      string            `json:"key"`
+		Kind     Kind              `json:"kind"`
+		Messages []*RecordedMsg    `json:"messages"`
+		Response string            `json:"response,omitempty"`
+		Chunks   []string          `json:"chunks,omitempty"`
+		Calls    []driver.ToolCall `json:"calls,omitempty"` // KindTools 返回的结构化调用
+	}
+
+	// RecordedMsg 落盘的消息，只用于人工排查，匹配只看 Key
+	RecordedMsg struct {
+		Role     history.Role `json:"role"`
+		Identity string       `json:"identity,omitempty"`
+		Content  string       `json:"content"`
+	}
+
+	Kind string
+)
+
+const (
+	KindChat   Kind = "chat"
+	KindStream Kind = "stream"
+	KindTools  Kind = "tools" // 原生工具调用
+
+	CassetteVersion = 1
+)
+
+var (
+	ErrCassetteMiss = irr.Error("cassette miss")
+
+	recordingMu sync.Mutex
+	recording   = make(map[string]*Cassette) // 绝对路径 -> 正在录制的 cassette
+)
+
+// NewCassette 创建一个空的 cassette, 写入时保存到 path
+func NewCassette(path string) *Cassette {
+	return &Cassette{
+		Version: CassetteVersion,
+		path:    path,
+		cursors: make(map[string]int),
+	}
+}
+
+// RecordingCassette 返回 path 对应的录制中的 cassette，同一个进程中对同一个 path 的录制共享一个 cassette
+// 多 agent 会话中的多个 bot 录制到同一个文件时，各自的交互都会被保留
+// 第一次获取时创建空的 cassette，写入时覆盖 path 上已有的文件
+func RecordingCassette(path string) *Cassette {
+	key := path
+	if abs, err := filepath.Abs(path); err == nil {
+		key = abs
+	}
+	recordingMu.Lock()
+	defer recordingMu.Unlock()
+	if c, ok := recording[key]; ok {
+		return c
+	}
+	c := NewCassette(path)
+	recording[key] = c
+	return c
+}
+
+// LoadCassette 从文件中读取 cassette
+func LoadCassette(path string) (*Cassette, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, irr.Wrap(err, "read cassette %s failed", path)
+	}
+	c := NewCassette(path)
+	if err = json.Unmarshal(raw, c); err != nil {
+		return nil, irr.Wrap(err, "decode cassette %s failed", path)
+	}
+	if c.Version != CassetteVersion {
+		return nil, irr.Error("cassette %s version %d is not supported, expected %d", path, c.Version, CassetteVersion)
+	}
+	return c, nil
+}
+
+// Key 计算请求的 key，对消息做归一化 (去掉首尾空白) 后取 sha256
+func Key(kind Kind, messages []*history.Message) string {
+	return driver.HashMessages(string(kind), messages)
+}
+
+// ToolsKey 计算原生工具调用的 key，工具定义也参与计算
+func ToolsKey(messages []*history.Message, tools []driver.ToolDef) string {
+	return driver.HashMessages(string(KindTools)+"\x00"+driver.HashTools(tools), messages)
+}
+
+// Next 按录制的顺序取出 key 对应的下一次交互
+// 同一个请求被录制了 N 次，就只能回放 N 次，超出或者找不到都返回 ErrCassetteMiss
+func (c *Cassette) Next(kind Kind, key string) (*Interaction, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen, total := c.cursors[key], 0
+	for _, it := range c.Interactions {
+		if it.Key != key || it.Kind != kind {
+			continue
+		}
+		if total == seen {
+			c.cursors[key] = seen + 1
+			return it, nil
+		}
+		total++
+	}
+	if total == 0 {
+		return nil, irr.Wrap(ErrCassetteMiss, "%s request %s is not recorded in %s", kind, key, c.path)
+	}
+	return nil, irr.Wrap(ErrCassetteMiss, "%s request %s is recorded %d times in %s, but requested %d times", kind, key, total, c.path, seen+1)
+}
+
+// has 是否录制过 kind 类型的交互
+func (c *Cassette) has(kind Kind) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, it := range c.Interactions {
+		if it.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Append 追加一次交互并立即保存
+func (c *Cassette) Append(it *Interaction) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Interactions = append(c.Interactions, it)
+	return c.save()
+}
+
+// save 先写临时文件再 rename，避免中途退出时留下半个文件
+// 每次保存使用不同的临时文件，并发保存时不会写到同一个文件中
+func (c *Cassette) save() error {
+	raw, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return irr.Wrap(err, "encode cassette failed")
+	}
+	dir := filepath.Dir(c.path)
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return irr.Wrap(err, "create cassette dir failed")
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(c.path)+".*.tmp")
+	if err != nil {
+		return irr.Wrap(err, "create temp cassette failed")
+	}
+	defer os.Remove(tmp.Name()) // rename 成功后是空操作
+	if _, err = tmp.Write(raw); err != nil {
+		_ = tmp.Close()
+		return irr.Wrap(err, "write cassette failed")
+	}
+	if err = tmp.Chmod(0o644); err != nil {
+		_ = tmp.Close()
+		return irr.Wrap(err, "write cassette failed")
+	}
+	if err = tmp.Close(); err != nil {
+		return irr.Wrap(err, "write cassette failed")
+	}
+	if err = os.Rename(tmp.Name(), c.path); err != nil {
+		return irr.Wrap(err, "save cassette failed")
+	}
+	return nil
+}
+
+func recordMessages(messages []*history.Message) []*RecordedMsg {
+	ret := make([]*RecordedMsg, 0, len(messages))
+	for _, m := range messages {
+		ret = append(ret, &RecordedMsg{Role: m.Role, Identity: m.Identity, Content: m.Content})
+	}
+	return ret
+}
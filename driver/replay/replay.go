@@ -0,0 +1,212 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/history"
+	"github.com/bagaking/botheater/utils"
+)
+
+type (
+	// Driver 录制/回放 driver
+	// 录制模式下转发请求到 inner，并把请求和返回写入 cassette；
+	// 回放模式下只从 cassette 中读取，找不到时直接报错
+	Driver struct {
+		mode     Mode
+		inner    driver.Driver
+		cassette *Cassette
+	}
+
+	// Options replay driver 的配置
+	//
+	//	driver: replay
+	//	driver_options:
+	//	  path: ./testdata/theater.cassette.json
+	//	  mode: record # 或 replay
+	//	  inner: # 录制时真正请求的 driver
+	//	    driver: coze
+	//	    endpoint: ep-xxx
+	Options struct {
+		Path  string        `yaml:"path" json:"path"`
+		Mode  Mode          `yaml:"mode,omitempty" json:"mode,omitempty"`
+		Inner driver.Config `yaml:"inner,omitempty" json:"inner,omitempty"`
+	}
+
+	Mode string
+)
+
+const (
+	DriverName = "replay"
+
+	ModeRecord Mode = "record"
+	ModeReplay Mode = "replay"
+)
+
+var (
+	_ driver.Driver        = new(Driver)
+	_ driver.ToolCaller    = new(Driver)
+	_ driver.ToolSupporter = new(Driver)
+)
+
+func init() {
+	driver.Register(DriverName, func(ctx context.Context, conf driver.Config) (driver.Driver, error) {
+		opts := &Options{}
+		if err := conf.DecodeOptions(opts); err != nil {
+			return nil, err
+		}
+		if opts.Path == "" {
+			return nil, irr.Error("replay driver requires driver_options.path")
+		}
+
+		switch opts.Mode {
+		case ModeRecord:
+			inner, err := driver.New(ctx, opts.Inner)
+			if err != nil {
+				return nil, irr.Wrap(err, "create inner driver failed")
+			}
+			return NewRecorder(inner, opts.Path), nil
+		case ModeReplay, "":
+			return NewPlayer(opts.Path)
+		}
+		return nil, irr.Error("unknown replay mode %q", opts.Mode)
+	})
+}
+
+// NewRecorder 创建录制模式的 driver，会覆盖 path 上已有的 cassette
+// 同一个进程中录制到同一个 path 的 driver 共享一个 cassette (见 RecordingCassette)
+func NewRecorder(inner driver.Driver, path string) *Driver {
+	return &Driver{
+		mode:     ModeRecord,
+		inner:    inner,
+		cassette: RecordingCassette(path),
+	}
+}
+
+// NewPlayer 创建回放模式的 driver
+func NewPlayer(path string) (*Driver, error) {
+	c, err := LoadCassette(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Driver{
+		mode:     ModeReplay,
+		cassette: c,
+	}, nil
+}
+
+func (d *Driver) Chat(ctx context.Context, messages []*history.Message) (string, error) {
+	log, ctx := wlog.ByCtxAndCache(ctx, "replay.chat")
+	key := Key(KindChat, messages)
+
+	if d.mode == ModeReplay {
+		it, err := d.cassette.Next(KindChat, key)
+		if err != nil {
+			log.WithError(err).Errorf("replay chat failed")
+			return "", err
+		}
+		d.debugFinish(log, key, it.Response)
+		return it.Response, nil
+	}
+
+	got, err := d.inner.Chat(ctx, messages)
+	if err != nil {
+		return "", err // 失败的请求不录制
+	}
+	if err = d.cassette.Append(&Interaction{
+		Key:      key,
+		Kind:     KindChat,
+		Messages: recordMessages(messages),
+		Response: got,
+	}); err != nil {
+		return "", irr.Wrap(err, "record chat failed")
+	}
+	return got, nil
+}
+
+func (d *Driver) StreamChat(ctx context.Context, messages []*history.Message, handle func(got string)) error {
+	log, ctx := wlog.ByCtxAndCache(ctx, "replay.stream")
+	key := Key(KindStream, messages)
+
+	if d.mode == ModeReplay {
+		it, err := d.cassette.Next(KindStream, key)
+		if err != nil {
+			log.WithError(err).Errorf("replay stream chat failed")
+			return err
+		}
+		for _, chunk := range it.Chunks {
+			handle(chunk)
+		}
+		return nil
+	}
+
+	chunks := make([]string, 0)
+	if err := d.inner.StreamChat(ctx, messages, func(got string) {
+		chunks = append(chunks, got)
+		handle(got)
+	}); err != nil {
+		return err
+	}
+	if err := d.cassette.Append(&Interaction{
+		Key:      key,
+		Kind:     KindStream,
+		Messages: recordMessages(messages),
+		Chunks:   chunks,
+	}); err != nil {
+		return irr.Wrap(err, "record stream chat failed")
+	}
+	return nil
+}
+
+// SupportsTools 录制时 inner 支持原生工具调用时返回 true，回放时 cassette 中录制过原生工具调用时返回 true
+func (d *Driver) SupportsTools() bool {
+	if d.mode == ModeReplay {
+		return d.cassette.has(KindTools)
+	}
+	_, ok := driver.AsToolCaller(d.inner)
+	return ok
+}
+
+// ChatWithTools 录制或回放原生工具调用，返回的结构化调用也会被录制
+func (d *Driver) ChatWithTools(ctx context.Context, messages []*history.Message, tools []driver.ToolDef) (string, []driver.ToolCall, error) {
+	log, ctx := wlog.ByCtxAndCache(ctx, "replay.tools")
+	key := ToolsKey(messages, tools)
+
+	if d.mode == ModeReplay {
+		it, err := d.cassette.Next(KindTools, key)
+		if err != nil {
+			log.WithError(err).Errorf("replay chat with tools failed")
+			return "", nil, err
+		}
+		d.debugFinish(log, key, it.Response)
+		return it.Response, it.Calls, nil
+	}
+
+	content, calls, err := driver.ChatWithTools(ctx, d.inner, messages, tools)
+	if err != nil {
+		return "", nil, err
+	}
+	if err = d.cassette.Append(&Interaction{
+		Key:      key,
+		Kind:     KindTools,
+		Messages: recordMessages(messages),
+		Response: content,
+		Calls:    calls,
+	}); err != nil {
+		return "", nil, irr.Wrap(err, "record chat with tools failed")
+	}
+	return content, calls, nil
+}
+
+func (d *Driver) debugFinish(log wlog.Log, key, got string) {
+	log.Debugf("\n%s\n",
+		utils.SPrintWithFrameCard(
+			fmt.Sprintf("replay driver <<< RESP (len:%d, key:%s)", len(got), key[:12]),
+			got, utils.PrintWidthL1, utils.StyTalk,
+		),
+	)
+}
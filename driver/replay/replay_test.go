@@ -0,0 +1,187 @@
+package replay_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/driver/mock"
+	"github.com/bagaking/botheater/driver/replay"
+	"github.com/bagaking/botheater/history"
+)
+
+// countingDriver 每次返回不同的内容，用来确认回放没有请求 inner
+type countingDriver struct {
+	calls int
+}
+
+func (c *countingDriver) Chat(ctx context.Context, messages []*history.Message) (string, error) {
+	c.calls++
+	return fmt.Sprintf("answer %d to %s", c.calls, messages[len(messages)-1].Content), nil
+}
+
+func (c *countingDriver) StreamChat(ctx context.Context, messages []*history.Message, handle func(got string)) error {
+	c.calls++
+	for _, s := range []string{"a", "b", fmt.Sprint(c.calls)} {
+		handle(s)
+	}
+	return nil
+}
+
+func TestReplay_RecordThenReplay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "session.cassette.json")
+	q1 := []*history.Message{history.NewSystemMsg("sys", ""), history.NewUserMsg("问题一", "")}
+	q2 := []*history.Message{history.NewSystemMsg("sys", ""), history.NewUserMsg("问题二", "")}
+
+	inner := &countingDriver{}
+	rec := replay.NewRecorder(inner, path)
+	var recorded []string
+	for _, q := range [][]*history.Message{q1, q2, q1} {
+		got, err := rec.Chat(ctx, q)
+		if err != nil {
+			t.Fatalf("record chat failed: %v", err)
+		}
+		recorded = append(recorded, got)
+	}
+	var recordedStream []string
+	if err := rec.StreamChat(ctx, q2, func(got string) { recordedStream = append(recordedStream, got) }); err != nil {
+		t.Fatalf("record stream failed: %v", err)
+	}
+
+	// 回放时忽略首尾空白的差异
+	q1Spaced := []*history.Message{history.NewSystemMsg(" sys\n", ""), history.NewUserMsg("问题一  ", "")}
+
+	player, err := driver.New(ctx, driver.Config{
+		Driver:  replay.DriverName,
+		Options: map[string]any{"path": path, "mode": "replay"},
+	})
+	if err != nil {
+		t.Fatalf("create player failed: %v", err)
+	}
+	var replayed []string
+	for _, q := range [][]*history.Message{q1Spaced, q2, q1} {
+		got, err := player.Chat(ctx, q)
+		if err != nil {
+			t.Fatalf("replay chat failed: %v", err)
+		}
+		replayed = append(replayed, got)
+	}
+	if strings.Join(replayed, "|") != strings.Join(recorded, "|") {
+		t.Errorf("replayed %v, recorded %v", replayed, recorded)
+	}
+
+	var replayedStream []string
+	if err = player.StreamChat(ctx, q2, func(got string) { replayedStream = append(replayedStream, got) }); err != nil {
+		t.Fatalf("replay stream failed: %v", err)
+	}
+	if strings.Join(replayedStream, "") != strings.Join(recordedStream, "") {
+		t.Errorf("replayed stream %v, recorded %v", replayedStream, recordedStream)
+	}
+	if inner.calls != 4 {
+		t.Errorf("inner should only be called while recording, calls= %d", inner.calls)
+	}
+
+	// q1 录制了两次，第三次请求以及从未录制过的请求都要报错
+	if _, err = player.Chat(ctx, q1); !errors.Is(err, replay.ErrCassetteMiss) {
+		t.Errorf("expected miss when exhausted, got %v", err)
+	}
+	if _, err = player.Chat(ctx, []*history.Message{history.NewUserMsg("没录过", "")}); !errors.Is(err, replay.ErrCassetteMiss) {
+		t.Errorf("expected miss for unknown request, got %v", err)
+	}
+}
+
+func TestReplay_Config(t *testing.T) {
+	ctx := context.Background()
+	if _, err := driver.New(ctx, driver.Config{Driver: replay.DriverName}); err == nil {
+		t.Errorf("expected error without path")
+	}
+	if _, err := driver.New(ctx, driver.Config{Driver: replay.DriverName, Options: map[string]any{"path": "x", "mode": "rewind"}}); err == nil {
+		t.Errorf("expected error for unknown mode")
+	}
+	if _, err := driver.New(ctx, driver.Config{Driver: replay.DriverName, Options: map[string]any{"path": filepath.Join(t.TempDir(), "none.json")}}); err == nil {
+		t.Errorf("expected error for missing cassette")
+	}
+}
+
+func TestReplay_SharedCassette(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "theater.cassette.json")
+	q1 := []*history.Message{history.NewUserMsg("问 bot 一", "")}
+	q2 := []*history.Message{history.NewUserMsg("问 bot 二", "")}
+
+	// 多 agent 会话中两个 bot 录制到同一个文件，并发请求
+	wg := sync.WaitGroup{}
+	for _, q := range [][]*history.Message{q1, q2} {
+		rec := replay.NewRecorder(&countingDriver{}, path)
+		wg.Add(1)
+		go func(q []*history.Message) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				if _, err := rec.Chat(ctx, q); err != nil {
+					t.Errorf("record chat failed: %v", err)
+				}
+			}
+		}(q)
+	}
+	wg.Wait()
+
+	player, err := replay.NewPlayer(path)
+	if err != nil {
+		t.Fatalf("create player failed: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		for _, q := range [][]*history.Message{q1, q2} {
+			if _, err = player.Chat(ctx, q); err != nil {
+				t.Fatalf("both bots should be replayed, %d: %v", i, err)
+			}
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temp files should not be left behind, got %v", entries)
+	}
+}
+
+func TestReplay_ChatWithTools(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tools.cassette.json")
+	q := []*history.Message{history.NewUserMsg("查一下", "")}
+	tools := []driver.ToolDef{{Name: "echo", Params: []driver.ToolParam{{Name: "text"}}}}
+
+	inner := mock.NewToolDriver(func(history.Messages, []driver.ToolDef) (string, []driver.ToolCall, error) {
+		return "我来查一下", []driver.ToolCall{{ID: "call_1", Name: "echo", Arguments: map[string]any{"text": "hi"}}}, nil
+	})
+	rec := replay.NewRecorder(inner, path)
+	if _, ok := driver.AsToolCaller(rec); !ok {
+		t.Fatalf("recorder should support tools when the inner driver does")
+	}
+	if _, _, err := rec.ChatWithTools(ctx, q, tools); err != nil {
+		t.Fatalf("record failed: %v", err)
+	}
+
+	player, err := replay.NewPlayer(path)
+	if err != nil {
+		t.Fatalf("create player failed: %v", err)
+	}
+	tc, ok := driver.AsToolCaller(player)
+	if !ok {
+		t.Fatalf("player should support tools when they were recorded")
+	}
+	content, calls, err := tc.ChatWithTools(ctx, q, tools)
+	if err != nil || content != "我来查一下" || len(calls) != 1 || calls[0].ID != "call_1" || calls[0].Arguments["text"] != "hi" {
+		t.Errorf("tool calls should be replayed, got %q %+v %v", content, calls, err)
+	}
+	if _, _, err = tc.ChatWithTools(ctx, q, []driver.ToolDef{{Name: "search"}}); !errors.Is(err, replay.ErrCassetteMiss) {
+		t.Errorf("different tools should miss, got %v", err)
+	}
+	if inner.ToolCallCount() != 1 {
+		t.Errorf("inner should only be called while recording, calls= %d", inner.ToolCallCount())
+	}
+}
@@ -0,0 +1,107 @@
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/history"
+)
+
+type (
+	// ToolDef 以原生方式下发给模型的工具定义
+	ToolDef struct {
+		Name        string      `json:"name"`
+		Description string      `json:"description"`
+		Params      []ToolParam `json:"params"`
+	}
+
+	// ToolParam 工具的参数定义
+	ToolParam struct {
+		Name        string   `json:"name"`
+		Type        string   `json:"type,omitempty"` // JSON schema 中的类型，为空时是 string
+		Description string   `json:"description,omitempty"`
+		Required    bool     `json:"required,omitempty"`
+		Enum        []string `json:"enum,omitempty"`
+	}
+
+	// ToolCall 模型返回的结构化调用，与 history 中记录的调用是同一个类型
+	ToolCall = history.ToolCall
+
+	// ToolCaller driver 的可选能力，支持原生工具调用协议 (如 ollama 和 openai 的 tools)
+	// 不支持的 driver 由调用方回退到文本协议 (func_call::name(params))，判断时使用 AsToolCaller
+	ToolCaller interface {
+		ChatWithTools(ctx context.Context, messages []*history.Message, tools []ToolDef) (content string, calls []ToolCall, err error)
+	}
+
+	// ToolSupporter 包装其他 driver 的 driver (如 cache、composite、ratelimit 和 replay) 总是实现 ToolCaller
+	// 通过 SupportsTools 告知内部的 driver 是否真正支持原生工具调用
+	ToolSupporter interface {
+		SupportsTools() bool
+	}
+)
+
+var ErrToolsNotSupported = irr.Error("driver does not support native tool calls")
+
+// AsToolCaller 返回 d 的原生工具调用能力，d 没有实现 ToolCaller 或者包装的 driver 不支持时返回 false
+func AsToolCaller(d Driver) (ToolCaller, bool) {
+	tc, ok := d.(ToolCaller)
+	if !ok {
+		return nil, false
+	}
+	if s, ok := d.(ToolSupporter); ok && !s.SupportsTools() {
+		return nil, false
+	}
+	return tc, true
+}
+
+// ChatWithTools 包装的 driver 转发原生工具调用时使用，inner 不支持时返回 ErrToolsNotSupported
+func ChatWithTools(ctx context.Context, inner Driver, messages []*history.Message, tools []ToolDef) (string, []ToolCall, error) {
+	tc, ok := AsToolCaller(inner)
+	if !ok {
+		return "", nil, irr.Wrap(ErrToolsNotSupported, "%T", inner)
+	}
+	return tc.ChatWithTools(ctx, messages, tools)
+}
+
+// HashTools 计算工具定义的哈希，用于缓存和录制的 key
+func HashTools(tools []ToolDef) string {
+	raw, _ := json.Marshal(tools)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// ParamType 返回参数的 JSON schema 类型
+func (p ToolParam) ParamType() string {
+	if p.Type == "" {
+		return "string"
+	}
+	return p.Type
+}
+
+// JSONSchema 把参数转成 JSON schema (type: object)
+func (t ToolDef) JSONSchema() map[string]any {
+	properties := make(map[string]any, len(t.Params))
+	required := make([]string, 0, len(t.Params))
+	for _, p := range t.Params {
+		prop := map[string]any{"type": p.ParamType()}
+		if p.Description != "" {
+			prop["description"] = p.Description
+		}
+		if len(p.Enum) > 0 {
+			prop["enum"] = p.Enum
+		}
+		properties[p.Name] = prop
+		if p.Required {
+			required = append(required, p.Name)
+		}
+	}
+	return map[string]any{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
@@ -0,0 +1,200 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bagaking/botheater/history"
+	"github.com/bagaking/botheater/utils"
+)
+
+type (
+	// Usage 一次 driver 调用的消耗
+	Usage struct {
+		Model            string        `yaml:"model,omitempty" json:"model,omitempty"`
+		PromptTokens     int           `yaml:"prompt_tokens" json:"prompt_tokens"`
+		CompletionTokens int           `yaml:"completion_tokens" json:"completion_tokens"`
+		TotalTokens      int           `yaml:"total_tokens" json:"total_tokens"`
+		Latency          time.Duration `yaml:"latency" json:"latency"`
+	}
+
+	// UsageStat 多次调用聚合后的消耗
+	UsageStat struct {
+		Calls            int           `yaml:"calls" json:"calls"`
+		PromptTokens     int           `yaml:"prompt_tokens" json:"prompt_tokens"`
+		CompletionTokens int           `yaml:"completion_tokens" json:"completion_tokens"`
+		TotalTokens      int           `yaml:"total_tokens" json:"total_tokens"`
+		Latency          time.Duration `yaml:"latency" json:"latency"`
+	}
+
+	// UsageReport 一次运行 (workflow、theater 等) 的消耗报告，分别按 agent、node、model 聚合，并发安全
+	UsageReport struct {
+		mu      sync.Mutex
+		total   UsageStat
+		byAgent map[string]*UsageStat
+		byNode  map[string]*UsageStat
+		byModel map[string]*UsageStat
+	}
+
+	ctxKeyUsageReport struct{}
+)
+
+// UnknownUsageKey agent、node 或 model 未知时使用的 key
+const UnknownUsageKey = "-"
+
+func (s *UsageStat) add(u Usage) {
+	s.Calls++
+	s.PromptTokens += u.PromptTokens
+	s.CompletionTokens += u.CompletionTokens
+	s.TotalTokens += u.TotalTokens
+	s.Latency += u.Latency
+}
+
+func (s UsageStat) String() string {
+	return fmt.Sprintf("calls=%d prompt=%d completion=%d total=%d latency=%v",
+		s.Calls, s.PromptTokens, s.CompletionTokens, s.TotalTokens, s.Latency.Round(time.Millisecond))
+}
+
+func NewUsageReport() *UsageReport {
+	return &UsageReport{
+		byAgent: make(map[string]*UsageStat),
+		byNode:  make(map[string]*UsageStat),
+		byModel: make(map[string]*UsageStat),
+	}
+}
+
+// WithUsageReport 在 ctx 中注入消耗报告，之后所有 driver 调用的消耗都会记入其中
+func WithUsageReport(ctx context.Context, r *UsageReport) context.Context {
+	return context.WithValue(ctx, ctxKeyUsageReport{}, r)
+}
+
+// UsageReportFromCtx 获取 ctx 中的消耗报告
+func UsageReportFromCtx(ctx context.Context) (*UsageReport, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	r, ok := ctx.Value(ctxKeyUsageReport{}).(*UsageReport)
+	return r, ok && r != nil
+}
+
+// EnsureUsageReport ctx 中已有报告时直接复用 (比如 workflow 嵌套在 theater 中)，否则创建一个新的
+func EnsureUsageReport(ctx context.Context) (context.Context, *UsageReport) {
+	if r, ok := UsageReportFromCtx(ctx); ok {
+		return ctx, r
+	}
+	r := NewUsageReport()
+	return WithUsageReport(ctx, r), r
+}
+
+// RecordUsage 由 driver 在每次请求完成后调用，把消耗记入 ctx 中的报告，ctx 中没有报告时忽略
+// agent 和 node 从 ctx 中读取，分别由 Bot 和 workflow 注入
+func RecordUsage(ctx context.Context, u Usage) {
+	r, ok := UsageReportFromCtx(ctx)
+	if !ok {
+		return
+	}
+	agent, _ := utils.ExtractAgentLogKey(ctx)
+	node, _ := utils.ExtractNodeName(ctx)
+	r.Add(agent, node, u)
+}
+
+// EstimateUsage 服务端没有返回消耗时，按内容估算
+func EstimateUsage(model string, messages []*history.Message, completion string) Usage {
+	prompt := 0
+	for _, m := range messages {
+		prompt += utils.CountTokens(m.Content)
+	}
+	completionTokens := utils.CountTokens(completion)
+	return Usage{
+		Model:            model,
+		PromptTokens:     prompt,
+		CompletionTokens: completionTokens,
+		TotalTokens:      prompt + completionTokens,
+	}
+}
+
+// Add 记入一次消耗，TotalTokens 为空时使用 prompt + completion
+func (r *UsageReport) Add(agent, node string, u Usage) {
+	if u.TotalTokens == 0 {
+		u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total.add(u)
+	addTo(r.byAgent, agent, u)
+	addTo(r.byNode, node, u)
+	addTo(r.byModel, u.Model, u)
+}
+
+func addTo(m map[string]*UsageStat, key string, u Usage) {
+	if key == "" {
+		key = UnknownUsageKey
+	}
+	s, ok := m[key]
+	if !ok {
+		s = &UsageStat{}
+		m[key] = s
+	}
+	s.add(u)
+}
+
+// Total 返回所有调用的总消耗
+func (r *UsageReport) Total() UsageStat {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.total
+}
+
+// ByAgent 按 agent (bot 的 prefab name) 聚合的消耗
+func (r *UsageReport) ByAgent() map[string]UsageStat {
+	return r.copyOf(r.byAgent)
+}
+
+// ByNode 按 workflow node 聚合的消耗，不在 workflow 中的调用记在 UnknownUsageKey 下
+func (r *UsageReport) ByNode() map[string]UsageStat {
+	return r.copyOf(r.byNode)
+}
+
+// ByModel 按模型 (endpoint) 聚合的消耗
+func (r *UsageReport) ByModel() map[string]UsageStat {
+	return r.copyOf(r.byModel)
+}
+
+func (r *UsageReport) copyOf(m map[string]*UsageStat) map[string]UsageStat {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := make(map[string]UsageStat, len(m))
+	for k, v := range m {
+		ret[k] = *v
+	}
+	return ret
+}
+
+// String 打印报告，便于输出到日志
+func (r *UsageReport) String() string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("total: %s\n", r.Total()))
+	for _, group := range []struct {
+		name  string
+		stats map[string]UsageStat
+	}{
+		{"agent", r.ByAgent()},
+		{"node", r.ByNode()},
+		{"model", r.ByModel()},
+	} {
+		sb.WriteString(fmt.Sprintf("by %s:\n", group.name))
+		keys := make([]string, 0, len(group.stats))
+		for k := range group.stats {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sb.WriteString(fmt.Sprintf("  %s: %s\n", k, group.stats[k]))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,58 @@
+package driver_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/utils"
+)
+
+func TestUsageReport_Aggregate(t *testing.T) {
+	ctx, report := driver.EnsureUsageReport(context.Background())
+	if again, same := driver.EnsureUsageReport(ctx); same != report || again != ctx {
+		t.Fatalf("report in ctx should be reused")
+	}
+
+	agentA := utils.InjectNodeName(utils.InjectAgentLogKey(ctx, "a"), "extract")
+	agentB := utils.InjectAgentLogKey(ctx, "b")
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			driver.RecordUsage(agentA, driver.Usage{Model: "m1", PromptTokens: 10, CompletionTokens: 2, Latency: time.Millisecond})
+		}()
+		go func() {
+			defer wg.Done()
+			driver.RecordUsage(agentB, driver.Usage{Model: "m2", PromptTokens: 5, CompletionTokens: 1, TotalTokens: 7})
+		}()
+	}
+	wg.Wait()
+
+	if total := report.Total(); total.Calls != 20 || total.TotalTokens != 190 || total.Latency != 10*time.Millisecond {
+		t.Errorf("unexpected total %+v", total)
+	}
+	if a := report.ByAgent()["a"]; a.Calls != 10 || a.PromptTokens != 100 || a.TotalTokens != 120 {
+		t.Errorf("unexpected agent a %+v", a)
+	}
+	byNode := report.ByNode()
+	if byNode["extract"].Calls != 10 || byNode[driver.UnknownUsageKey].Calls != 10 {
+		t.Errorf("unexpected by node %+v", byNode)
+	}
+	if m2 := report.ByModel()["m2"]; m2.TotalTokens != 70 {
+		t.Errorf("unexpected model m2 %+v", m2)
+	}
+	if s := report.String(); !strings.Contains(s, "by node:") || !strings.Contains(s, "extract: calls=10") {
+		t.Errorf("unexpected report string:\n%s", s)
+	}
+}
+
+func TestRecordUsage_WithoutReport(t *testing.T) {
+	// ctx 中没有报告时直接忽略
+	driver.RecordUsage(context.Background(), driver.Usage{PromptTokens: 1})
+}
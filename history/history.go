@@ -20,6 +20,9 @@ const (
 	RoleUser   Role = "user"
 	RoleBot    Role = "bot"
 	RoleSystem Role = "system"
+
+	// RoleTool 原生工具调用协议中的调用结果，通过 Message.ToolCallID 对应到调用
+	RoleTool Role = "tool"
 )
 
 // NewHistory 创建一个新的 History 实例
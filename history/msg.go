@@ -18,6 +18,22 @@ type (
 
 		// Role 角色
 		Role
+
+		// Parts 附加的图片、文件等片段，支持的 driver 会将其下发给模型
+		Parts []Part `json:",omitempty" yaml:",omitempty"`
+
+		// ToolCalls 原生工具调用协议中，模型在这条消息里返回的结构化调用
+		ToolCalls []ToolCall `json:",omitempty" yaml:",omitempty"`
+
+		// ToolCallID RoleTool 消息对应的调用
+		ToolCallID string `json:",omitempty" yaml:",omitempty"`
+	}
+
+	// ToolCall 模型通过原生工具调用协议返回的结构化调用
+	ToolCall struct {
+		ID        string         `json:"id,omitempty"`
+		Name      string         `json:"name"`
+		Arguments map[string]any `json:"arguments"`
 	}
 
 	Messages = []*Message
@@ -31,6 +47,12 @@ func (m *Message) AppendContent(more string) *Message {
 	return m
 }
 
+// WithToolCalls 附加模型返回的结构化调用
+func (m *Message) WithToolCalls(calls ...ToolCall) *Message {
+	m.ToolCalls = append(m.ToolCalls, calls...)
+	return m
+}
+
 var (
 	MSGFunctionContinue = &Message{
 		Role:     RoleUser,
@@ -100,6 +122,16 @@ func NewUserMsg(content, identity string) *Message {
 	}
 }
 
+// NewToolResultMsg 原生工具调用协议中的调用结果，callID 是对应的 ToolCall.ID
+func NewToolResultMsg(callID, name, result string) *Message {
+	return &Message{
+		Content:    result,
+		Identity:   name,
+		Role:       RoleTool,
+		ToolCallID: callID,
+	}
+}
+
 func NewSystemMsg(content, identity string) *Message {
 	return &Message{
 		Content:  content,
@@ -123,6 +155,7 @@ func PushFunctionResultMSG(msgs Messages, insertions ...string) Messages {
 		// todo: merge 规则可以调整
 		for l := len(msgs); l > 0 && typer.SliceLast(msgs).Identity == tool.Caller.Prefix; l = len(msgs) { // merge calls
 			mCall.Content = typer.SliceLast(msgs).Content + "\n\n" + cmd
+			mCall.Parts = append(typer.SliceLast(msgs).Parts, mCall.Parts...)
 			msgs = msgs[:l-1]
 		}
 		msgs = append(msgs, mCall)
@@ -0,0 +1,115 @@
+package history
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type (
+	PartType string
+
+	// Part 消息中附加的片段，Message.Content 仍然是消息的主体文本
+	// 图片可以是原始数据 (Data + MIME) 或者地址 (URL)，文件只是一个引用 (Path)，由 driver 决定如何下发
+	Part struct {
+		Type PartType `json:"type"`
+		Text string   `json:"text,omitempty"`
+		Data []byte   `json:"data,omitempty"`
+		MIME string   `json:"mime,omitempty"`
+		URL  string   `json:"url,omitempty"`
+		Path string   `json:"path,omitempty"`
+	}
+)
+
+const (
+	PartText  PartType = "text"
+	PartImage PartType = "image"
+	PartFile  PartType = "file"
+)
+
+func TextPart(text string) Part {
+	return Part{Type: PartText, Text: text}
+}
+
+// ImagePart 图片数据，mime 为空时根据内容推断
+func ImagePart(data []byte, mime string) Part {
+	if mime == "" {
+		mime = http.DetectContentType(data)
+	}
+	return Part{Type: PartImage, Data: data, MIME: mime}
+}
+
+func ImageURLPart(url string) Part {
+	return Part{Type: PartImage, URL: url}
+}
+
+func FilePart(path, mime string) Part {
+	return Part{Type: PartFile, Path: path, MIME: mime}
+}
+
+// DataURL 返回图片的地址，有原始数据时转成 data:<mime>;base64,... 的形式
+func (p Part) DataURL() string {
+	if len(p.Data) == 0 {
+		return p.URL
+	}
+	return "data:" + p.MIME + ";base64," + base64.StdEncoding.EncodeToString(p.Data)
+}
+
+// Describe 返回片段的文本描述，用于日志，以及不支持该类型的 driver
+func (p Part) Describe() string {
+	switch p.Type {
+	case PartText:
+		return p.Text
+	case PartImage:
+		if len(p.Data) == 0 {
+			return fmt.Sprintf("[image: %s]", p.URL)
+		}
+		return fmt.Sprintf("[image: %s, %.1fKB]", p.MIME, float64(len(p.Data))/1024)
+	case PartFile:
+		return fmt.Sprintf("[file: %s]", p.Path)
+	}
+	return fmt.Sprintf("[%s]", p.Type)
+}
+
+// WithParts 附加片段
+func (m *Message) WithParts(parts ...Part) *Message {
+	m.Parts = append(m.Parts, parts...)
+	return m
+}
+
+// Images 返回所有图片片段
+func (m *Message) Images() []Part {
+	var ret []Part
+	for _, p := range m.Parts {
+		if p.Type == PartImage {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// Text 返回消息的全部文本: Content 加上文本片段和文件引用，图片不包含在内
+func (m *Message) Text() string {
+	sb := strings.Builder{}
+	sb.WriteString(m.Content)
+	for _, p := range m.Parts {
+		if p.Type == PartImage {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(p.Describe())
+	}
+	return sb.String()
+}
+
+// PushFunctionResultWithParts 与 PushFunctionResultMSG 相同，并把 parts (如工具返回的图片) 附加到函数结果消息上
+func PushFunctionResultWithParts(msgs Messages, result string, parts ...Part) Messages {
+	msgs = PushFunctionResultMSG(msgs, result)
+	if len(parts) > 0 {
+		msgs[len(msgs)-1].WithParts(parts...)
+	}
+	return msgs
+}
@@ -3,7 +3,10 @@ package rag_extract
 import (
 	"context"
 
+	"github.com/khicago/got/util/typer"
+
 	"github.com/bagaking/botheater/bot"
+	"github.com/bagaking/botheater/driver"
 	"github.com/bagaking/botheater/utils"
 	"github.com/bagaking/botheater/workflow"
 	"github.com/bagaking/botheater/workflow/nodes"
@@ -29,6 +32,8 @@ func Play(ctx context.Context, loader *bot.Loader) {
 		ChunkSize: 3 * 1024,
 	}
 	ctx = workflow.WithCtx(ctx, wfCtx)
+	// 抽取任务需要稳定的输出，所有 bot 都以 temperature 0 运行
+	ctx = driver.WithGenerationParams(ctx, &driver.GenerationParams{Temperature: typer.Ptr(0.0)})
 	logger := wlog.ByCtx(ctx, "TryWorkflow")
 
 	use := UsingBots{}
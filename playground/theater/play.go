@@ -11,6 +11,7 @@ import (
 	"github.com/khicago/got/util/typer"
 
 	"github.com/bagaking/botheater/bot"
+	"github.com/bagaking/botheater/driver"
 	"github.com/bagaking/botheater/history"
 )
 
@@ -55,6 +56,7 @@ func Play(ctx context.Context, loader *bot.Loader) {
 func MultiAgentChat(ctx context.Context, h *history.History, question string, bots ...*bot.Bot) {
 	l2, ctx := wlog.ByCtxAndRemoveCache(ctx, "MultiAgentChat")
 	log := l2.WithField("mode", "auto")
+	ctx, usage := driver.EnsureUsageReport(ctx)
 
 	if len(bots) == 0 {
 		return
@@ -83,6 +85,10 @@ func MultiAgentChat(ctx context.Context, h *history.History, question string, bo
 		}
 		log.Infof("enter new round= %d", i)
 		content, err := bCur.SendChat(ctx, h)
+		if ctx.Err() != nil { // 整个会话被取消或超时，不再继续
+			log.WithError(err).Warnf("chat interrupted at round %d", i)
+			return
+		}
 		if err != nil {
 			log.WithError(err).Errorf("chat failed")
 			h.EnqueueAssistantMsg("chat failed, err: "+err.Error(), bCur.PrefabName)
@@ -164,4 +170,6 @@ func MultiAgentChat(ctx context.Context, h *history.History, question string, bo
 
 	log.Infof("\n%s\n",
 		utils.SPrintWithFrameCard("CHAT ANSWER", answer, utils.PrintWidthL1, utils.StyConclusion))
+	log.Infof("\n%s\n",
+		utils.SPrintWithFrameCard("USAGE", usage.String(), utils.PrintWidthL1, utils.StyConclusion))
 }
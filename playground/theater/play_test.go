@@ -0,0 +1,72 @@
+package theater_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/bagaking/botheater/bot"
+	"github.com/bagaking/botheater/call/tool"
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/driver/mock"
+	"github.com/bagaking/botheater/history"
+	"github.com/bagaking/botheater/playground/theater"
+)
+
+func TestMultiAgentChat_CoordinatorLoop(t *testing.T) {
+	tm := tool.NewToolManager()
+
+	dCoord := mock.New(
+		mock.Match(`^帮我写个笑话$`, `交给写手。agent_call::writer("写一个程序员笑话")`),
+		mock.Match(theater.ContinueMessage, "任务完成，笑话已经写好了"),
+	)
+	dWriter := mock.New(mock.Sequence("为什么程序员分不清万圣节和圣诞节？因为 Oct 31 == Dec 25"))
+
+	coordinator := bot.New(bot.Config{
+		PrefabName: "coordinator",
+		AckAs:      bot.ActAsCoordinator,
+		Prompt:     &bot.Prompt{Content: "你负责分派任务"},
+	}, dCoord, tm)
+	writer := bot.New(bot.Config{
+		PrefabName: "writer",
+		Usage:      "写笑话",
+		Prompt:     &bot.Prompt{Content: "你负责写笑话"},
+	}, dWriter, tm)
+	bot.InitActAsForBots(context.Background(), coordinator, writer)
+
+	h := history.NewHistory()
+	ctx, usage := driver.EnsureUsageReport(context.Background())
+	theater.MultiAgentChat(ctx, h, "帮我写个笑话", writer, coordinator)
+
+	if dCoord.CallCount() != 2 || dWriter.CallCount() != 1 {
+		t.Fatalf("unexpected rounds, coordinator= %d writer= %d", dCoord.CallCount(), dWriter.CallCount())
+	}
+
+	// 协调者的 prompt 中注入了其他 agent 的信息
+	if sys := dCoord.Call(0)[0].Content; !strings.Contains(sys, "writer") || !strings.Contains(sys, bot.CallPrefix) {
+		t.Errorf("coordinator prompt should list agents:\n%s", sys)
+	}
+
+	// 写手收到的是协调者整理后的任务，协调者的决策过程被移除
+	writerReq := mock.Transcript(dWriter.Call(0))
+	if !strings.Contains(writerReq, "决定接下来 agent::writer 来做") || strings.Contains(writerReq, "交给写手") {
+		t.Errorf("unexpected writer request:\n%s", writerReq)
+	}
+
+	// 写手回答后回到协调者，协调者没有再指派 agent 时结束
+	coordReq := dCoord.Call(1)
+	if last := coordReq[len(coordReq)-1]; last.Content != theater.ContinueMessage {
+		t.Errorf("should ask coordinator to continue, got %+v", last)
+	}
+
+	tail, _ := h.PeekTail()
+	if tail.Identity != "coordinator" || !strings.Contains(tail.Content, "任务完成") {
+		t.Errorf("unexpected final message %+v", tail)
+	}
+
+	// 消耗按 agent 聚合
+	byAgent := usage.ByAgent()
+	if byAgent["coordinator"].Calls != 2 || byAgent["writer"].Calls != 1 || byAgent["writer"].CompletionTokens == 0 {
+		t.Errorf("unexpected usage by agent %+v", byAgent)
+	}
+}
@@ -1,12 +1,14 @@
 package tools
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/khicago/irr"
@@ -22,7 +24,14 @@ type (
 	}
 )
 
-var _ tool.ITool = &Browser{}
+var (
+	_ tool.IConcurrentTool = &Browser{}
+	_ tool.IContextTool    = &Browser{}
+	_ tool.ITimeoutTool    = &Browser{}
+	_ tool.IBudgetTool     = &Browser{}
+)
+
+const browserTimeout = 30 * time.Second
 
 func (b *Browser) Name() string {
 	return "browser"
@@ -40,7 +49,27 @@ func (b *Browser) ParamNames() []string {
 	return []string{"url"}
 }
 
+// Concurrent 每次请求互不影响，可以并发执行
+func (b *Browser) Concurrent() bool {
+	return true
+}
+
+// Budget 页面内容通常很长，默认分页返回，避免一次塞满上下文
+func (b *Browser) Budget() *tool.Budget {
+	return &tool.Budget{MaxTokens: 6000, Strategy: tool.BudgetPage}
+}
+
+// Timeout 单个页面的超时时间
+func (b *Browser) Timeout() time.Duration {
+	return browserTimeout
+}
+
 func (b *Browser) Execute(params map[string]string) (any, error) {
+	return b.ExecuteContext(context.Background(), params)
+}
+
+// ExecuteContext 访问页面，ctx 被取消时请求会被中断
+func (b *Browser) ExecuteContext(ctx context.Context, params map[string]string) (any, error) {
 	urlStr, ok := params["url"]
 	if !ok {
 		return nil, irr.Wrap(call.ErrExecFailedInvalidParams, "parameter 'url' is required in %v", params)
@@ -54,7 +83,11 @@ func (b *Browser) Execute(params map[string]string) (any, error) {
 		return nil, irr.Wrap(call.ErrExecFailedInvalidParams, "invalid url format")
 	}
 
-	resp, err := http.Get(urlStr)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/khicago/irr"
 
 	"github.com/bagaking/botheater/call"
 	"github.com/bagaking/botheater/call/tool"
+	"github.com/bagaking/botheater/history"
 )
 
 // LocalFileReader 结构体
@@ -20,9 +22,25 @@ type (
 	}
 )
 
-var _ tool.ITool = &LocalFileReader{}
+var (
+	_ tool.IConcurrentTool = &LocalFileReader{}
+	_ tool.ISchemaTool     = &LocalFileReader{}
+	_ tool.IBudgetTool     = &LocalFileReader{}
+)
 
-const maxFileSize = 10 * 1024
+const (
+	maxFileSize  = 1024 * 1024 // 超出输出预算的内容由 Manager 分页返回
+	maxImageSize = 4 * 1024 * 1024
+)
+
+// imageMIMEs 按扩展名识别的图片类型，读取这些文件时返回图片片段，由 bot 附加到下一轮对话中
+var imageMIMEs = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
 
 // Name 返回工具名称
 func (l *LocalFileReader) Name() string {
@@ -38,6 +56,7 @@ func (l *LocalFileReader) Examples() []string {
 		"local_file_reader(.) // 获得根目录下文件列表",
 		"local_file_reader(./bots) // 获得子目录下所有文件列表",
 		"local_file_reader(./README.md) // 读取 README.md 这个文件中的内容",
+		"local_file_reader(./docs/arch.png) // 读取图片，图片会附加在之后的对话中",
 	}
 }
 
@@ -45,6 +64,22 @@ func (l *LocalFileReader) ParamNames() []string {
 	return []string{"path"}
 }
 
+func (l *LocalFileReader) ParamSchemas() []tool.ParamSchema {
+	return []tool.ParamSchema{
+		{Name: "path", Description: "文件或目录的路径，相对路径基于当前工作目录", Required: true},
+	}
+}
+
+// Concurrent 只读文件系统，可以并发执行
+func (l *LocalFileReader) Concurrent() bool {
+	return true
+}
+
+// Budget 大文件分页返回，模型可以通过 read_more 继续读取
+func (l *LocalFileReader) Budget() *tool.Budget {
+	return &tool.Budget{MaxTokens: 6000, Strategy: tool.BudgetPage}
+}
+
 // Execute 执行文件读取操作
 func (l *LocalFileReader) Execute(param map[string]string) (any, error) {
 	path, ok := param["path"]
@@ -68,6 +103,9 @@ func (l *LocalFileReader) Execute(param map[string]string) (any, error) {
 		return l.readDirectory(path)
 	} else {
 		fmt.Printf("read file: %s\n", path)
+		if mime, ok := imageMIMEs[strings.ToLower(filepath.Ext(path))]; ok {
+			return l.readImage(path, mime, info.Size())
+		}
 		return l.readFile(path, info.Size())
 	}
 }
@@ -107,3 +145,17 @@ func (l *LocalFileReader) readFile(path string, size int64) (string, error) {
 
 	return string(content), nil
 }
+
+// readImage 读取图片，返回图片片段
+func (l *LocalFileReader) readImage(path, mime string, size int64) (history.Part, error) {
+	if size > maxImageSize {
+		return history.Part{}, errors.New("图片过大")
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return history.Part{}, err
+	}
+
+	return history.ImagePart(content, mime), nil
+}
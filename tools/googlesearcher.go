@@ -1,7 +1,9 @@
 package tools
 
 import (
+	"context"
 	"net/url"
+	"time"
 
 	"github.com/khicago/irr"
 
@@ -16,7 +18,12 @@ type (
 	}
 )
 
-var _ tool.ITool = &GoogleSearcher{}
+var (
+	_ tool.IConcurrentTool = &GoogleSearcher{}
+	_ tool.ISchemaTool     = &GoogleSearcher{}
+	_ tool.IContextTool    = &GoogleSearcher{}
+	_ tool.ITimeoutTool    = &GoogleSearcher{}
+)
 
 func (g *GoogleSearcher) Name() string {
 	return "google_searcher"
@@ -27,14 +34,36 @@ func (g *GoogleSearcher) Usage() string {
 }
 
 func (g *GoogleSearcher) Examples() []string {
-	return []string{"google_searcher(\"golang tutorial\")"}
+	return []string{"google_searcher(\"golang tutorial\")", "google_searcher(\"vector database\", num=5)"}
 }
 
 func (g *GoogleSearcher) ParamNames() []string {
-	return []string{"query"}
+	return []string{"query", "num"}
+}
+
+func (g *GoogleSearcher) ParamSchemas() []tool.ParamSchema {
+	return []tool.ParamSchema{
+		{Name: "query", Description: "搜索的内容", Required: true},
+		{Name: "num", Type: tool.ParamTypeInteger, Description: "返回的结果条数", Default: "10"},
+	}
+}
+
+// Concurrent 每次请求互不影响，可以并发执行
+func (g *GoogleSearcher) Concurrent() bool {
+	return true
+}
+
+// Timeout 与 browser 相同
+func (g *GoogleSearcher) Timeout() time.Duration {
+	return browserTimeout
 }
 
 func (g *GoogleSearcher) Execute(params map[string]string) (any, error) {
+	return g.ExecuteContext(context.Background(), params)
+}
+
+// ExecuteContext 通过 browser 访问搜索页面，ctx 被取消时请求会被中断
+func (g *GoogleSearcher) ExecuteContext(ctx context.Context, params map[string]string) (any, error) {
 	query, ok := params["query"]
 	if !ok {
 		return nil, irr.Wrap(call.ErrExecFailedInvalidParams, "parameter 'query' is required in %v", params)
@@ -44,8 +73,11 @@ func (g *GoogleSearcher) Execute(params map[string]string) (any, error) {
 	}
 
 	searchURL := "https://www.google.com/search?q=" + url.QueryEscape(query)
+	if num, ok := params["num"]; ok {
+		searchURL += "&num=" + num
+	}
 	browser := &Browser{}
-	result, err := browser.Execute(map[string]string{"url": searchURL})
+	result, err := browser.ExecuteContext(ctx, map[string]string{"url": searchURL})
 	if err != nil {
 		return nil, err
 	}
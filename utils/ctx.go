@@ -9,6 +9,7 @@ type CtxKey string
 const (
 	CtxKeyAgentLog      CtxKey = "agent_log"
 	CtxKeyAgentIdentity CtxKey = "agent_id"
+	CtxKeyNodeName      CtxKey = "node_name"
 )
 
 // InjectAgentLogKey 将 bot 的 prefabName 注入到 context 中
@@ -36,3 +37,17 @@ func ExtractAgentID(ctx context.Context) (string, bool) {
 	botID, ok := ctx.Value(CtxKeyAgentIdentity).(string)
 	return botID, ok
 }
+
+// InjectNodeName 将当前执行的 workflow node 名注入到 context 中
+func InjectNodeName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, CtxKeyNodeName, name)
+}
+
+// ExtractNodeName 从 context 中获取当前执行的 workflow node 名
+func ExtractNodeName(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	name, ok := ctx.Value(CtxKeyNodeName).(string)
+	return name, ok
+}
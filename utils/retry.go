@@ -0,0 +1,404 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/got/util/proretry"
+	"github.com/khicago/irr"
+)
+
+type (
+	// ErrClass 错误的分类，决定是否重试
+	ErrClass string
+
+	// RetryPolicy 重试策略，可以直接写在 yaml 中
+	//
+	//	retry:
+	//	  max_attempts: 5
+	//	  backoff: exponential # constant | linear | exponential | fibonacci
+	//	  interval: 1s
+	//	  max_interval: 30s
+	//	  retry_on: [rate_limit, server, timeout]
+	RetryPolicy struct {
+		// MaxAttempts 最多执行的次数 (包括第一次)，不填时为 3
+		MaxAttempts int `yaml:"max_attempts,omitempty" json:"max_attempts,omitempty"`
+
+		// Backoff 间隔的增长方式，不填时为 linear
+		Backoff string `yaml:"backoff,omitempty" json:"backoff,omitempty"`
+
+		// Interval 第一次重试前的等待时间，不填时为 2s
+		Interval time.Duration `yaml:"interval,omitempty" json:"interval,omitempty"`
+
+		// MaxInterval 单次等待的上限，不填时不限制
+		MaxInterval time.Duration `yaml:"max_interval,omitempty" json:"max_interval,omitempty"`
+
+		// RetryOn 需要重试的错误分类，不填时除 fatal 以外都会重试
+		RetryOn []ErrClass `yaml:"retry_on,omitempty" json:"retry_on,omitempty"`
+	}
+
+	// RetryEvent 每次失败时发出的事件，GiveUp 为 true 表示不再重试
+	RetryEvent struct {
+		Name        string
+		Attempt     int
+		MaxAttempts int
+		Class       ErrClass
+		Err         error
+		Wait        time.Duration
+		GiveUp      bool
+	}
+
+	// RetryError 重试结束 (次数用完或者遇到不可重试的错误) 时返回，可以通过 errors.As 获取分类
+	RetryError struct {
+		Name     string
+		Attempts int
+		Class    ErrClass
+		LastErr  error
+	}
+
+	// RetryStat 按分类汇总的重试情况
+	RetryStat struct {
+		Failures int
+		GiveUps  int
+		Wait     time.Duration
+	}
+
+	// RetryRecorder 收集重试事件，通过 WithRetryListener 注入 ctx
+	RetryRecorder struct {
+		mu      sync.Mutex
+		byClass map[ErrClass]*RetryStat
+		byName  map[string]*RetryStat
+	}
+
+	// HTTPStatusError 带有 http 状态码的错误，用于分类
+	HTTPStatusError interface {
+		HTTPStatus() int
+	}
+
+	classifiedErr struct {
+		error
+		class ErrClass
+	}
+
+	statusErr struct {
+		error
+		status int
+	}
+
+	ctxKeyRetryListener struct{}
+	ctxKeyRetryGate     struct{}
+)
+
+const (
+	ErrClassRateLimit ErrClass = "rate_limit"
+	ErrClassServer    ErrClass = "server"
+	ErrClassTimeout   ErrClass = "timeout"
+	ErrClassParse     ErrClass = "parse"
+	ErrClassFatal     ErrClass = "fatal"
+	ErrClassUnknown   ErrClass = "unknown"
+
+	BackoffConstant    = "constant"
+	BackoffLinear      = "linear"
+	BackoffExponential = "exponential"
+	BackoffFibonacci   = "fibonacci"
+)
+
+var (
+	// DefaultDriverRetry driver 请求使用的默认策略
+	DefaultDriverRetry = &RetryPolicy{MaxAttempts: 3, Backoff: BackoffLinear, Interval: time.Second * 2}
+
+	// DefaultNodeRetry workflow 节点 (bot 请求或者解析失败) 使用的默认策略
+	DefaultNodeRetry = &RetryPolicy{MaxAttempts: 3, Backoff: BackoffFibonacci, Interval: time.Second * 2}
+)
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%s failed after %d attempts (%s): %v", e.Name, e.Attempts, e.Class, e.LastErr)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.LastErr
+}
+
+func (e *statusErr) Unwrap() error   { return e.error }
+func (e *statusErr) HTTPStatus() int { return e.status }
+
+func (e *classifiedErr) Unwrap() error { return e.error }
+
+// WithHTTPStatus 为底层 client 的错误附加 http 状态码，status 为 0 时原样返回
+func WithHTTPStatus(err error, status int) error {
+	if err == nil || status == 0 {
+		return err
+	}
+	return &statusErr{error: err, status: status}
+}
+
+// MarkErrClass 直接指定错误的分类，如解析模型的返回失败时标记为 ErrClassParse
+func MarkErrClass(err error, class ErrClass) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedErr{error: err, class: class}
+}
+
+// ClassifyErr 错误分类，优先使用 MarkErrClass 指定的分类，其次是 ctx 错误、http 状态码和网络超时
+func ClassifyErr(err error) ErrClass {
+	if err == nil {
+		return ""
+	}
+	ce := &classifiedErr{}
+	if errors.As(err, &ce) {
+		return ce.class
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrClassFatal
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrClassTimeout
+	}
+	var se HTTPStatusError
+	if errors.As(err, &se) {
+		switch status := se.HTTPStatus(); {
+		case status == http.StatusTooManyRequests:
+			return ErrClassRateLimit
+		case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+			return ErrClassTimeout
+		case status >= 500:
+			return ErrClassServer
+		case status >= 400:
+			return ErrClassFatal // 鉴权失败、参数错误等，重试也不会成功
+		}
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return ErrClassTimeout
+	}
+	return ErrClassUnknown
+}
+
+// Retryable 判断该分类是否需要重试
+func (p *RetryPolicy) Retryable(class ErrClass) bool {
+	if len(p.RetryOn) == 0 {
+		return class != ErrClassFatal
+	}
+	for _, c := range p.RetryOn {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate 检查配置是否合法
+func (p *RetryPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.MaxAttempts < 0 || p.Interval < 0 || p.MaxInterval < 0 {
+		return irr.Error("retry policy must not be negative, got %+v", *p)
+	}
+	if _, err := p.backoff(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *RetryPolicy) backoff() (proretry.Backoff, error) {
+	interval := p.interval()
+	switch strings.ToLower(p.Backoff) {
+	case BackoffConstant:
+		return proretry.ConstantBackoff(interval), nil
+	case BackoffLinear, "":
+		return proretry.LinearBackoff(interval), nil
+	case BackoffExponential:
+		return proretry.ExponentialBackoff(interval), nil
+	case BackoffFibonacci:
+		return proretry.FibonacciBackoff(interval), nil
+	}
+	return nil, irr.Error("unknown backoff %q", p.Backoff)
+}
+
+func (p *RetryPolicy) interval() time.Duration {
+	if p.Interval > 0 {
+		return p.Interval
+	}
+	return time.Second * 2
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts > 0 {
+		return p.MaxAttempts
+	}
+	return 3
+}
+
+// Do 按策略执行 fn，name 用于日志和事件
+// 遇到不可重试的错误或者次数用完时返回 *RetryError；等待期间 ctx 结束时立即返回 ctx.Err()，fn 失败时如果 ctx 已经结束也不再重试
+// p 为 nil 时使用 DefaultDriverRetry
+func (p *RetryPolicy) Do(ctx context.Context, name string, fn func() error) error {
+	if p == nil {
+		p = DefaultDriverRetry
+	}
+	backoff, err := p.backoff()
+	if err != nil {
+		return err
+	}
+
+	maxAttempts, interval := p.maxAttempts(), p.interval()
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			if err = passRetryGates(ctx, attempt); err != nil {
+				return err
+			}
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		class := ClassifyErr(err)
+		wait := interval
+		if p.MaxInterval > 0 && wait > p.MaxInterval {
+			wait = p.MaxInterval
+		}
+		event := RetryEvent{Name: name, Attempt: attempt, MaxAttempts: maxAttempts, Class: class, Err: err, Wait: wait}
+		if attempt >= maxAttempts || !p.Retryable(class) {
+			event.Wait, event.GiveUp = 0, true
+			emitRetryEvent(ctx, event)
+			return &RetryError{Name: name, Attempts: attempt, Class: class, LastErr: err}
+		}
+		emitRetryEvent(ctx, event)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		interval = backoff(interval)
+	}
+}
+
+// WithRetryGate 注册重试前的检查，每次重试 (第 2 次及以后的执行) 前按注册顺序调用，返回错误时不再重试并返回这个错误
+// 用于让 Do 内部的重试也受到外层的约束，比如限流器为每次重试都扣除令牌
+func WithRetryGate(ctx context.Context, gate func(ctx context.Context, attempt int) error) context.Context {
+	gates, _ := ctx.Value(ctxKeyRetryGate{}).([]func(context.Context, int) error)
+	return context.WithValue(ctx, ctxKeyRetryGate{}, append(gates[:len(gates):len(gates)], gate))
+}
+
+func passRetryGates(ctx context.Context, attempt int) error {
+	gates, _ := ctx.Value(ctxKeyRetryGate{}).([]func(context.Context, int) error)
+	for _, gate := range gates {
+		if err := gate(ctx, attempt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithRetryListener 注册重试事件的监听，可以多次注册，事件按注册顺序依次通知
+func WithRetryListener(ctx context.Context, listener func(RetryEvent)) context.Context {
+	listeners, _ := ctx.Value(ctxKeyRetryListener{}).([]func(RetryEvent))
+	return context.WithValue(ctx, ctxKeyRetryListener{}, append(listeners[:len(listeners):len(listeners)], listener))
+}
+
+func emitRetryEvent(ctx context.Context, e RetryEvent) {
+	log := wlog.ByCtx(ctx, "retry").WithError(e.Err)
+	if e.GiveUp {
+		log.Warnf("%s give up at attempt %d/%d, class= %s", e.Name, e.Attempt, e.MaxAttempts, e.Class)
+	} else {
+		log.Warnf("%s failed at attempt %d/%d, class= %s, retry after %v", e.Name, e.Attempt, e.MaxAttempts, e.Class, e.Wait)
+	}
+	listeners, _ := ctx.Value(ctxKeyRetryListener{}).([]func(RetryEvent))
+	for _, l := range listeners {
+		l(e)
+	}
+}
+
+func NewRetryRecorder() *RetryRecorder {
+	return &RetryRecorder{
+		byClass: make(map[ErrClass]*RetryStat),
+		byName:  make(map[string]*RetryStat),
+	}
+}
+
+// Record 记录一次事件，可以直接作为 WithRetryListener 的 listener
+func (r *RetryRecorder) Record(e RetryEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, stat := range []*RetryStat{ensureRetryStat(r.byClass, e.Class), ensureRetryStat(r.byName, e.Name)} {
+		stat.Failures++
+		stat.Wait += e.Wait
+		if e.GiveUp {
+			stat.GiveUps++
+		}
+	}
+}
+
+// ByClass 返回按分类汇总的快照
+func (r *RetryRecorder) ByClass() map[ErrClass]RetryStat {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copyRetryStats(r.byClass)
+}
+
+// ByName 返回按名字 (如 openai.chat) 汇总的快照
+func (r *RetryRecorder) ByName() map[string]RetryStat {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copyRetryStats(r.byName)
+}
+
+func (r *RetryRecorder) String() string {
+	sb := strings.Builder{}
+	byClass, byName := r.ByClass(), r.ByName()
+	sb.WriteString("by class:\n")
+	for _, class := range sortedKeys(byClass) {
+		sb.WriteString(fmt.Sprintf("  %s: %s\n", class, byClass[class]))
+	}
+	sb.WriteString("by name:\n")
+	for _, name := range sortedKeys(byName) {
+		sb.WriteString(fmt.Sprintf("  %s: %s\n", name, byName[name]))
+	}
+	return sb.String()
+}
+
+func (s RetryStat) String() string {
+	return fmt.Sprintf("failures=%d give_ups=%d wait=%v", s.Failures, s.GiveUps, s.Wait)
+}
+
+func sortedKeys[K ~string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func ensureRetryStat[K comparable](m map[K]*RetryStat, key K) *RetryStat {
+	if s, ok := m[key]; ok {
+		return s
+	}
+	s := &RetryStat{}
+	m[key] = s
+	return s
+}
+
+func copyRetryStats[K comparable](m map[K]*RetryStat) map[K]RetryStat {
+	ret := make(map[K]RetryStat, len(m))
+	for k, v := range m {
+		ret[k] = *v
+	}
+	return ret
+}
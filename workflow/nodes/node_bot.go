@@ -4,21 +4,21 @@ import (
 	"context"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/khicago/got/util/contraver"
-	"github.com/khicago/got/util/proretry"
 
 	"github.com/khicago/irr"
 
 	"github.com/bagaking/botheater/bot"
 	"github.com/bagaking/botheater/history"
+	"github.com/bagaking/botheater/utils"
 	"github.com/bagaking/botheater/workflow"
 )
 
 type WFBotNode struct {
 	*bot.Bot
 	afterFunc func(answer string) (any, error)
+	retry     *utils.RetryPolicy
 	his       *history.History
 }
 
@@ -86,7 +86,7 @@ func (n *WFBotNode) Execute(ctx context.Context, params workflow.ParamsTable, si
 
 		var item any
 
-		if err = proretry.Run(func() error { // bot 请求错误，或者解析错误，都会进行重试
+		if err = retryBot(ctx, n.retry, n.Bot, func() error {
 			output := ""
 			his := n.his
 			if his == nil {
@@ -101,14 +101,11 @@ func (n *WFBotNode) Execute(ctx context.Context, params workflow.ParamsTable, si
 
 			if n.afterFunc != nil {
 				if item, err = n.afterFunc(output); err != nil {
-					return irr.Wrap(err, "after func failed when handle str= `%s`", output)
+					return utils.MarkErrClass(irr.Wrap(err, "after func failed when handle str= `%s`", output), utils.ErrClassParse)
 				}
 			}
 			return nil
-		}, 3,
-			proretry.WithInitInterval(time.Second*2),
-			proretry.WithBackoff(proretry.FibonacciBackoff(time.Second*2)),
-		); err != nil {
+		}); err != nil {
 			execErr = irr.Wrap(err, "bot question failed, input= %s", strings.Replace(t.input, "\n", "\\n", -1))
 			return
 		}
@@ -149,6 +146,12 @@ func (n *WFBotNode) Execute(ctx context.Context, params workflow.ParamsTable, si
 	return "success", nil
 }
 
+// WithRetry 设置 bot 请求或者解析失败时的重试策略，nil 时使用 bot 配置中的 node_retry 或 utils.DefaultNodeRetry
+func (n *WFBotNode) WithRetry(p *utils.RetryPolicy) *WFBotNode {
+	n.retry = p
+	return n
+}
+
 func (n *WFBotNode) Name() string {
 	return n.Bot.PrefabName
 }
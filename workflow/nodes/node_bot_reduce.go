@@ -4,19 +4,19 @@ import (
 	"context"
 	"fmt"
 	"strings"
-	"time"
 
-	"github.com/khicago/got/util/proretry"
 	"github.com/khicago/irr"
 
 	"github.com/bagaking/botheater/bot"
 	"github.com/bagaking/botheater/history"
+	"github.com/bagaking/botheater/utils"
 	"github.com/bagaking/botheater/workflow"
 )
 
 type WFBotReduce struct {
 	*bot.Bot
 	afterFunc func(answer string) (any, error)
+	retry     *utils.RetryPolicy
 }
 
 func NewBotReduceWorkflowNode(botGist *bot.Bot, afterFunc func(answer string) (any, error)) *WFBotReduce {
@@ -50,21 +50,18 @@ func (n *WFBotReduce) Execute(ctx context.Context, params workflow.ParamsTable,
 		output = ""
 	)
 	for i, input := range inputLst {
-		if err = proretry.Run(func() error { // bot 请求错误，或者解析错误，都会进行重试
+		if err = retryBot(ctx, n.retry, n.Bot, func() error {
 			if output, err = n.Bot.Question(ctx, history.NewHistory(), fmt.Sprintf("%v\n\n%v", output, input)); err != nil {
 				return irr.Wrap(err, "bot question failed, reduce round %d, input= `%s`", i, strings.Replace(input, "\n", "\\n", -1))
 			}
 			item = output
 			if n.afterFunc != nil && i == len(inputLst)-1 {
 				if item, err = n.afterFunc(output); err != nil {
-					return irr.Wrap(err, "after func failed when handle str= `%s`", output)
+					return utils.MarkErrClass(irr.Wrap(err, "after func failed when handle str= `%s`", output), utils.ErrClassParse)
 				}
 			}
 			return nil
-		}, 3,
-			proretry.WithInitInterval(time.Second*2),
-			proretry.WithBackoff(proretry.FibonacciBackoff(time.Second*2)),
-		); err != nil {
+		}); err != nil {
 			return "", irr.Wrap(err, "bot question failed, input= `%s`", strings.Replace(input, "\n", "\\n", -1))
 		}
 	}
@@ -78,6 +75,12 @@ func (n *WFBotReduce) Execute(ctx context.Context, params workflow.ParamsTable,
 	return "success", nil
 }
 
+// WithRetry 设置 bot 请求或者解析失败时的重试策略，nil 时使用 bot 配置中的 node_retry 或 utils.DefaultNodeRetry
+func (n *WFBotReduce) WithRetry(p *utils.RetryPolicy) *WFBotReduce {
+	n.retry = p
+	return n
+}
+
 func (n *WFBotReduce) Name() string {
 	return n.Bot.PrefabName
 }
@@ -4,20 +4,20 @@ import (
 	"context"
 	"fmt"
 	"strings"
-	"time"
 
 	"github.com/khicago/got/util/contraver"
-	"github.com/khicago/got/util/proretry"
 	"github.com/khicago/irr"
 
 	"github.com/bagaking/botheater/bot"
 	"github.com/bagaking/botheater/history"
+	"github.com/bagaking/botheater/utils"
 	"github.com/bagaking/botheater/workflow"
 )
 
 type WFBotWithHistoryNode struct {
 	*bot.Bot
 	afterFunc func(answer string) (any, error)
+	retry     *utils.RetryPolicy
 }
 
 const (
@@ -75,7 +75,7 @@ func (n *WFBotWithHistoryNode) Execute(ctx context.Context, params workflow.Para
 
 	contraver.TraverseAndWait(tasks, func(t task) {
 		var item any
-		if err = proretry.Run(func() error { // bot 请求错误，或者解析错误，都会进行重试
+		if err = retryBot(ctx, n.retry, n.Bot, func() error {
 			output := ""
 			his := history.NewHistory()
 			his.EnqueueAssistantMsg(fmt.Sprintf("%v", _history), "workflow")
@@ -85,14 +85,11 @@ func (n *WFBotWithHistoryNode) Execute(ctx context.Context, params workflow.Para
 			item = output
 			if n.afterFunc != nil {
 				if item, err = n.afterFunc(output); err != nil {
-					return irr.Wrap(err, "after func failed when handle str= `%s`", output)
+					return utils.MarkErrClass(irr.Wrap(err, "after func failed when handle str= `%s`", output), utils.ErrClassParse)
 				}
 			}
 			return nil
-		}, 3,
-			proretry.WithInitInterval(time.Second*2),
-			proretry.WithBackoff(proretry.FibonacciBackoff(time.Second*2)),
-		); err != nil {
+		}); err != nil {
 			execErr = irr.Wrap(err, "bot question failed, input=%s", t.input)
 			return
 		}
@@ -131,6 +128,12 @@ func (n *WFBotWithHistoryNode) Execute(ctx context.Context, params workflow.Para
 	return "success", nil
 }
 
+// WithRetry 设置 bot 请求或者解析失败时的重试策略，nil 时使用 bot 配置中的 node_retry 或 utils.DefaultNodeRetry
+func (n *WFBotWithHistoryNode) WithRetry(p *utils.RetryPolicy) *WFBotWithHistoryNode {
+	n.retry = p
+	return n
+}
+
 func (n *WFBotWithHistoryNode) Name() string {
 	return n.Bot.PrefabName
 }
@@ -0,0 +1,79 @@
+package nodes
+
+import (
+	"context"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/workflow"
+)
+
+// WFEmbedNode 获取输入文本的向量，embedder 可以是 driver.NewEmbedder 创建的实例，也可以直接使用 *bot.Bot
+type WFEmbedNode struct {
+	Embedder driver.Embedder
+	name     string
+}
+
+const (
+	InNameEmbed  = "input"
+	OutNameEmbed = "vectors"
+)
+
+var _ workflow.NodeDef = &WFEmbedNode{}
+
+func NewEmbedNode(name string, embedder driver.Embedder) *WFEmbedNode {
+	return &WFEmbedNode{
+		Embedder: embedder,
+		name:     name,
+	}
+}
+
+// Execute
+// in - input: string 或 []string (如 chunk 节点的输出)
+// out - vectors: 输入为 string 时输出 []float32，否则输出与输入一一对应的 [][]float32
+func (n *WFEmbedNode) Execute(ctx context.Context, params workflow.ParamsTable, signal workflow.SignalTarget) (log string, err error) {
+	var texts []string
+	single := false
+	switch t := params[InNameEmbed].(type) {
+	case string:
+		texts, single = []string{t}, true
+	case []string:
+		texts = t
+	default:
+		return "", irr.Error("input param must be string or []string, got %T", t)
+	}
+
+	vectors, err := n.Embedder.Embed(ctx, texts)
+	if err != nil {
+		return "", irr.Wrap(err, "embed failed")
+	}
+	wlog.ByCtx(ctx, "embed").Infof("embed %d texts", len(texts))
+
+	var output any = vectors
+	if single {
+		output = vectors[0]
+	}
+	if finish, err := signal(ctx, OutNameEmbed, output); err != nil {
+		return "", irr.Wrap(err, "signal failed")
+	} else if !finish {
+		return "", irr.Error("signal not finished")
+	}
+	return "success", nil
+}
+
+func (n *WFEmbedNode) Name() string {
+	if n.name == "" {
+		return "embed"
+	}
+	return n.name
+}
+
+func (n *WFEmbedNode) InNames() []string {
+	return []string{InNameEmbed}
+}
+
+func (n *WFEmbedNode) OutNames() []string {
+	return []string{OutNameEmbed}
+}
@@ -0,0 +1,24 @@
+package nodes
+
+import (
+	"context"
+
+	"github.com/bagaking/botheater/bot"
+	"github.com/bagaking/botheater/utils"
+)
+
+// retryBot bot 节点执行 fn，bot 请求错误或者解析错误时按重试策略重试
+// 策略依次是节点上 WithRetry 设置的、bot 配置中的 node_retry 和 utils.DefaultNodeRetry
+func retryBot(ctx context.Context, override *utils.RetryPolicy, b *bot.Bot, fn func() error) error {
+	return nodeRetryPolicy(override, b).Do(ctx, "node."+b.PrefabName, fn)
+}
+
+func nodeRetryPolicy(override *utils.RetryPolicy, b *bot.Bot) *utils.RetryPolicy {
+	if override != nil {
+		return override
+	}
+	if b.Config != nil && b.NodeRetry != nil {
+		return b.NodeRetry
+	}
+	return utils.DefaultNodeRetry
+}
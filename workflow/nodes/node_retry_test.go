@@ -0,0 +1,51 @@
+package nodes_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/bagaking/botheater/bot"
+	"github.com/bagaking/botheater/driver/mock"
+	"github.com/bagaking/botheater/history"
+	"github.com/bagaking/botheater/utils"
+	"github.com/bagaking/botheater/workflow"
+	"github.com/bagaking/botheater/workflow/nodes"
+)
+
+func TestBotNode_NodeRetryFromConfig(t *testing.T) {
+	conf := bot.Config{}
+	if err := yaml.Unmarshal([]byte("prefab_name: flaky\nnode_retry: {max_attempts: 4, interval: 1ms}\n"), &conf); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	attempts := 0
+	d := mock.New(mock.Func(func(history.Messages) (string, bool, error) {
+		attempts++
+		if attempts < 4 {
+			return "", true, errors.New("server busy")
+		}
+		return "ok", true, nil
+	}))
+
+	var got any
+	signal := func(ctx context.Context, paramName string, data any) (bool, error) {
+		got = data
+		return true, nil
+	}
+	node := nodes.NewBotReduceWorkflowNode(bot.New(conf, d, nil), nil)
+	if _, err := node.Execute(context.Background(), workflow.ParamsTable{nodes.InNameBotQuestion: "q"}, signal); err != nil {
+		t.Fatalf("node should succeed within node_retry, got %v", err)
+	}
+	if attempts != 4 || got != "ok" {
+		t.Errorf("node_retry should be used, attempts %d, got %v", attempts, got)
+	}
+
+	// 节点上设置的策略优先
+	attempts = 0
+	_, err := node.WithRetry(&utils.RetryPolicy{MaxAttempts: 1}).Execute(context.Background(), workflow.ParamsTable{nodes.InNameBotQuestion: "q"}, signal)
+	if err == nil || attempts != 1 {
+		t.Errorf("retry of the node should override node_retry, attempts %d, err %v", attempts, err)
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"github.com/khicago/got/util/contraver"
 	"github.com/khicago/got/util/typer"
 	"github.com/khicago/irr"
+
+	"github.com/bagaking/botheater/driver"
+	"github.com/bagaking/botheater/utils"
 )
 
 type (
@@ -17,7 +20,9 @@ type (
 		EndNode   Node
 		Output    ParamsTable
 
-		fakeN Node
+		fakeN   Node
+		usage   *driver.UsageReport
+		retries *utils.RetryRecorder
 	}
 )
 
@@ -30,6 +35,16 @@ func New(name string) *Workflow {
 	}
 }
 
+// Usage 返回最近一次 Execute 的消耗报告，ctx 中已有报告时 (如嵌套在 theater 中) 与其共享
+func (wf *Workflow) Usage() *driver.UsageReport {
+	return wf.usage
+}
+
+// Retries 返回最近一次 Execute 中发生的重试，按错误分类和来源 (driver 或 node) 汇总
+func (wf *Workflow) Retries() *utils.RetryRecorder {
+	return wf.retries
+}
+
 func (wf *Workflow) Finished() bool {
 	return wf.Output != nil
 }
@@ -122,6 +137,10 @@ func (wf *Workflow) Execute(ctx context.Context, initParams ParamsTable) (Params
 		return nil, irr.Wrap(err, "workflow validate failed")
 	}
 
+	ctx, wf.usage = driver.EnsureUsageReport(ctx)
+	wf.retries = utils.NewRetryRecorder()
+	ctx = utils.WithRetryListener(ctx, wf.retries.Record)
+
 	executionList := make([]Node, 0)
 	if err := wf.callStart(ctx, initParams); err != nil {
 		return nil, irr.Wrap(err, "call start failed")
@@ -165,6 +184,8 @@ func (wf *Workflow) Execute(ctx context.Context, initParams ParamsTable) (Params
 		// 如果没有 Output，说明工作流没有结束, 但却没有可执行的节点了
 		return nil, irr.Wrap(ErrWorkflowIsNotFinish, "executed= %v", allExecuted)
 	}
+	logger.Infof("usage of workflow:\n%s", wf.usage)
+	logger.Infof("retries of workflow:\n%s", wf.retries)
 	return wf.Output, nil
 }
 
@@ -190,7 +211,7 @@ func executeNodesConcurrently(ctx context.Context, nodes []Node) ([]Node, error)
 
 	contraver.TraverseAndWait(nodes, func(n Node) {
 		logger := wlog.ByCtx(ctx, n.String())
-		log, execErr := n.Execute(ctx)
+		log, execErr := n.Execute(utils.InjectNodeName(ctx, n.Name()))
 		if execErr != nil {
 			logger.Errorf("node %s execute failed: %v", n, execErr)
 			err = execErr